@@ -0,0 +1,166 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	cmd2 "github.com/TheNatureOfSoftware/k3pi/pkg/cmd"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/logging"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/misc"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/secrets"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/spec"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"strings"
+)
+
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Brings a cluster to the state described by a cluster spec",
+	Long: `Compares a cluster spec with the inventory of the cluster and the installed
+nodes, prints the changes and executes them when confirmed. New nodes are
+installed, nodes whose k3os config differs from the spec get the new config
+and are rebooted, nodes no longer in the spec are drained, k3s is stopped on
+them and they are removed from the cluster, and changed addon manifests are
+deployed on the server. Applying an unchanged spec does nothing.
+
+	A spec, cluster.yaml, with one listed server and agents picked from scan output
+	version: 1
+	name: pearl
+	versions:
+	  k3os: v0.3.0
+	hostname:
+	  prefix: pearl-
+	ssh_keys:
+	- github:octocat
+	nodes:
+	- address: 192.168.1.10
+	  role: server
+	  auth:
+	    type: basic-auth
+	    user: pirate
+	    password_secret: pirate
+	nodes_file: nodes.yaml
+	selectors:
+	- role: agent
+	  address: 192.168.1.0/24
+	config:
+	  k3os:
+	    dns_nameservers:
+	    - 192.168.1.1
+	addons:
+	- name: dashboard
+	  manifest: addons/dashboard.yaml
+
+	Examples:
+	Apply the spec, the cluster is named by the spec
+	$ k3pi apply -f cluster.yaml
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		fn := viper.GetString(ParamFilenameApplyBindKey)
+		if fn == "" {
+			exitWithMessage("must specify --filename|-f")
+		}
+		clusterSpec, err := spec.Load(fn)
+		exitOnError(err, "failed to read the cluster spec")
+
+		cluster, err := inventory.Open(viper.GetString(ParamStateDir), clusterSpec.Name)
+		exitOnError(err)
+
+		ctx, cancel := signalContext()
+		defer cancel()
+
+		applyArgs := &cmd2.ApplyArgs{
+			Spec:     clusterSpec,
+			Cluster:  cluster,
+			SSHKeys:  specAuthorizedKeys(clusterSpec, cluster),
+			Version:  Version,
+			Parallel: viper.GetInt(ParamParallelApplyBindKey),
+		}
+		plan, err := cmd2.PlanApply(ctx, applyArgs)
+		exitOnError(err, "failed to plan the changes")
+
+		plan.Print(os.Stdout)
+		if plan.Empty() {
+			return
+		}
+		if !viper.GetBool(ParamConfirmApplyBindKey) && !confirm("Apply the changes?") {
+			return
+		}
+
+		var installNodes []*pkg.Node
+		for _, change := range plan.Install {
+			installNodes = append(installNodes, change.Node)
+		}
+		exitOnError(secrets.Resolve(installNodes, openSecrets), "failed to resolve node passwords")
+
+		err = cmd2.ExecuteApply(ctx, applyArgs, plan)
+		exitOnError(err)
+		logging.Infof("Cluster %s matches its spec", cluster.Name)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(applyCmd)
+
+	applyCmd.Flags().StringP(ParamFilename, "f", "", "cluster spec file")
+	applyCmd.Flags().BoolP(ParamConfirmInstall, "y", false, "apply the changes without asking")
+	applyCmd.Flags().IntP(ParamParallel, "p", 5, "max number of nodes to install in parallel")
+	_ = viper.BindPFlag(ParamFilenameApplyBindKey, applyCmd.Flags().Lookup(ParamFilename))
+	_ = viper.BindPFlag(ParamConfirmApplyBindKey, applyCmd.Flags().Lookup(ParamConfirmInstall))
+	_ = viper.BindPFlag(ParamParallelApplyBindKey, applyCmd.Flags().Lookup(ParamParallel))
+}
+
+// Returns the keys of the spec and the cluster key, which is generated if the
+// cluster has none.
+func specAuthorizedKeys(clusterSpec *spec.ClusterSpec, cluster *inventory.Cluster) []string {
+	_, created, err := cmd2.EnsureClusterKey(cluster)
+	exitOnError(err, "failed to create the cluster key")
+	if created {
+		logging.Infof("Generated the ssh key %s for the rancher user of cluster %s", cluster.KeyPath(), cluster.Name)
+	}
+	sources := append([]string{}, clusterSpec.SSHKeys...)
+	for _, keyPath := range cluster.KeyPaths() {
+		sources = append(sources, keyPath+".pub")
+	}
+	keys, err := ssh.ResolveAuthorizedKeys(sources, nil)
+	exitOnError(err, "failed to resolve ssh authorized keys")
+	return keys
+}
+
+// Asks question and returns true if the answer is yes, exits if stdin is not
+// a terminal.
+func confirm(question string) bool {
+	if misc.DataPipedIn() {
+		exitWithMessage("changes need to be confirmed (--yes|-y)")
+	}
+	fmt.Printf("%s (y/N): ", question)
+	var reply string
+	_, _ = fmt.Scanln(&reply)
+	answer := strings.TrimSpace(strings.ToUpper(reply))
+	return answer == "YES" || answer == "Y"
+}
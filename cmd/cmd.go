@@ -22,18 +22,64 @@ THE SOFTWARE.
 package cmd
 
 const (
-	ParamDryRun               = "dry-run"
-	ParamFilename             = "filename"
-	ParamServer               = "server"
-	ParamToken                = "token"
-	ParamSSHKeyInstallBindKey = "install-ssh-key"
-	ParamUser                 = "user"
-	ParamSSHKey               = "ssh-key"
-	ParamSSHPort              = "ssh-port"
-	ParamCIDR                 = "cidr"
-	ParamHostnameSubstring    = "substr"
-	ParamAuth                 = "auth"
-	ParamHostnamePattern      = "hostname-pattern"
-    ParamHostnamePrefix      = "hostname-prefix"
-    ParamConfirmInstall = "yes"
+	ParamDryRun                 = "dry-run"
+	ParamFilename               = "filename"
+	ParamServer                 = "server"
+	ParamToken                  = "token"
+	ParamSSHKeyInstallBindKey   = "install-ssh-key"
+	ParamRecordInstallBindKey   = "install-record"
+	ParamUser                   = "user"
+	ParamSSHKey                 = "ssh-key"
+	ParamSSHPort                = "ssh-port"
+	ParamCIDR                   = "cidr"
+	ParamHostnameSubstring      = "substr"
+	ParamAuth                   = "auth"
+	ParamHostnamePattern        = "hostname-pattern"
+	ParamHostnamePrefix         = "hostname-prefix"
+	ParamConfirmInstall         = "yes"
+	ParamParallel               = "parallel"
+	ParamFailFast               = "fail-fast"
+	ParamBatchSize              = "batch-size"
+	ParamServerReadyTimeout     = "server-ready-timeout"
+	ParamJoinTimeout            = "join-timeout"
+	ParamUploadTimeout          = "upload-timeout"
+	ParamExtractTimeout         = "extract-timeout"
+	ParamRebootTimeout          = "reboot-timeout"
+	ParamBootTimeout            = "boot-timeout"
+	ParamPlanFormat             = "plan-format"
+	ParamRecord                 = "record"
+	ParamSkipPreflight          = "skip-preflight"
+	ParamStateFile              = "state-file"
+	ParamResume                 = "resume"
+	ParamReportFile             = "report-file"
+	ParamReportFormat           = "report-format"
+	ParamVerbose                = "verbose"
+	ParamQuiet                  = "quiet"
+	ParamLogFormat              = "log-format"
+	ParamLogDir                 = "log-dir"
+	ParamSecretsFile            = "secrets-file"
+	ParamSecretsKeyFile         = "secrets-key-file"
+	ParamPasswordRef            = "password-ref"
+	ParamCluster                = "cluster"
+	ParamStateDir               = "state-dir"
+	ParamGitHubKeysURL          = "github-keys-url"
+	ParamForce                  = "force"
+	ParamFilenameRotateBindKey  = "rotate-filename"
+	ParamStateFileRotateBindKey = "rotate-state-file"
+	ParamPlan                   = "plan"
+	ParamOut                    = "out"
+	ParamFilenameApplyBindKey   = "apply-filename"
+	ParamConfirmApplyBindKey    = "apply-yes"
+	ParamParallelApplyBindKey   = "apply-parallel"
+	ParamSelector               = "selector"
+	ParamTimeout                = "timeout"
+	ParamFormat                 = "format"
+	ParamParallelExecBindKey    = "exec-parallel"
+	ParamTimeoutExecBindKey     = "exec-timeout"
+	ParamFormatExecBindKey      = "exec-format"
+	ParamFilenameSSHBindKey     = "ssh-filename"
+	ParamSudo                   = "sudo"
+	ParamParallelCopyBindKey    = "cp-parallel"
+	ParamTimeoutStatusBindKey   = "status-timeout"
+	ParamFormatStatusBindKey    = "status-format"
 )
@@ -0,0 +1,120 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	cmd2 "github.com/TheNatureOfSoftware/k3pi/pkg/cmd"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/logging"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"strings"
+)
+
+var cpCmd = &cobra.Command{
+	Use:   "cp <source> <destination>",
+	Short: "Copies a file to or from nodes",
+	Long: `Copies a local file to nodes of the cluster inventory or a file on nodes to the
+local machine, as the rancher user with the cluster key. A path on nodes is
+given as <nodes>:<path>, where <nodes> is a hostname, an index or an address
+of a node as listed by k3pi ssh, all for all nodes, or a selector as used by
+k3pi exec. A file copied from several nodes is written to a directory per
+node, named by the hostname. Files are copied with scp and keep their mode.
+With --sudo the file on the nodes is written or read as root.
+
+	Examples:
+	Copy a file to the home directory of k3-node1
+	$ k3pi cp ./notes.txt k3-node1:
+
+	Copy a file owned by root to all agents
+	$ k3pi cp --sudo ./registries.yaml role=agent:/etc/rancher/k3s/
+
+	Copy the os-release of all nodes to os/<hostname>/os-release
+	$ k3pi cp all:/etc/os-release ./os
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		source, destination := cmd2.ParseCopyLocation(args[0]), cmd2.ParseCopyLocation(args[1])
+		if source.Remote() == destination.Remote() {
+			exitWithMessage("one of source and destination must be a path on nodes, like k3-node1:/etc/os-release")
+		}
+		copyArgs := &cmd2.CopyArgs{
+			LocalPath:  source.Path,
+			RemotePath: destination.Path,
+			Download:   source.Remote(),
+			Sudo:       viper.GetBool(ParamSudo),
+			Parallel:   viper.GetInt(ParamParallelCopyBindKey),
+		}
+		remote := destination
+		if copyArgs.Download {
+			remote = source
+			copyArgs.LocalPath, copyArgs.RemotePath = destination.Path, source.Path
+			if copyArgs.RemotePath == "" {
+				exitWithMessage("must specify the path of the file on the nodes")
+			}
+		}
+		copyArgs.Cluster = openCluster()
+		copyArgs.Nodes = copyNodes(copyArgs.Cluster, remote.Nodes)
+		if len(copyArgs.Nodes) == 1 && logging.Default().Interactive() {
+			copyArgs.Progress = printCopyProgress
+		}
+
+		ctx, cancel := signalContext()
+		defer cancel()
+
+		exitOnError(cmd2.Copy(ctx, copyArgs))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cpCmd)
+
+	cpCmd.Flags().Bool(ParamSudo, false, "write or read the file on the nodes as root")
+	cpCmd.Flags().IntP(ParamParallel, "p", 5, "max number of nodes copied to or from in parallel")
+	_ = viper.BindPFlag(ParamSudo, cpCmd.Flags().Lookup(ParamSudo))
+	_ = viper.BindPFlag(ParamParallelCopyBindKey, cpCmd.Flags().Lookup(ParamParallel))
+}
+
+// Returns the nodes of the cluster inventory given by the nodes part of a
+// cp argument.
+func copyNodes(cluster *inventory.Cluster, nodes string) []*inventory.Node {
+	if nodes == "all" {
+		return selectNodes(cluster, nil)
+	}
+	if strings.ContainsAny(nodes, "=*?[,") {
+		return selectNodes(cluster, []string{nodes})
+	}
+	inv, err := cluster.Load()
+	exitOnError(err, "failed to load the cluster inventory")
+	node, err := cmd2.FindNode(inv.Nodes, nodes)
+	exitOnError(err)
+	return []*inventory.Node{node}
+}
+
+func printCopyProgress(node *inventory.Node, copied, total int64) {
+	fmt.Printf("\rCopying... %s of %s", humanize.Bytes(uint64(copied)), humanize.Bytes(uint64(total)))
+	if copied == total {
+		fmt.Println()
+	}
+}
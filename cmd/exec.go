@@ -0,0 +1,116 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	cmd2 "github.com/TheNatureOfSoftware/k3pi/pkg/cmd"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"strings"
+)
+
+var execCmd = &cobra.Command{
+	Use:   "exec [flags] -- command",
+	Short: "Runs a command on the nodes of a cluster",
+	Long: `Runs a command on all or the selected nodes of the cluster inventory in
+parallel, as the rancher user with the cluster key. The output is grouped per
+node and followed by a summary of the exit codes, exec fails if the command
+fails on any node. A node that drops the session of a single reboot, poweroff
+or shutdown command is reported as rebooted, which counts as success.
+
+A selector is a comma separated list of conditions that must all match, a node
+is selected if it matches any of the selectors:
+	role=server|agent
+	address=<ip or cidr>
+	hostname=<glob>, or just <glob>
+	arch=<arch>
+
+	Examples:
+	Show the disk usage of all nodes
+	$ k3pi exec -- df -h
+
+	Reboot the agents
+	$ k3pi exec --selector role=agent -- sudo reboot
+
+	Show the uptime of two nodes as JSON
+	$ k3pi exec -l k3-node1 -l k3-node2 --format json -- uptime
+`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		// Read from the flag since viper splits the selectors at commas.
+		selectors, _ := cmd.Flags().GetStringArray(ParamSelector)
+		cluster := openCluster()
+		nodes := selectNodes(cluster, selectors)
+
+		ctx, cancel := signalContext()
+		defer cancel()
+
+		report := cmd2.Exec(ctx, &cmd2.ExecArgs{
+			Nodes:    nodes,
+			Command:  strings.Join(args, " "),
+			Cluster:  cluster,
+			Parallel: viper.GetInt(ParamParallelExecBindKey),
+			Timeout:  viper.GetDuration(ParamTimeoutExecBindKey),
+		})
+		exitOnError(report.Write(os.Stdout, viper.GetString(ParamFormatExecBindKey)))
+		if failed := report.Failed(); failed > 0 {
+			exitWithMessage(fmt.Sprintf("the command failed on %d of %d nodes", failed, len(nodes)))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(execCmd)
+
+	execCmd.Flags().StringArrayP(ParamSelector, "l", nil, "select nodes, for example role=agent,hostname=k3-node* (default all nodes)")
+	execCmd.Flags().IntP(ParamParallel, "p", 10, "max number of nodes the command runs on in parallel")
+	execCmd.Flags().Duration(ParamTimeout, 0, "max time the command runs on each node, 0 means no limit")
+	execCmd.Flags().String(ParamFormat, cmd2.ExecFormatText, "output format, text or json")
+	_ = viper.BindPFlag(ParamParallelExecBindKey, execCmd.Flags().Lookup(ParamParallel))
+	_ = viper.BindPFlag(ParamTimeoutExecBindKey, execCmd.Flags().Lookup(ParamTimeout))
+	_ = viper.BindPFlag(ParamFormatExecBindKey, execCmd.Flags().Lookup(ParamFormat))
+}
+
+// Returns the nodes of the cluster inventory matching any of selectors, all
+// nodes if there are no selectors.
+func selectNodes(cluster *inventory.Cluster, selectors []string) []*inventory.Node {
+	inv, err := cluster.Load()
+	exitOnError(err, "failed to load the cluster inventory")
+	if len(inv.Nodes) == 0 {
+		exitWithMessage(fmt.Sprintf("cluster %s has no installed nodes", cluster.Name))
+	}
+
+	var parsed []*inventory.Selector
+	for _, s := range selectors {
+		sel, err := inventory.ParseSelector(s)
+		exitOnError(err)
+		parsed = append(parsed, sel)
+	}
+	nodes := inv.Select(parsed)
+	if len(nodes) == 0 {
+		exitWithMessage(fmt.Sprintf("no node of cluster %s matches %s", cluster.Name, strings.Join(selectors, " or ")))
+	}
+	return nodes
+}
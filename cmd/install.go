@@ -25,21 +25,24 @@ import (
 	"fmt"
 	"github.com/TheNatureOfSoftware/k3pi/pkg"
 	cmd2 "github.com/TheNatureOfSoftware/k3pi/pkg/cmd"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/logging"
 	"github.com/TheNatureOfSoftware/k3pi/pkg/misc"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/secrets"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
 	"github.com/kubernetes-sigs/yaml"
 	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"io/ioutil"
 	"os"
-	"strings"
 )
 
 // installCmd represents the install command
 var installCmd = &cobra.Command{
 	Use:   "install",
 	Short: "Installs k3os on selected nodes",
-	Long:  `Installs k3os on ARM devices, should be combined with the scan command.
+	Long: `Installs k3os on ARM devices, should be combined with the scan command.
 
 	IMPORTANT! This will overwrite your existing installation.
 	
@@ -47,81 +50,84 @@ var installCmd = &cobra.Command{
 	Scan and install, confirm the install using --yes
 	$ k3pi scan <scan args> | k3pi install --yes <install args>
 
-	You should always run the install as a dry run first
-	$ k3pi scan <scan args> | k3pi install <install args> --dry-run
+	Before any node is touched, pre-flight checks verify disk space, sudo, tools,
+	board model, clock and server connectivity on all nodes. Use --skip-preflight
+	to install even if a check fails.
 
-	Installs k3os on all nodes in the file and selects <server ip> as server
-	$ k3pi install --filename ./nodes.yaml --server <server ip>
+	After reboot every node is verified to run k3os with its new hostname and
+	to be Ready in the cluster, a status table with timings is printed last.
 
-	$ Installs k3os on all nodes as agents joining an existing server (server is not in nodes file)
-	k3pi install --filename ./nodes.yaml -t <token|secret> --server <server ip>
-`,
-	Run: func(cmd *cobra.Command, args []string) {
-		fn := viper.GetString(ParamFilename)
-
-		var bytes []byte
-		var err error
-
-		if misc.DataPipedIn() {
-			bytes, err = ioutil.ReadAll(os.Stdin)
-		} else {
-			if fn == "" {
-				misc.ErrorExitWithMessage("must specify --filename|-f")
-			}
-			bytes, err = ioutil.ReadFile(fn)
-		}
-		misc.PanicOnError(err, "error reading input file")
+	Nodes are reached on the port found by scan, set port, k3os_port (the ssh
+	port after the reboot into k3os) and jump_host ([user@]host[:port]) in the
+	nodes file for nodes behind a bastion or port forwarding.
 
-		nodes := []*pkg.Node{}
-		err = yaml.Unmarshal(bytes, &nodes)
-		misc.ExitOnError(err, "error parsing nodes from file")
+	The rancher user logs in with the ssh key of the cluster, generated on the
+	first install, see k3pi keys. Keys from --ssh-key are authorized as well,
+	each is a key, a .pub file, a directory of .pub files, github:<user> or an
+	https:// URL. Keys are validated and duplicates removed
+	$ k3pi install --filename ./nodes.yaml --server <server ip> -k ~/.ssh/team -k github:octocat
 
-		if len(nodes) == 0 {
-			misc.ErrorExitWithMessage("No nodes found in file")
-		}
+	Ctrl-C aborts the operations running on all nodes and prints the phase each
+	node was left in, a second Ctrl-C exits immediately. Phases that hang are
+	aborted after --upload-timeout, --extract-timeout and --reboot-timeout, the
+	wait for the rebooted server after --boot-timeout.
 
-		sshKeys := viper.GetStringSlice(ParamSSHKeyInstallBindKey)
-		server := viper.GetString(ParamServer)
-		token := viper.GetString(ParamToken)
-		dryRun := viper.GetBool(ParamDryRun)
-		hostnameSpec := &pkg.HostnameSpec{
-			Pattern: viper.GetString(ParamHostnamePattern),
-			Prefix:  viper.GetString(ParamHostnamePrefix),
-		}
+	The progress of each node is recorded in the state file. If the install fails,
+	rerun it with --resume to skip installed nodes and continue failed nodes
+	$ k3pi install --filename ./nodes.yaml --server <server ip> --resume
+
+	Record all ssh commands and responses to a cassette file for a bug report
+	$ k3pi install --filename ./nodes.yaml --server <server ip> --record install-cassette.yaml
 
+	Write a JUnit XML report for CI, use a .json file or --report-format json for JSON
+	$ k3pi install --filename ./nodes.yaml --server <server ip> --report-file report.xml
 
-		if len(sshKeys) == 0 {
+	Before the install is confirmed a plan shows what happens to each node: the
+	OS that is overwritten, the current and new hostname, the role, the k3os
+	image and, for nodes already running k3os, the diff of the k3os config.
+	Save the plan with k3pi plan and execute exactly that plan later
+	$ k3pi plan --filename ./nodes.yaml --server <server ip> --out plan.yaml
+	$ k3pi install --plan plan.yaml --yes
 
-			misc.ErrorExitWithMessage("at least one ssh key is required")
+	You should always run the install as a dry run first, it changes nothing and
+	prints the commands, file transfers and reboots planned for each node
+	$ k3pi scan <scan args> | k3pi install <install args> --dry-run
 
-		} else if len(sshKeys) == 1 && sshKeys[0] == cmd2.DefaultSSHAuthorizedKey {
+	Print the dry run plan as JSON
+	$ k3pi install --filename ./nodes.yaml --server <server ip> --dry-run --plan-format json
 
-			idRsaPubFile, err := homedir.Expand(cmd2.DefaultSSHAuthorizedKey)
-			msg := fmt.Sprintf("failed to read default ssh public key: %s", cmd2.DefaultSSHAuthorizedKey)
-			misc.ExitOnError(err, msg)
+	Installs k3os on all nodes in the file and selects <server ip> as server
+	$ k3pi install --filename ./nodes.yaml --server <server ip>
 
-			f, err := os.Open(idRsaPubFile)
-			defer f.Close()
-			misc.ExitOnError(err, msg)
+	The installed nodes with their roles and hostnames, the token, versions and
+	install history are recorded in the inventory of the cluster together with
+	its ssh key and kubeconfig, ~/.k3pi/clusters/<cluster>/ (see --cluster and
+	--state-dir). Without --filename the nodes of the inventory are reinstalled
+	$ k3pi install --cluster pearl --server <server ip>
 
-			b, err := ioutil.ReadAll(f)
-			misc.ExitOnError(err, msg)
+	Resumes an install that failed on some nodes, the nodes file is needed since
+	only installed nodes are in the inventory
+	$ k3pi install --cluster pearl --filename ./nodes.yaml --server <server ip> --resume
 
-			key := strings.Split(strings.TrimSpace(string(b)), " ")
-			sshKeys = []string{fmt.Sprintf("%s %s", key[0], key[1])}
-		}
+	The server is installed first, agents are installed when the server is ready.
+	Installs agents in batches of 3, each batch waits for the previous one to join
+	$ k3pi install --filename ./nodes.yaml --server <server ip> --batch-size 3
 
-		installArgs := &cmd2.InstallArgs{
-			Nodes:        nodes,
-			SSHKeys:      sshKeys,
-			Token:        token,
-			ServerID:     server,
-			HostnameSpec: hostnameSpec,
-			DryRun:       dryRun,
-			Confirmed: viper.GetBool(ParamConfirmInstall),
-		}
-		err = cmd2.Install(installArgs)
-		misc.ExitOnError(err)
+	$ Installs k3os on all nodes as agents joining an existing server (server is not in nodes file)
+	k3pi install --filename ./nodes.yaml -t <token|secret> --server <server ip>
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		installArgs := newInstallArgs(viper.GetBool(ParamDryRun))
+
+		var saveCassette func()
+		installArgs.OperatorFactory, saveCassette = recordingFactory(viper.GetString(ParamRecordInstallBindKey))
+
+		ctx, cancel := signalContext()
+		defer cancel()
+
+		err := cmd2.Install(ctx, installArgs)
+		saveCassette()
+		exitOnError(err)
 	},
 }
 
@@ -129,21 +135,190 @@ func init() {
 	rootCmd.AddCommand(installCmd)
 
 	installCmd.Flags().BoolP(ParamConfirmInstall, "y", false, "confirm the installation")
-	installCmd.Flags().Bool(ParamDryRun, false, "if true will run the install but not execute commands")
+	installCmd.Flags().Int(ParamBatchSize, 0, "number of agents installed per batch, 0 installs all agents at once")
+	installCmd.Flags().Bool(ParamDryRun, false, "print the plan of the install without changing any node")
+	installCmd.Flags().Bool(ParamFailFast, false, "stop installing remaining nodes as soon as one node fails")
 	installCmd.Flags().String(ParamHostnamePattern, "%s%d", "hostname pattern, printf with %s and %d")
 	installCmd.Flags().String(ParamHostnamePrefix, "k3-node", "hostname prefix, (hostname = '<prefix><index>')")
 	installCmd.Flags().StringP(ParamFilename, "f", "", "scan output file with all nodes")
+	installCmd.Flags().IntP(ParamParallel, "p", 5, "max number of nodes to install in parallel")
+	installCmd.Flags().String(ParamPlan, "", "execute the plan saved by k3pi plan, nodes, server, token, keys and hostnames are taken from the plan")
+	installCmd.Flags().String(ParamPlanFormat, cmd2.PlanFormatText, "format of the plan of a dry run and of k3pi plan, text or json")
+	installCmd.Flags().String(ParamRecord, "", "record all ssh commands and responses to this cassette file")
+	installCmd.Flags().String(ParamReportFile, "", "write an install report with the result of each node to this file")
+	installCmd.Flags().String(ParamReportFormat, "", "report format, json or junit (default json, junit for .xml files)")
+	installCmd.Flags().Bool(ParamResume, false, "skip installed nodes and resume failed nodes from the state file")
 	installCmd.Flags().StringP(ParamServer, "s", "", "ip address or hostname of the server node")
+	installCmd.Flags().Bool(ParamSkipPreflight, false, "continue the install even if pre-flight checks fail")
+	installCmd.Flags().String(ParamStateFile, "", "file where the install progress of each node is recorded (default state.yaml in the cluster directory)")
 	installCmd.Flags().StringP(ParamToken, "t", "", "token or cluster secret for joining a server")
+	installCmd.Flags().Duration(ParamServerReadyTimeout, cmd2.DefaultServerReadyTimeout, "max time to wait for the server to become ready")
+	installCmd.Flags().Duration(ParamJoinTimeout, cmd2.DefaultJoinTimeout, "max time to wait for a batch of agents to join the server")
+	installCmd.Flags().Duration(ParamUploadTimeout, cmd2.DefaultUploadTimeout, "max time to upload the image and config to a node")
+	installCmd.Flags().Duration(ParamExtractTimeout, cmd2.DefaultExtractTimeout, "max time to extract the image on a node")
+	installCmd.Flags().Duration(ParamRebootTimeout, cmd2.DefaultRebootTimeout, "max time to wait for the reboot command to return")
+	installCmd.Flags().Duration(ParamBootTimeout, cmd2.DefaultBootTimeout, "max time to wait for the rebooted server to accept ssh connections")
 	installCmd.Flags().Lookup(ParamFilename).NoOptDefVal = ""
 
-	installCmd.Flags().StringSliceP(ParamSSHKey, "k", []string{cmd2.DefaultSSHAuthorizedKey}, "ssh authorized key that should be added to the rancher user")
+	installCmd.Flags().StringSliceP(ParamSSHKey, "k", []string{cmd2.DefaultSSHAuthorizedKey}, "ssh authorized keys of the rancher user, a key, a .pub file, a directory of .pub files, github:<user> or an https:// URL")
+	installCmd.Flags().String(ParamGitHubKeysURL, "", "fetch the keys of github:<user> from <url>/<user>.keys instead of letting k3os fetch them, e.g. "+ssh.DefaultGitHubKeysURL)
 	_ = viper.BindPFlag(ParamDryRun, installCmd.Flags().Lookup(ParamDryRun))
 	_ = viper.BindPFlag(ParamConfirmInstall, installCmd.Flags().Lookup(ParamConfirmInstall))
+	_ = viper.BindPFlag(ParamFailFast, installCmd.Flags().Lookup(ParamFailFast))
+	_ = viper.BindPFlag(ParamParallel, installCmd.Flags().Lookup(ParamParallel))
 	_ = viper.BindPFlag(ParamFilename, installCmd.Flags().Lookup(ParamFilename))
 	_ = viper.BindPFlag(ParamServer, installCmd.Flags().Lookup(ParamServer))
 	_ = viper.BindPFlag(ParamSSHKeyInstallBindKey, installCmd.Flags().Lookup(ParamSSHKey))
+	_ = viper.BindPFlag(ParamGitHubKeysURL, installCmd.Flags().Lookup(ParamGitHubKeysURL))
 	_ = viper.BindPFlag(ParamToken, installCmd.Flags().Lookup(ParamToken))
 	_ = viper.BindPFlag(ParamHostnamePattern, installCmd.Flags().Lookup(ParamHostnamePattern))
 	_ = viper.BindPFlag(ParamHostnamePrefix, installCmd.Flags().Lookup(ParamHostnamePrefix))
+	_ = viper.BindPFlag(ParamBatchSize, installCmd.Flags().Lookup(ParamBatchSize))
+	_ = viper.BindPFlag(ParamServerReadyTimeout, installCmd.Flags().Lookup(ParamServerReadyTimeout))
+	_ = viper.BindPFlag(ParamJoinTimeout, installCmd.Flags().Lookup(ParamJoinTimeout))
+	_ = viper.BindPFlag(ParamUploadTimeout, installCmd.Flags().Lookup(ParamUploadTimeout))
+	_ = viper.BindPFlag(ParamExtractTimeout, installCmd.Flags().Lookup(ParamExtractTimeout))
+	_ = viper.BindPFlag(ParamRebootTimeout, installCmd.Flags().Lookup(ParamRebootTimeout))
+	_ = viper.BindPFlag(ParamBootTimeout, installCmd.Flags().Lookup(ParamBootTimeout))
+	_ = viper.BindPFlag(ParamSkipPreflight, installCmd.Flags().Lookup(ParamSkipPreflight))
+	_ = viper.BindPFlag(ParamStateFile, installCmd.Flags().Lookup(ParamStateFile))
+	_ = viper.BindPFlag(ParamResume, installCmd.Flags().Lookup(ParamResume))
+	_ = viper.BindPFlag(ParamReportFile, installCmd.Flags().Lookup(ParamReportFile))
+	_ = viper.BindPFlag(ParamReportFormat, installCmd.Flags().Lookup(ParamReportFormat))
+	_ = viper.BindPFlag(ParamPlanFormat, installCmd.Flags().Lookup(ParamPlanFormat))
+	_ = viper.BindPFlag(ParamRecordInstallBindKey, installCmd.Flags().Lookup(ParamRecord))
+	_ = viper.BindPFlag(ParamPlan, installCmd.Flags().Lookup(ParamPlan))
+}
+
+// Creates the install args from the flags, with the nodes and keys of the
+// saved plan when --plan is set. The cluster key is generated unless dryRun.
+func newInstallArgs(dryRun bool) *cmd2.InstallArgs {
+	cluster := openCluster()
+	if !dryRun {
+		_, created, err := cmd2.EnsureClusterKey(cluster)
+		exitOnError(err, "failed to create the cluster key")
+		if created {
+			logging.Infof("Generated the ssh key %s for the rancher user of cluster %s", cluster.KeyPath(), cluster.Name)
+		}
+	}
+
+	installArgs := &cmd2.InstallArgs{
+		DryRun:    dryRun,
+		Confirmed: viper.GetBool(ParamConfirmInstall),
+		Parallel:  viper.GetInt(ParamParallel),
+		FailFast:  viper.GetBool(ParamFailFast),
+		BatchSize: viper.GetInt(ParamBatchSize),
+
+		SkipPreflight:      viper.GetBool(ParamSkipPreflight),
+		StateFile:          stateFile(cluster, viper.GetString(ParamStateFile), dryRun),
+		Resume:             viper.GetBool(ParamResume),
+		ReportFile:         viper.GetString(ParamReportFile),
+		ReportFormat:       viper.GetString(ParamReportFormat),
+		PlanFormat:         viper.GetString(ParamPlanFormat),
+		RancherKeyPaths:    cluster.KeyPaths(),
+		Cluster:            cluster,
+		Version:            Version,
+		ServerReadyTimeout: viper.GetDuration(ParamServerReadyTimeout),
+		JoinTimeout:        viper.GetDuration(ParamJoinTimeout),
+		PhaseTimeouts: cmd2.PhaseTimeouts{
+			Upload:  viper.GetDuration(ParamUploadTimeout),
+			Extract: viper.GetDuration(ParamExtractTimeout),
+			Reboot:  viper.GetDuration(ParamRebootTimeout),
+			Boot:    viper.GetDuration(ParamBootTimeout),
+		},
+	}
+
+	if planFile := viper.GetString(ParamPlan); planFile != "" {
+		plan, err := cmd2.LoadInstallPlan(planFile)
+		exitOnError(err, "failed to read the plan")
+		installArgs.Plan = plan
+		installArgs.Nodes = plan.InstallNodes()
+		exitOnError(secrets.Resolve(installArgs.Nodes, openSecrets), "failed to resolve node passwords")
+		return installArgs
+	}
+
+	installArgs.Nodes = readNodes(viper.GetString(ParamFilename))
+	exitOnError(secrets.Resolve(installArgs.Nodes, openSecrets), "failed to resolve node passwords")
+	installArgs.ServerID = viper.GetString(ParamServer)
+	installArgs.Token = viper.GetString(ParamToken)
+	installArgs.HostnameSpec = &pkg.HostnameSpec{
+		Pattern: viper.GetString(ParamHostnamePattern),
+		Prefix:  viper.GetString(ParamHostnamePrefix),
+	}
+
+	sshKeys := viper.GetStringSlice(ParamSSHKeyInstallBindKey)
+	if len(sshKeys) == 1 && sshKeys[0] == cmd2.DefaultSSHAuthorizedKey && !defaultAuthorizedKeyExists() {
+		sshKeys = nil
+	}
+	for _, keyPath := range cluster.KeyPaths() {
+		sshKeys = append(sshKeys, keyPath+".pub")
+	}
+	sshKeys, err := ssh.ResolveAuthorizedKeys(sshKeys, &ssh.AuthorizedKeysOptions{
+		GitHubKeysURL: viper.GetString(ParamGitHubKeysURL),
+	})
+	exitOnError(err, "failed to resolve ssh authorized keys")
+	if len(sshKeys) == 0 {
+		exitWithMessage("at least one ssh key is required")
+	}
+	installArgs.SSHKeys = sshKeys
+	return installArgs
+}
+
+// Reads the nodes piped in or, if nothing is piped in, from the file fn. The
+// nodes of the cluster inventory are read if there is no file.
+func readNodes(fn string) []*pkg.Node {
+	var bytes []byte
+	var err error
+
+	if misc.DataPipedIn() {
+		bytes, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		if fn == "" {
+			return inventoryNodes()
+		}
+		bytes, err = ioutil.ReadFile(fn)
+	}
+	exitOnError(err, "error reading input file")
+
+	nodes := []*pkg.Node{}
+	err = yaml.Unmarshal(bytes, &nodes)
+	exitOnError(err, "error parsing nodes from file")
+
+	if len(nodes) == 0 {
+		exitWithMessage("No nodes found in file")
+	}
+	return nodes
+}
+
+// Returns true if ~/.ssh/id_rsa.pub exists.
+func defaultAuthorizedKeyExists() bool {
+	path, err := homedir.Expand(cmd2.DefaultSSHAuthorizedKey)
+	exitOnError(err)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		logging.Debugf("No %s, only the cluster key is authorized", cmd2.DefaultSSHAuthorizedKey)
+		return false
+	}
+	return true
+}
+
+// Reads the nodes of the cluster inventory.
+func inventoryNodes() []*pkg.Node {
+	cluster := openCluster()
+	inv, err := cluster.Load()
+	exitOnError(err, "failed to load the cluster inventory")
+	if len(inv.Nodes) == 0 {
+		exitWithMessage(fmt.Sprintf("must specify --filename|-f, cluster %s has no installed nodes", cluster.Name))
+	}
+	return inv.NodeList()
+}
+
+// Returns file or, if empty, the state file in the cluster directory.
+func stateFile(cluster *inventory.Cluster, file string, dryRun bool) string {
+	if file != "" {
+		return file
+	}
+	if !dryRun {
+		exitOnError(cluster.Init(), "failed to create the cluster directory")
+	}
+	return cluster.StatePath()
 }
@@ -0,0 +1,113 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	cmd2 "github.com/TheNatureOfSoftware/k3pi/pkg/cmd"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/logging"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manages the ssh key of the rancher user",
+	Long: `Manages the ed25519 key the rancher user of a cluster logs in with. The key is
+kept in the cluster directory, ~/.k3pi/clusters/<cluster>/id_ed25519, and is
+generated by install if there is none.
+
+	Examples:
+	Generate the key of the cluster pearl before installing it
+	$ k3pi keys generate --cluster pearl
+
+	Replace the key on all installed nodes of the cluster
+	$ k3pi keys rotate --cluster pearl
+`,
+}
+
+var keysGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generates the ssh key of the cluster",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cluster := openCluster()
+		publicKey, err := cmd2.GenerateClusterKey(cluster, viper.GetBool(ParamForce))
+		exitOnError(err, "failed to generate the cluster key")
+
+		logging.Infof("Generated %s", cluster.KeyPath())
+		fmt.Println(publicKey)
+	},
+}
+
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Replaces the ssh key of the cluster on all installed nodes",
+	Long: `Replaces the ssh key of the cluster on all nodes installed according to the
+state file. The new key is added to each node and verified by logging in with
+it before the old key is removed from the k3os config and the authorized keys.
+If a node fails both keys are kept, rerun the rotation to complete it.
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		nodes := readNodes(viper.GetString(ParamFilenameRotateBindKey))
+		cluster := openCluster()
+		state, err := cmd2.LoadInstallState(stateFile(cluster, viper.GetString(ParamStateFileRotateBindKey), true))
+		exitOnError(err, "failed to load install state")
+
+		var installed pkg.Nodes
+		for _, node := range nodes {
+			if ns := state.Get(node); ns != nil && ns.Completed() {
+				installed = append(installed, node)
+			} else {
+				logging.Warnf("%s is not installed, skipping", node)
+			}
+		}
+
+		ctx, cancel := signalContext()
+		defer cancel()
+
+		err = cmd2.RotateKeys(ctx, &cmd2.RotateArgs{Nodes: installed, Cluster: cluster})
+		exitOnError(err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysGenerateCmd, keysRotateCmd)
+
+	keysGenerateCmd.Flags().Bool(ParamForce, false, "replace an existing key, nodes still authorize the old key")
+	keysRotateCmd.Flags().StringP(ParamFilename, "f", "", "scan output file with all nodes (default the nodes of the cluster inventory)")
+	keysRotateCmd.Flags().String(ParamStateFile, "", "file where the install progress of each node is recorded (default state.yaml in the cluster directory)")
+	_ = viper.BindPFlag(ParamForce, keysGenerateCmd.Flags().Lookup(ParamForce))
+	_ = viper.BindPFlag(ParamFilenameRotateBindKey, keysRotateCmd.Flags().Lookup(ParamFilename))
+	_ = viper.BindPFlag(ParamStateFileRotateBindKey, keysRotateCmd.Flags().Lookup(ParamStateFile))
+}
+
+// Opens the cluster selected by the cluster flags.
+func openCluster() *inventory.Cluster {
+	cluster, err := inventory.Open(viper.GetString(ParamStateDir), viper.GetString(ParamCluster))
+	exitOnError(err)
+	return cluster
+}
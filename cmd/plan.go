@@ -0,0 +1,79 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	cmd2 "github.com/TheNatureOfSoftware/k3pi/pkg/cmd"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/logging"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+)
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Shows what an install would do to each node",
+	Long: `Shows what an install with the same flags would do to each node without
+changing any node: the OS that is overwritten, the current and the new
+hostname, the role, the k3os image, the diff of the k3os config of nodes that
+already run k3os, and the nodes that are left untouched.
+
+	Examples:
+	Save the plan and execute it, the install fails if a node changed since
+	$ k3pi plan --filename ./nodes.yaml --server <server ip> --out plan.yaml
+	$ k3pi install --plan plan.yaml
+
+	Print the plan as JSON
+	$ k3pi plan --filename ./nodes.yaml --server <server ip> --plan-format json
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		installArgs := newInstallArgs(false)
+
+		ctx, cancel := signalContext()
+		defer cancel()
+
+		plan, err := cmd2.PlanInstall(ctx, installArgs)
+		exitOnError(err, "failed to plan the install")
+		exitOnError(plan.Write(os.Stdout, viper.GetString(ParamPlanFormat)))
+
+		if out := viper.GetString(ParamOut); out != "" {
+			exitOnError(plan.Save(out), "failed to save the plan")
+			logging.Infof("Saved the plan to %s, execute it with: k3pi install --plan %s", out, out)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(planCmd)
+
+	// The flags are shared with install, so viper reads the flags of whichever
+	// command runs. Runs after the init of install.go.
+	for _, name := range []string{
+		ParamFilename, ParamServer, ParamToken, ParamSSHKey, ParamGitHubKeysURL, ParamHostnamePattern,
+		ParamHostnamePrefix, ParamStateFile, ParamResume, ParamPlanFormat,
+	} {
+		planCmd.Flags().AddFlag(installCmd.Flags().Lookup(name))
+	}
+	planCmd.Flags().StringP(ParamOut, "o", "", "save the plan to this file")
+	_ = viper.BindPFlag(ParamOut, planCmd.Flags().Lookup(ParamOut))
+}
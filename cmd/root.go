@@ -23,7 +23,9 @@ package cmd
 
 import (
 	"fmt"
-	"github.com/TheNatureOfSoftware/k3pi/pkg/misc"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/logging"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/secrets"
 	"github.com/spf13/cobra"
 	"os"
 
@@ -55,6 +57,41 @@ func Execute() {
 
 func init() {
 	cobra.OnInitialize(initConfig)
+
+	rootCmd.PersistentFlags().BoolP(ParamVerbose, "v", false, "verbose output, includes debug messages")
+	rootCmd.PersistentFlags().BoolP(ParamQuiet, "q", false, "quiet output, only warnings and errors")
+	rootCmd.PersistentFlags().String(ParamLogFormat, logging.FormatText, "log format, text or json")
+	rootCmd.PersistentFlags().String(ParamLogDir, "", "directory where the output of all remote commands is logged per node")
+	rootCmd.PersistentFlags().String(ParamSecretsFile, secrets.DefaultFile, "encrypted store of node passwords")
+	rootCmd.PersistentFlags().String(ParamSecretsKeyFile, "", "file with the passphrase of the secrets store")
+	rootCmd.PersistentFlags().String(ParamCluster, inventory.DefaultCluster, "name of the cluster")
+	rootCmd.PersistentFlags().String(ParamStateDir, inventory.DefaultStateDir, "directory with a subdirectory per cluster")
+	_ = viper.BindPFlag(ParamVerbose, rootCmd.PersistentFlags().Lookup(ParamVerbose))
+	_ = viper.BindPFlag(ParamQuiet, rootCmd.PersistentFlags().Lookup(ParamQuiet))
+	_ = viper.BindPFlag(ParamLogFormat, rootCmd.PersistentFlags().Lookup(ParamLogFormat))
+	_ = viper.BindPFlag(ParamLogDir, rootCmd.PersistentFlags().Lookup(ParamLogDir))
+	_ = viper.BindPFlag(ParamSecretsFile, rootCmd.PersistentFlags().Lookup(ParamSecretsFile))
+	_ = viper.BindPFlag(ParamSecretsKeyFile, rootCmd.PersistentFlags().Lookup(ParamSecretsKeyFile))
+	_ = viper.BindPFlag(ParamCluster, rootCmd.PersistentFlags().Lookup(ParamCluster))
+	_ = viper.BindPFlag(ParamStateDir, rootCmd.PersistentFlags().Lookup(ParamStateDir))
+}
+
+// initLogging configures the default logger from the logging flags.
+func initLogging() {
+	level := logging.LevelInfo
+	if viper.GetBool(ParamVerbose) {
+		level = logging.LevelDebug
+	} else if viper.GetBool(ParamQuiet) {
+		level = logging.LevelWarn
+	}
+
+	format := viper.GetString(ParamLogFormat)
+	if format != logging.FormatText && format != logging.FormatJSON {
+		exitWithMessage(fmt.Sprintf("unknown log format: %s", format))
+	}
+
+	logging.SetDefault(logging.New(os.Stderr, level, format))
+	exitOnError(logging.SetLogDir(viper.GetString(ParamLogDir)), "failed to create log directory")
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -65,7 +102,7 @@ func initConfig() {
 	} else {
 		// Find home directory.
 		home, err := homedir.Dir()
-		misc.ExitOnError(err)
+		exitOnError(err)
 
 		// Search config in home directory with name ".k3pi" (without extension).
 		viper.AddConfigPath(home)
@@ -75,7 +112,9 @@ func initConfig() {
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+	err := viper.ReadInConfig()
+	initLogging()
+	if err == nil {
+		logging.Debugf("Using config file: %s", viper.ConfigFileUsed())
 	}
 }
@@ -25,7 +25,10 @@ import (
 	"fmt"
 	"github.com/TheNatureOfSoftware/k3pi/pkg"
 	cmd2 "github.com/TheNatureOfSoftware/k3pi/pkg/cmd"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/logging"
 	"github.com/TheNatureOfSoftware/k3pi/pkg/misc"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/replay"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/secrets"
 	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
 	"github.com/kubernetes-sigs/yaml"
 	"github.com/spf13/cobra"
@@ -37,8 +40,10 @@ import (
 var scanCmd = &cobra.Command{
 	Use:   "scan",
 	Short: "Scans the network for ARM devices",
-	Long: `Scans the network for ARM devices with ssh enabled. The scan can use one SSH key
-and multiple username and password combinations. Examples:
+	Long: `Scans the network for ARM devices with ssh enabled. The scan can use SSH keys,
+the keys of the ssh agent and multiple username and password combinations.
+Keys can be RSA, ECDSA or ed25519 in PEM or OpenSSH format, a user certificate
+in <key>-cert.pub is presented with its key. Examples:
 
 	# Scan using default SSH key in ~/.ssh/id_rsa, user root and CIDR 192.168.1.0/24
 	$ k3pi scan
@@ -46,11 +51,25 @@ and multiple username and password combinations. Examples:
 	# Scan using default SSH key in ~/.ssh/id_rsa and user foo
 	$ k3pi scan --user foo --cidr 192.168.1.0/24
 
+	# Scan using two keys, the second with a certificate in ~/.ssh/ca_ed25519-cert.pub
+	$ k3pi scan --ssh-key ~/.ssh/id_ed25519 --ssh-key ~/.ssh/ca_ed25519
+
+	# Scan using only the keys of the ssh agent
+	$ k3pi scan --ssh-key ""
+
 	# Scan using username and password
 	$ k3pi scan --auth foo:bar --auth root:notsosecret
 
 	# Scan filtering on hostname
 	$ k3pi scan --substr pearl
+
+	# Scan using username and password, nodes.yaml references the password in
+	# the environment variable K3PI_PASSWORD_FOO instead of containing it, use
+	# --password-ref secret to save it in the secrets store
+	$ k3pi scan --auth foo:bar --password-ref env > nodes.yaml
+
+	# Record all ssh commands and responses to a cassette file for a bug report
+	$ k3pi scan --record scan-cassette.yaml
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		scanRequest := &cmd2.ScanRequest{
@@ -59,12 +78,18 @@ and multiple username and password combinations. Examples:
 			SSHSettings:       sshSettings(),
 			UserCredentials:   credentials(viper.GetStringSlice(ParamAuth)),
 		}
-		cmdOpFactory := &pkg.CmdOperatorFactory{Create: ssh.NewCmdOperator}
+		cmdOpFactory, saveCassette := recordingFactory(viper.GetString(ParamRecord))
 		nodes, err := cmd2.ScanForRaspberries(scanRequest, misc.NewHostScanner(), cmdOpFactory)
-		misc.ExitOnError(err, "node scan failed")
+		saveCassette()
+		exitOnError(err, "node scan failed")
+
+		if ref := viper.GetString(ParamPasswordRef); ref != "" {
+			err = secrets.Externalize(*nodes, ref, openSecrets)
+			exitOnError(err, "failed to replace passwords with references")
+		}
 
 		y, err := yaml.Marshal(nodes)
-		misc.ExitOnError(err, "node scan failed")
+		exitOnError(err, "node scan failed")
 
 		fmt.Print(string(y))
 	},
@@ -85,22 +110,40 @@ func credentials(basicAuths []string) map[string]string {
 func init() {
 	rootCmd.AddCommand(scanCmd)
 	scanCmd.Flags().String(ParamUser, "root", "username for ssh login")
-	scanCmd.Flags().String(ParamSSHKey, "~/.ssh/id_rsa", "ssh key to use for remote login")
+	scanCmd.Flags().StringSlice(ParamSSHKey, []string{"~/.ssh/id_rsa"}, "ssh keys to try for remote login, before the keys of the ssh agent")
 	scanCmd.Flags().Int(ParamSSHPort, 22, "port on which to connect for ssh")
 	scanCmd.Flags().String(ParamCIDR, "192.168.1.0/24", "CIDR to scan for members")
 	scanCmd.Flags().String(ParamHostnameSubstring, "", "Substring that should be part of hostname")
 	scanCmd.Flags().StringSliceP(ParamAuth, "a", []string{}, "Username and password separated with ':' for authentication")
+	scanCmd.Flags().String(ParamRecord, "", "record all ssh commands and responses to this cassette file")
+	scanCmd.Flags().String(ParamPasswordRef, "", "write password references instead of passwords, env or secret")
 	_ = viper.BindPFlag(ParamUser, scanCmd.Flags().Lookup(ParamUser))
 	_ = viper.BindPFlag(ParamSSHKey, scanCmd.Flags().Lookup(ParamSSHKey))
 	_ = viper.BindPFlag(ParamSSHPort, scanCmd.Flags().Lookup(ParamSSHPort))
 	_ = viper.BindPFlag(ParamCIDR, scanCmd.Flags().Lookup(ParamCIDR))
 	_ = viper.BindPFlag(ParamHostnameSubstring, scanCmd.Flags().Lookup(ParamHostnameSubstring))
 	_ = viper.BindPFlag(ParamAuth, scanCmd.Flags().Lookup(ParamAuth))
+	_ = viper.BindPFlag(ParamRecord, scanCmd.Flags().Lookup(ParamRecord))
+	_ = viper.BindPFlag(ParamPasswordRef, scanCmd.Flags().Lookup(ParamPasswordRef))
+}
+
+// Returns an ssh operator factory that records to filename, when set, and a
+// function that saves the recording.
+func recordingFactory(filename string) (*pkg.CmdOperatorFactory, func()) {
+	if filename == "" {
+		return &pkg.CmdOperatorFactory{Create: ssh.NewCmdOperator}, func() {}
+	}
+	recorder := replay.NewRecorder(ssh.NewCmdOperator)
+	return &pkg.CmdOperatorFactory{Create: recorder.Create}, func() {
+		if err := recorder.Save(filename); err != nil {
+			logging.Errorf("Failed to save cassette %s: %v", filename, err)
+		}
+	}
 }
 
 func sshSettings() *ssh.Settings {
 	return &ssh.Settings{
-		KeyPath: viper.GetString(ParamSSHKey),
-		User:    viper.GetString(ParamUser),
-		Port:    viper.GetString(ParamSSHPort)}
+		KeyPaths: viper.GetStringSlice(ParamSSHKey),
+		User:     viper.GetString(ParamUser),
+		Port:     viper.GetString(ParamSSHPort)}
 }
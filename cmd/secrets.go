@@ -0,0 +1,127 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/misc"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/secrets"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh/terminal"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var secretsCmd = &cobra.Command{
+	Use:   "secrets",
+	Short: "Manages the encrypted store of node passwords",
+	Long: `Manages the local store of node passwords, encrypted with a passphrase read
+from --secrets-key-file, the K3PI_SECRETS_PASSPHRASE environment variable or
+the terminal.
+
+	Nodes reference an entry with password_secret instead of a literal password,
+	password_env and password_file reference an environment variable or a file.
+
+	Examples:
+	Save the password of the pirate user, read from the terminal or stdin
+	$ k3pi secrets set pirate
+
+	Scan and save the found passwords in the store, nodes.yaml gets references
+	$ k3pi scan --auth pirate:hypriot --password-ref secret > nodes.yaml
+
+	Scan and reference the environment variable K3PI_PASSWORD_PIRATE
+	$ k3pi scan --auth pirate:hypriot --password-ref env > nodes.yaml
+`,
+}
+
+var secretsSetCmd = &cobra.Command{
+	Use:   "set <name>",
+	Short: "Sets a secret, the value is read from stdin or the terminal",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := openSecrets()
+		exitOnError(err, "failed to open secrets store")
+
+		value, err := readSecret(args[0])
+		exitOnError(err, "failed to read secret")
+
+		store.Set(args[0], value)
+		exitOnError(store.Save(), "failed to save secrets store")
+	},
+}
+
+var secretsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the names of all secrets",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := openSecrets()
+		exitOnError(err, "failed to open secrets store")
+
+		for _, name := range store.Names() {
+			fmt.Println(name)
+		}
+	},
+}
+
+var secretsDeleteCmd = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "Deletes a secret",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := openSecrets()
+		exitOnError(err, "failed to open secrets store")
+
+		if !store.Delete(args[0]) {
+			exitWithMessage(fmt.Sprintf("no secret named %s", args[0]))
+		}
+		exitOnError(store.Save(), "failed to save secrets store")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(secretsCmd)
+	secretsCmd.AddCommand(secretsSetCmd, secretsListCmd, secretsDeleteCmd)
+}
+
+// Opens the secrets store selected by the secrets flags.
+func openSecrets() (*secrets.Store, error) {
+	passphrase, err := secrets.ReadPassphrase(viper.GetString(ParamSecretsKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	return secrets.Open(viper.GetString(ParamSecretsFile), passphrase)
+}
+
+// Reads the value of a secret from stdin when piped, else from the terminal.
+func readSecret(name string) (string, error) {
+	if misc.DataPipedIn() {
+		b, err := ioutil.ReadAll(os.Stdin)
+		return strings.TrimRight(string(b), "\r\n"), err
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "Enter value of %s: ", name)
+	b, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	_, _ = fmt.Fprintln(os.Stderr)
+	return string(b), err
+}
@@ -0,0 +1,137 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	cmd2 "github.com/TheNatureOfSoftware/k3pi/pkg/cmd"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/secrets"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+	"text/tabwriter"
+)
+
+var sshCmd = &cobra.Command{
+	Use:   "ssh [hostname|index|address]",
+	Short: "Opens a shell on a node",
+	Long: `Opens an interactive shell on a node of the cluster inventory, or of the scan
+output given with --filename. Installed nodes are logged in to as rancher with
+the cluster key on the k3os port, nodes not installed yet with the user, the
+password or the keys, and the port found by scan. Without a node the nodes are
+listed with their index.
+
+	Examples:
+	List the nodes of the cluster
+	$ k3pi ssh
+
+	Open a shell on the node with hostname k3-node2
+	$ k3pi ssh k3-node2
+
+	Open a shell on a node before installing it
+	$ k3pi ssh --filename ./nodes.yaml 192.168.1.12
+`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cluster := openCluster()
+		inv, err := cluster.Load()
+		exitOnError(err, "failed to load the cluster inventory")
+		var scanned pkg.Nodes
+		if fn := viper.GetString(ParamFilenameSSHBindKey); fn != "" {
+			scanned = readNodes(fn)
+		}
+		nodes := cmd2.ShellNodes(inv, scanned)
+		if len(nodes) == 0 {
+			exitWithMessage(fmt.Sprintf("must specify --filename|-f, cluster %s has no installed nodes", cluster.Name))
+		}
+
+		if len(args) == 0 {
+			printShellNodes(nodes)
+			return
+		}
+		node, err := cmd2.FindNode(nodes, args[0])
+		exitOnError(err)
+		if node.Role == "" {
+			exitOnError(secrets.Resolve([]*pkg.Node{&node.Node}, openSecrets), "failed to resolve the node password")
+		}
+
+		code, err := openShell(node, cluster)
+		exitOnError(err, fmt.Sprintf("failed to open a shell on %s", node))
+		if code != 0 {
+			os.Exit(code)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sshCmd)
+
+	sshCmd.Flags().StringP(ParamFilename, "f", "", "scan output file with nodes not installed yet")
+	_ = viper.BindPFlag(ParamFilenameSSHBindKey, sshCmd.Flags().Lookup(ParamFilename))
+}
+
+// Prints the nodes with the index to select them by.
+func printShellNodes(nodes []*inventory.Node) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "INDEX\tHOSTNAME\tADDRESS\tROLE")
+	for i, node := range nodes {
+		role := node.Role
+		if role == "" {
+			role = "not installed"
+		}
+		_, _ = fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", i+1, node.Hostname, node.Address, role)
+	}
+	_ = w.Flush()
+}
+
+// Connects the terminal to a shell on node, in raw mode with a pty of the
+// same size when stdin is a terminal. The terminal is restored before
+// returning.
+func openShell(node *inventory.Node, cluster *inventory.Cluster) (int, error) {
+	term := &ssh.Terminal{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr}
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		width, height, err := terminal.GetSize(fd)
+		if err != nil {
+			return -1, err
+		}
+		term.Term, term.Size = os.Getenv("TERM"), ssh.WindowSize{Width: width, Height: height}
+		if term.Term == "" {
+			term.Term = "xterm"
+		}
+
+		state, err := terminal.MakeRaw(fd)
+		if err != nil {
+			return -1, err
+		}
+		defer func() { _ = terminal.Restore(fd, state) }()
+
+		resize, stop := notifyResize(fd)
+		defer stop()
+		term.Resize = resize
+	}
+	return cmd2.OpenShell(node, cluster, term)
+}
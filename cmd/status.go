@@ -0,0 +1,80 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	cmd2 "github.com/TheNatureOfSoftware/k3pi/pkg/cmd"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"time"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Shows the status of the nodes of a cluster",
+	Long: `Connects to all nodes of the cluster inventory in parallel and shows per node
+whether it is reachable, the OS, the k3s version and the state of the k3s
+service, the uptime and the Kubernetes readiness, read from the server with
+k3s kubectl get nodes. The wide format adds the address, the load, the memory
+and disk usage and the CPU temperature.
+
+	Examples:
+	Show the status of the nodes of the cluster pearl
+	$ k3pi status --cluster pearl
+
+	Include the resource usage
+	$ k3pi status -o wide
+
+	Print the status as JSON
+	$ k3pi status -o json
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cluster := openCluster()
+		inv, err := cluster.Load()
+		exitOnError(err, "failed to load the cluster inventory")
+		if len(inv.Nodes) == 0 {
+			exitWithMessage(fmt.Sprintf("cluster %s has no installed nodes", cluster.Name))
+		}
+
+		ctx, cancel := signalContext()
+		defer cancel()
+
+		status := cmd2.Status(ctx, &cmd2.StatusArgs{
+			Inventory: inv,
+			Cluster:   cluster,
+			Timeout:   viper.GetDuration(ParamTimeoutStatusBindKey),
+		})
+		exitOnError(status.Write(os.Stdout, viper.GetString(ParamFormatStatusBindKey)))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+
+	statusCmd.Flags().Duration(ParamTimeout, 30*time.Second, "max time spent on each node")
+	statusCmd.Flags().StringP(ParamFormat, "o", cmd2.StatusFormatTable, "output format, table, wide or json")
+	_ = viper.BindPFlag(ParamTimeoutStatusBindKey, statusCmd.Flags().Lookup(ParamTimeout))
+	_ = viper.BindPFlag(ParamFormatStatusBindKey, statusCmd.Flags().Lookup(ParamFormat))
+}
@@ -3,13 +3,12 @@ module github.com/TheNatureOfSoftware/k3pi
 go 1.13
 
 require (
-	github.com/bramvdbogaerde/go-scp v0.0.0-20190831150028-46baf5a32069
 	github.com/dustin/go-humanize v1.0.0
 	github.com/kubernetes-sigs/yaml v1.1.0
 	github.com/mitchellh/go-homedir v1.1.0
-	github.com/pkg/errors v0.8.1
+	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/viper v1.4.0
-	golang.org/x/crypto v0.0.0-20190927123631-a832865fa7ad
+	golang.org/x/crypto v0.0.0-20211202192323-5770296d904e
 	gopkg.in/yaml.v2 v2.2.2
 )
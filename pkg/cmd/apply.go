@@ -0,0 +1,460 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/config"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/logging"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/spec"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Directory k3s deploys manifests from on the server.
+const AddonManifestDir = "/var/lib/rancher/k3s/server/manifests"
+
+// Max time to wait for a node to come back after a config update.
+const DefaultUpdateTimeout = time.Minute * 3
+
+type ApplyArgs struct {
+	Spec    *spec.ClusterSpec
+	Cluster *inventory.Cluster
+	// Authorized keys of the rancher user, the keys of the spec and the
+	// cluster key.
+	SSHKeys []string
+	// Creates the operators that connect to the nodes, ssh when nil.
+	OperatorFactory *pkg.CmdOperatorFactory
+	// Version of k3pi recorded in the inventory.
+	Version string
+	// Max number of nodes installed concurrently.
+	Parallel int
+	// Max time to wait for a node to reboot after a config update.
+	UpdateTimeout time.Duration
+}
+
+// A node to install, update or remove.
+type NodeChange struct {
+	Node   *pkg.Node `json:"node"`
+	Role   string    `json:"role"`
+	Reason string    `json:"reason"`
+	// k3os config the node is installed or updated with.
+	Config string `json:"config,omitempty"`
+	// k3os config on the node when the plan was made.
+	CurrentConfig string `json:"current_config,omitempty"`
+	// Values merged into the generated config.
+	Overrides map[string]interface{} `json:"overrides,omitempty"`
+}
+
+// A manifest to deploy on the server.
+type AddonChange struct {
+	Name     string `json:"name"`
+	Reason   string `json:"reason"`
+	Manifest string `json:"manifest"`
+}
+
+// The changes that bring a cluster to its spec.
+type ApplyPlan struct {
+	Cluster   string         `json:"cluster"`
+	Server    *pkg.Node      `json:"server"`
+	Token     string         `json:"-"`
+	Install   []*NodeChange  `json:"install,omitempty"`
+	Update    []*NodeChange  `json:"update,omitempty"`
+	Remove    []*NodeChange  `json:"remove,omitempty"`
+	Addons    []*AddonChange `json:"addons,omitempty"`
+	Unchanged []string       `json:"unchanged,omitempty"`
+}
+
+// Returns true if the cluster matches its spec.
+func (p *ApplyPlan) Empty() bool {
+	return len(p.Install) == 0 && len(p.Update) == 0 && len(p.Remove) == 0 && len(p.Addons) == 0
+}
+
+// Prints one line per change, followed by the config diff of updated nodes.
+func (p *ApplyPlan) Print(w io.Writer) {
+	if p.Empty() {
+		_, _ = fmt.Fprintf(w, "Cluster %s matches its spec, nothing to do\n", p.Cluster)
+		return
+	}
+	for _, group := range []struct {
+		action  string
+		changes []*NodeChange
+	}{{"install", p.Install}, {"update", p.Update}, {"remove", p.Remove}} {
+		for _, change := range group.changes {
+			_, _ = fmt.Fprintf(w, "%-8s %s %s (%s)\n", group.action, change.Role, change.Node, change.Reason)
+			if diff := config.Diff(change.CurrentConfig, change.Config); change.CurrentConfig != "" && diff != "" {
+				for _, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+					_, _ = fmt.Fprintf(w, "           %s\n", line)
+				}
+			}
+		}
+	}
+	for _, addon := range p.Addons {
+		_, _ = fmt.Fprintf(w, "%-8s addon %s (%s)\n", "deploy", addon.Name, addon.Reason)
+	}
+}
+
+/*
+Compares the spec with the inventory and the installed nodes. Nodes not in
+the inventory, or with another role, are installed. The k3os config of
+installed nodes is read and compared with the config generated from the spec,
+nodes whose config differs are updated. Nodes in the inventory but not in the
+spec are removed from the cluster. Addons whose manifest differs from the one
+on the server are deployed.
+*/
+func PlanApply(ctx context.Context, args *ApplyArgs) (*ApplyPlan, error) {
+	inv, err := args.Cluster.Load()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load the cluster inventory")
+	}
+	desired, err := args.Spec.Resolve(inv.NodeList())
+	if err != nil {
+		return nil, err
+	}
+	if args.Spec.Versions.K3os != "" && args.Spec.Versions.K3os != K3osVersion {
+		return nil, fmt.Errorf("k3os %s is not supported, this release installs %s", args.Spec.Versions.K3os, K3osVersion)
+	}
+
+	var server *spec.Node
+	for _, n := range desired {
+		if n.Role == spec.RoleServer {
+			server = n
+		}
+	}
+	if inv.Server != "" && inv.Server != server.Address && inv.GetNode(inv.Server) != nil {
+		return nil, fmt.Errorf("cluster %s is served by %s, moving the server to %s is not supported", args.Cluster.Name, inv.Server, server.Address)
+	}
+
+	serverNode := server.Node
+	plan := &ApplyPlan{Cluster: args.Cluster.Name, Server: &serverNode, Token: args.Spec.Token}
+	if plan.Token == "" {
+		plan.Token = inv.Token
+	}
+	factory := operatorFactory(args.OperatorFactory)
+
+	wanted := make(map[string]bool)
+	for _, n := range desired {
+		wanted[n.Address] = true
+		node := n.Node
+		target := &pkg.Target{
+			SSHAuthorizedKeys: args.SSHKeys,
+			ServerIP:          server.Address,
+			Token:             plan.Token,
+			ConfigOverrides:   args.Spec.ConfigFor(n),
+			Node:              &node,
+		}
+		rendered, err := targetConfig(target, n.Role == spec.RoleServer)
+		if err != nil {
+			return nil, err
+		}
+		content := *rendered
+		change := &NodeChange{Node: &node, Role: n.Role, Config: string(content), Overrides: target.ConfigOverrides}
+
+		installed := inv.GetNode(n.Address)
+		switch {
+		case installed == nil:
+			change.Reason = "not installed"
+			plan.Install = append(plan.Install, change)
+		case installed.Role != n.Role:
+			change.Reason = fmt.Sprintf("role changes from %s to %s", installed.Role, n.Role)
+			plan.Install = append(plan.Install, change)
+		default:
+			current, err := readRemoteK3osConfig(ctx, &node, args.Cluster, factory)
+			if err != nil {
+				return nil, &pkg.NodeError{Address: n.Address, Op: "read config of", Err: err}
+			}
+			if equal, err := config.Equal(current, content); err != nil {
+				return nil, &pkg.NodeError{Address: n.Address, Op: "compare config of", Err: err}
+			} else if !equal {
+				change.Reason = "config changed"
+				change.CurrentConfig = string(current)
+				plan.Update = append(plan.Update, change)
+			} else {
+				plan.Unchanged = append(plan.Unchanged, node.String())
+			}
+		}
+	}
+
+	for _, n := range inv.Nodes {
+		if !wanted[n.Address] {
+			node := n.Node
+			plan.Remove = append(plan.Remove, &NodeChange{Node: &node, Role: n.Role, Reason: "not in spec"})
+		}
+	}
+
+	serverInstalled := true
+	for _, change := range plan.Install {
+		if change.Role == spec.RoleServer {
+			serverInstalled = false
+		}
+	}
+	for _, addon := range args.Spec.Addons {
+		manifest, err := args.Spec.ReadManifest(addon)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the manifest of addon %s: %w", addon.Name, err)
+		}
+		reason := "not deployed"
+		if serverInstalled {
+			deployed, err := readRemoteFile(ctx, plan.Server, args.Cluster, factory, addonPath(addon.Name))
+			if err == nil && bytes.Equal(deployed, manifest) {
+				continue
+			} else if err == nil {
+				reason = "manifest changed"
+			}
+		}
+		plan.Addons = append(plan.Addons, &AddonChange{Name: addon.Name, Reason: reason, Manifest: string(manifest)})
+	}
+	return plan, nil
+}
+
+// Executes plan: installs new nodes, pushes changed configs and reboots the
+// nodes, drains, stops and removes nodes from the cluster and deploys addons. The inventory
+// records the outcome, a rerun continues where a failed apply stopped.
+func ExecuteApply(ctx context.Context, args *ApplyArgs, plan *ApplyPlan) (err error) {
+	started := time.Now()
+	factory := operatorFactory(args.OperatorFactory)
+	defer func() {
+		recordApply(args.Cluster, plan, started, err)
+	}()
+
+	if len(plan.Install) > 0 {
+		installArgs := &InstallArgs{
+			SSHKeys:         args.SSHKeys,
+			Token:           plan.Token,
+			ServerID:        plan.Server.Address,
+			Confirmed:       true,
+			StateFile:       args.Cluster.StatePath(),
+			OperatorFactory: args.OperatorFactory,
+			RancherKeyPaths: args.Cluster.KeyPaths(),
+			Cluster:         args.Cluster,
+			Version:         args.Version,
+			Parallel:        args.Parallel,
+			ConfigOverrides: make(map[string]map[string]interface{}),
+		}
+		for _, change := range plan.Install {
+			installArgs.Nodes = append(installArgs.Nodes, change.Node)
+			installArgs.ConfigOverrides[change.Node.Address] = change.Overrides
+		}
+		if err = args.Cluster.Init(); err != nil {
+			return err
+		}
+		if err = Install(ctx, installArgs); err != nil {
+			return err
+		}
+	}
+
+	timeout := args.UpdateTimeout
+	if timeout == 0 {
+		timeout = DefaultUpdateTimeout
+	}
+	for _, change := range plan.Update {
+		log := logging.Default().WithNode(change.Node.Hostname)
+		log.Infof("Updating config ...")
+		if err = updateConfig(ctx, change, args.Cluster, factory, timeout); err != nil {
+			log.Errorf("Updating config ... Failed")
+			return &pkg.NodeError{Address: change.Node.Address, Op: "update config of", Err: err}
+		}
+		log.Infof("Updating config ... OK")
+	}
+
+	if len(plan.Remove) > 0 || len(plan.Addons) > 0 {
+		operator, err := connectRancher(plan.Server, factory, args.Cluster.KeyPaths()...)
+		if err != nil {
+			return &pkg.NodeError{Address: plan.Server.Address, Op: "connect to", Err: err}
+		}
+		defer operator.Close()
+
+		for _, change := range plan.Remove {
+			logging.Infof("Removing %s from the cluster", change.Node)
+			if err = removeNode(ctx, operator, change.Node, args.Cluster, factory, timeout); err != nil {
+				return &pkg.NodeError{Address: change.Node.Address, Op: "remove", Err: err}
+			}
+		}
+		for _, addon := range plan.Addons {
+			logging.Infof("Deploying addon %s", addon.Name)
+			if err = copyAsRoot(ctx, operator, strings.NewReader(addon.Manifest), int64(len(addon.Manifest)), addonPath(addon.Name), 0644); err != nil {
+				return fmt.Errorf("failed to deploy addon %s: %w", addon.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Records the removed nodes and the outcome of an apply in the inventory,
+// installed nodes are recorded by the install.
+func recordApply(cluster *inventory.Cluster, plan *ApplyPlan, started time.Time, applyErr error) {
+	inv, err := cluster.Load()
+	if err != nil {
+		logging.Errorf("Failed to load the inventory of cluster %s: %v", cluster.Name, err)
+		return
+	}
+	event := inventory.Event{Time: started, Command: "apply"}
+	for _, changes := range [][]*NodeChange{plan.Install, plan.Update, plan.Remove} {
+		for _, change := range changes {
+			event.Nodes = append(event.Nodes, change.Node.Address)
+		}
+	}
+	if applyErr == nil {
+		for _, change := range plan.Remove {
+			inv.RemoveNode(change.Node.Address)
+		}
+	} else {
+		event.Error = applyErr.Error()
+	}
+	inv.Record(event)
+	if err := cluster.Save(inv); err != nil {
+		logging.Errorf("Failed to save the inventory of cluster %s: %v", cluster.Name, err)
+	}
+}
+
+// Pushes the config of change to the node and reboots it into the new config.
+func updateConfig(ctx context.Context, change *NodeChange, cluster *inventory.Cluster, factory *pkg.CmdOperatorFactory, timeout time.Duration) error {
+	operator, err := connectRancher(change.Node, factory, cluster.KeyPaths()...)
+	if err != nil {
+		return err
+	}
+	err = copyAsRoot(ctx, operator, strings.NewReader(change.Config), int64(len(change.Config)), k3osConfigPath, 0600)
+	if err == nil {
+		rebootCtx, cancel := context.WithTimeout(ctx, DefaultRebootTimeout)
+		_, _ = operator.ExecuteContext(rebootCtx, "sudo sync && sudo reboot -f")
+		cancel()
+	}
+	_ = operator.Close()
+	if err != nil {
+		return err
+	}
+	return waitForRancher(ctx, change.Node, cluster, factory, timeout)
+}
+
+// Drains node, stops k3s on it so it does not register again and deletes it
+// from the cluster. A node that is not reachable is deleted with a warning.
+func removeNode(ctx context.Context, server pkg.CmdOperator, node *pkg.Node, cluster *inventory.Cluster, factory *pkg.CmdOperatorFactory, timeout time.Duration) error {
+	command := fmt.Sprintf("sudo k3s kubectl drain %s --ignore-daemonsets --delete-local-data --force --timeout=%s", node.Hostname, timeout)
+	if result, err := server.ExecuteContext(ctx, command); err != nil && (result == nil || !strings.Contains(string(result.StdErr), "NotFound")) {
+		return fmt.Errorf("failed to drain, %v", result)
+	}
+
+	operator, err := connectRancher(node, factory, cluster.KeyPaths()...)
+	if err != nil {
+		logging.Warnf("Failed to stop k3s on %s, stop it before the node is reused: %v", node, err)
+	} else {
+		result, err := operator.ExecuteContext(ctx, "sudo rc-service k3s-service stop && sudo rc-update del k3s-service default")
+		_ = operator.Close()
+		if err != nil {
+			return fmt.Errorf("failed to stop k3s, %v", result)
+		}
+	}
+
+	command = fmt.Sprintf("sudo k3s kubectl delete node %s --ignore-not-found", node.Hostname)
+	if result, err := server.ExecuteContext(ctx, command); err != nil {
+		return fmt.Errorf("failed to delete the node, %v", result)
+	}
+	return nil
+}
+
+// Waits until the rancher user of node can log in again.
+func waitForRancher(ctx context.Context, node *pkg.Node, cluster *inventory.Cluster, factory *pkg.CmdOperatorFactory, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		// Gives the node time to go down before the first attempt.
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+		operator, err := connectRancher(node, factory, cluster.KeyPaths()...)
+		if err == nil {
+			_, err = operator.ExecuteContext(ctx, "true")
+			_ = operator.Close()
+			if err == nil {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("node did not come back after %s: %w", timeout, err)
+		}
+	}
+}
+
+// Copies size bytes from r to path, owned by root with mode, through a file in
+// the home directory of the rancher user.
+func copyAsRoot(ctx context.Context, operator pkg.CmdOperator, r io.Reader, size int64, path string, mode os.FileMode) error {
+	if err := operator.Copy(ctx, r, "~/k3pi-upload", size, mode); err != nil {
+		return err
+	}
+	quoted := ssh.QuotePath(path)
+	command := fmt.Sprintf("sudo mkdir -p %s && sudo cp k3pi-upload %s && sudo chmod %04o %s", ssh.QuotePath(dir(path)), quoted, mode.Perm(), quoted)
+	if result, err := operator.ExecuteContext(ctx, command); err != nil {
+		return fmt.Errorf("failed to copy %s, %v", path, result)
+	}
+	return nil
+}
+
+// Reads path as root.
+func readRemoteFile(ctx context.Context, node *pkg.Node, cluster *inventory.Cluster, factory *pkg.CmdOperatorFactory, path string) ([]byte, error) {
+	operator, err := connectRancher(node, factory, cluster.KeyPaths()...)
+	if err != nil {
+		return nil, err
+	}
+	defer operator.Close()
+	result, err := operator.ExecuteContext(ctx, "sudo cat "+path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s, %v", path, result)
+	}
+	return result.StdOut, nil
+}
+
+// Reads the k3os config of node.
+func readRemoteK3osConfig(ctx context.Context, node *pkg.Node, cluster *inventory.Cluster, factory *pkg.CmdOperatorFactory) ([]byte, error) {
+	operator, err := connectRancher(node, factory, cluster.KeyPaths()...)
+	if err != nil {
+		return nil, err
+	}
+	defer operator.Close()
+	return readK3osConfig(ctx, operator)
+}
+
+func addonPath(name string) string {
+	return fmt.Sprintf("%s/k3pi-%s.yaml", AddonManifestDir, name)
+}
+
+func dir(path string) string {
+	if i := strings.LastIndex(path, "/"); i > 0 {
+		return path[:i]
+	}
+	return "/"
+}
+
+func operatorFactory(factory *pkg.CmdOperatorFactory) *pkg.CmdOperatorFactory {
+	if factory == nil {
+		return &pkg.CmdOperatorFactory{Create: ssh.NewCmdOperator}
+	}
+	return factory
+}
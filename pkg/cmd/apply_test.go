@@ -0,0 +1,147 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/spec"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh/sshtest"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var clusterSpecYaml = `
+version: 1
+name: pearl
+token: secret
+nodes:
+- address: 10.0.0.1
+  role: server
+- address: 10.0.0.2
+  role: agent
+config:
+  k3os:
+    dns_nameservers:
+    - 10.0.0.254
+addons:
+- name: hello
+  manifest: hello.yaml
+`
+
+func TestApply(t *testing.T) {
+	cluster, clusterKey, cleanup := testClusterWithKey(t)
+	defer cleanup()
+
+	_ = ioutil.WriteFile(filepath.Join(cluster.Dir, "cluster.yaml"), []byte(clusterSpecYaml), 0600)
+	_ = ioutil.WriteFile(filepath.Join(cluster.Dir, "hello.yaml"), []byte("kind: Namespace\n"), 0600)
+	clusterSpec, err := spec.Load(filepath.Join(cluster.Dir, "cluster.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, agent, removed := startK3osPi(t, clusterKey), startK3osPi(t, clusterKey), startK3osPi(t, clusterKey)
+	defer server.Close()
+	defer agent.Close()
+	defer removed.Close()
+	var removal []string
+	record := func(command string, stdout, stderr io.Writer) int {
+		removal = append(removal, command)
+		return 0
+	}
+	server.Handle("k3s kubectl drain", record)
+	server.Handle("k3s kubectl delete node", record)
+	removed.Handle("rc-", record)
+
+	inv := &inventory.Inventory{Name: cluster.Name, Server: "10.0.0.1", Token: "secret"}
+	inv.SetNode(&pkg.Node{Address: "10.0.0.1", Hostname: "pearl-1"}, spec.RoleServer)
+	inv.SetNode(&pkg.Node{Address: "10.0.0.2", Hostname: "pearl-2"}, spec.RoleAgent)
+	inv.SetNode(&pkg.Node{Address: "10.0.0.3", Hostname: "pearl-3"}, spec.RoleAgent)
+	if err := cluster.Save(inv); err != nil {
+		t.Fatal(err)
+	}
+
+	args := &ApplyArgs{
+		Spec:            clusterSpec,
+		Cluster:         cluster,
+		SSHKeys:         []string{clusterKey},
+		OperatorFactory: &pkg.CmdOperatorFactory{Create: sshtest.Rewrite(ssh.NewCmdOperator, map[string]*sshtest.Server{"10.0.0.1": server, "10.0.0.2": agent, "10.0.0.3": removed})},
+		UpdateTimeout:   time.Second * 10,
+	}
+	plan, err := PlanApply(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Install) != 0 || len(plan.Update) != 2 || len(plan.Remove) != 1 || len(plan.Addons) != 1 {
+		t.Fatalf("unexpected plan %+v", plan)
+	}
+	if plan.Remove[0].Node.Address != "10.0.0.3" {
+		t.Errorf("expected 10.0.0.3 to be removed, actual: %s", plan.Remove[0].Node)
+	}
+
+	if err := ExecuteApply(context.Background(), args, plan); err != nil {
+		t.Fatal(err)
+	}
+
+	config, _ := agent.File(sshtest.K3osRuntimeConfigFile)
+	if !strings.Contains(string(config), "10.0.0.254") || !strings.Contains(string(config), "token: secret") {
+		t.Errorf("expected the agent config from the spec, actual:\n%s", config)
+	}
+	if agent.CurrentHostname() != "pearl-2" || agent.Reboots() != 1 {
+		t.Errorf("expected the agent to reboot as pearl-2, actual: %s after %d reboots", agent.CurrentHostname(), agent.Reboots())
+	}
+	if manifest, ok := server.File(addonPath("hello")); !ok || string(manifest) != "kind: Namespace\n" {
+		t.Errorf("expected the addon to be deployed, actual: %q", manifest)
+	}
+	want := []string{
+		"k3s kubectl drain pearl-3 --ignore-daemonsets --delete-local-data --force --timeout=10s",
+		"rc-service k3s-service stop",
+		"rc-update del k3s-service default",
+		"k3s kubectl delete node pearl-3 --ignore-not-found",
+	}
+	if !reflect.DeepEqual(removal, want) {
+		t.Errorf("expected pearl-3 to be drained, stopped and deleted, actual: %v", removal)
+	}
+
+	inv, _ = cluster.Load()
+	if len(inv.Nodes) != 2 || inv.GetNode("10.0.0.3") != nil {
+		t.Errorf("expected 10.0.0.3 to be removed from the inventory, actual: %v", inv.Nodes)
+	}
+	if last := inv.History[len(inv.History)-1]; last.Command != "apply" || last.Error != "" {
+		t.Errorf("unexpected history %+v", last)
+	}
+
+	plan, err = PlanApply(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.Empty() {
+		t.Errorf("expected nothing to do, actual: %+v", plan)
+	}
+}
@@ -0,0 +1,249 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/logging"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"github.com/dustin/go-humanize"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A local path or a path on the nodes given as <nodes>:<path>.
+type CopyLocation struct {
+	// The nodes part, empty for a local path.
+	Nodes string
+	Path  string
+}
+
+func (l *CopyLocation) Remote() bool {
+	return l.Nodes != ""
+}
+
+// Parses a cp argument, a colon makes it a remote location unless the part
+// before it is a path or, on Windows, a drive letter. A part starting with a
+// key=value selector is never a path, its values may contain a slash.
+func ParseCopyLocation(arg string) *CopyLocation {
+	i := strings.Index(arg, ":")
+	if i <= 0 || (i == 1 && runtime.GOOS == "windows") {
+		return &CopyLocation{Path: arg}
+	}
+	nodes := arg[:i]
+	if j := strings.IndexAny(nodes, `=/\`); j >= 0 && (j == 0 || nodes[j] != '=') {
+		return &CopyLocation{Path: arg}
+	}
+	return &CopyLocation{Nodes: nodes, Path: arg[i+1:]}
+}
+
+type CopyArgs struct {
+	Nodes []*inventory.Node
+	// The file uploaded to RemotePath, or where RemotePath is downloaded to
+	// when Download is set.
+	LocalPath  string
+	RemotePath string
+	Download   bool
+	// Read or write the remote file as root.
+	Sudo    bool
+	Cluster *inventory.Cluster
+	// Max number of nodes copied to or from at the same time, 0 means all.
+	Parallel int
+	// Called as a transfer progresses with the bytes copied so far.
+	Progress func(node *inventory.Node, copied, total int64)
+	// Creates the operators that connect to the nodes, ssh when nil.
+	OperatorFactory *pkg.CmdOperatorFactory
+}
+
+// Copies a file to or from all nodes. A file uploaded to a path ending with
+// a slash keeps its name. A file downloaded from several nodes is written to
+// a directory per node in LocalPath, named by the hostname of the node.
+func Copy(ctx context.Context, args *CopyArgs) error {
+	cmdOperatorFactory := operatorFactory(args.OperatorFactory)
+	parallel := args.Parallel
+	if parallel <= 0 || parallel > len(args.Nodes) {
+		parallel = len(args.Nodes)
+	}
+
+	var failed []string
+	mu := sync.Mutex{}
+	sem := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+	for _, node := range args.Nodes {
+		wg.Add(1)
+		go func(node *inventory.Node) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			log := logging.Default().WithNode(node.Hostname)
+			started := time.Now()
+			transfer := upload
+			if args.Download {
+				transfer = download
+			}
+			size, err := transfer(ctx, node, args, cmdOperatorFactory)
+			if err != nil {
+				log.Errorf("Copying %s ... Failed: %v", args.RemotePath, err)
+				mu.Lock()
+				failed = append(failed, node.Hostname)
+				mu.Unlock()
+				return
+			}
+			log.Infof("Copying %s ... OK (%s in %s)", args.RemotePath, humanize.Bytes(uint64(size)), time.Since(started).Round(time.Millisecond))
+		}(node)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return fmt.Errorf("copy failed on %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func upload(ctx context.Context, node *inventory.Node, args *CopyArgs, cmdOperatorFactory *pkg.CmdOperatorFactory) (int64, error) {
+	file, err := os.Open(args.LocalPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if stat.IsDir() {
+		return 0, fmt.Errorf("%s is a directory", args.LocalPath)
+	}
+
+	remotePath := args.RemotePath
+	if remotePath == "" || strings.HasSuffix(remotePath, "/") {
+		remotePath += filepath.Base(args.LocalPath)
+	}
+
+	operator, err := connectRancher(&node.Node, cmdOperatorFactory, args.Cluster.KeyPaths()...)
+	if err != nil {
+		return 0, err
+	}
+	defer operator.Close()
+
+	var r io.Reader = file
+	if args.Progress != nil {
+		r = &progressReader{r: file, onRead: func(copied int64) { args.Progress(node, copied, stat.Size()) }}
+	}
+	if args.Sudo {
+		err = copyAsRoot(ctx, operator, r, stat.Size(), remotePath, stat.Mode())
+	} else {
+		err = operator.Copy(ctx, r, remotePath, stat.Size(), stat.Mode())
+	}
+	return stat.Size(), err
+}
+
+func download(ctx context.Context, node *inventory.Node, args *CopyArgs, cmdOperatorFactory *pkg.CmdOperatorFactory) (int64, error) {
+	localPath := args.LocalPath
+	if len(args.Nodes) > 1 {
+		name := node.Hostname
+		if name == "" {
+			name = node.Address
+		}
+		localPath = filepath.Join(localPath, name)
+		if err := os.MkdirAll(localPath, 0755); err != nil {
+			return 0, err
+		}
+	}
+	if stat, err := os.Stat(localPath); err == nil && stat.IsDir() {
+		localPath = filepath.Join(localPath, path.Base(args.RemotePath))
+	}
+
+	operator, err := connectRancher(&node.Node, cmdOperatorFactory, args.Cluster.KeyPaths()...)
+	if err != nil {
+		return 0, err
+	}
+	defer operator.Close()
+
+	// A file only root can read is copied to the home directory first.
+	remotePath := args.RemotePath
+	if args.Sudo {
+		command := fmt.Sprintf("sudo cp %s k3pi-download && sudo chown rancher k3pi-download", ssh.QuotePath(remotePath))
+		if result, err := operator.ExecuteContext(ctx, command); err != nil {
+			return 0, fmt.Errorf("failed to read %s, %v", args.RemotePath, result)
+		}
+		defer func() { _, _ = operator.ExecuteContext(context.Background(), "rm -f k3pi-download") }()
+		remotePath = "~/k3pi-download"
+	}
+
+	var file *os.File
+	var total int64
+	err = operator.CopyFrom(ctx, remotePath, func(size int64, mode os.FileMode) (io.Writer, error) {
+		f, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return nil, err
+		}
+		file, total = f, size
+		if args.Progress != nil {
+			return &progressWriter{w: file, onWrite: func(copied int64) { args.Progress(node, copied, size) }}, nil
+		}
+		return file, nil
+	})
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return total, err
+}
+
+// Reports the number of bytes read so far after each read.
+type progressReader struct {
+	r      io.Reader
+	read   int64
+	onRead func(read int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	p.onRead(p.read)
+	return n, err
+}
+
+// Reports the number of bytes written so far after each write.
+type progressWriter struct {
+	w       io.Writer
+	written int64
+	onWrite func(written int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	p.onWrite(p.written)
+	return n, err
+}
@@ -0,0 +1,146 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh/sshtest"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseCopyLocation(t *testing.T) {
+	tests := []struct {
+		arg, nodes, path string
+	}{
+		{"all:/etc/os-release", "all", "/etc/os-release"},
+		{"k3-node1:", "k3-node1", ""},
+		{"role=agent:~/x", "role=agent", "~/x"},
+		{"address=10.0.0.0/24:/etc/hosts", "address=10.0.0.0/24", "/etc/hosts"},
+		{"role=agent,address=10.0.0.0/24:x", "role=agent,address=10.0.0.0/24", "x"},
+		{"./a=b:c", "", "./a=b:c"},
+		{"./a:b", "", "./a:b"},
+		{"notes.txt", "", "notes.txt"},
+		{":x", "", ":x"},
+	}
+	for _, test := range tests {
+		location := ParseCopyLocation(test.arg)
+		if location.Nodes != test.nodes || location.Path != test.path || location.Remote() != (test.nodes != "") {
+			t.Errorf("expected %s:%s for %s, actual %+v", test.nodes, test.path, test.arg, location)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	cluster, clusterKey, cleanup := testClusterWithKey(t)
+	defer cleanup()
+
+	pis := map[string]*sshtest.Server{"10.0.0.1": startK3osPi(t, clusterKey), "10.0.0.2": startK3osPi(t, clusterKey)}
+	for _, pi := range pis {
+		defer pi.Close()
+	}
+	pis["10.0.0.2"].SetFile("/etc/os-release", []byte("NAME=\"k3OS\"\n"))
+	args := &CopyArgs{
+		Nodes: []*inventory.Node{
+			{Node: pkg.Node{Hostname: "k3-node1", Address: "10.0.0.1"}, Role: "server"},
+			{Node: pkg.Node{Hostname: "k3-node2", Address: "10.0.0.2"}, Role: "agent"},
+		},
+		Cluster:         cluster,
+		OperatorFactory: &pkg.CmdOperatorFactory{Create: sshtest.Rewrite(ssh.NewCmdOperator, pis)},
+	}
+
+	args.LocalPath = filepath.Join(cluster.Dir, "registries.yaml")
+	_ = ioutil.WriteFile(args.LocalPath, []byte("mirrors: {}\n"), 0640)
+	args.RemotePath, args.Sudo = "/etc/rancher/k3s/", true
+	var progress int64
+	args.Progress = func(node *inventory.Node, copied, total int64) {
+		if node.Hostname == "k3-node1" && copied == total {
+			progress = copied
+		}
+	}
+	if err := Copy(context.Background(), args); err != nil {
+		t.Fatal(err)
+	}
+	for address, pi := range pis {
+		if content, _ := pi.File("/etc/rancher/k3s/registries.yaml"); string(content) != "mirrors: {}\n" {
+			t.Errorf("expected the file to be copied to %s, actual %q", address, content)
+		}
+		if mode := pi.FileMode("/etc/rancher/k3s/registries.yaml"); mode != 0640 {
+			t.Errorf("expected the mode of the local file on %s, actual %04o", address, mode)
+		}
+	}
+	if progress != 12 {
+		t.Errorf("expected the progress of the whole file, actual %d", progress)
+	}
+
+	pis["10.0.0.2"].Sudo = false
+	if err := Copy(context.Background(), args); err == nil {
+		t.Error("expected the copy to fail without sudo")
+	}
+
+	args.Download, args.Progress = true, nil
+	args.LocalPath, args.RemotePath, args.Sudo = filepath.Join(cluster.Dir, "os"), "/etc/os-release", false
+	if err := Copy(context.Background(), args); err != nil {
+		t.Fatal(err)
+	}
+	node1, _ := ioutil.ReadFile(filepath.Join(args.LocalPath, "k3-node1", "os-release"))
+	node2, _ := ioutil.ReadFile(filepath.Join(args.LocalPath, "k3-node2", "os-release"))
+	if len(node1) == 0 || string(node2) != "NAME=\"k3OS\"\n" {
+		t.Errorf("expected the file of each node in its own directory, actual %q and %q", node1, node2)
+	}
+
+	args.Nodes = args.Nodes[1:]
+	args.LocalPath = filepath.Join(cluster.Dir, "os-release")
+	if err := Copy(context.Background(), args); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(args.LocalPath); string(content) != "NAME=\"k3OS\"\n" {
+		t.Errorf("expected the file of the node, actual %q", content)
+	}
+
+	pi := pis["10.0.0.2"]
+	pi.Sudo = true
+	pi.SetFile("/etc/rancher/k3s/k3s config.yaml", []byte("token: secret\n"))
+	args.LocalPath, args.RemotePath, args.Sudo = filepath.Join(cluster.Dir, "k3s.yaml"), "/etc/rancher/k3s/k3s config.yaml", true
+	progress = 0
+	args.Progress = func(node *inventory.Node, copied, total int64) {
+		if copied == total {
+			progress = copied
+		}
+	}
+	if err := Copy(context.Background(), args); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(args.LocalPath); string(content) != "token: secret\n" {
+		t.Errorf("expected the file read as root, actual %q", content)
+	}
+	if progress != 14 {
+		t.Errorf("expected the progress of the whole file, actual %d", progress)
+	}
+	if _, ok := pi.File("~/k3pi-download"); ok {
+		t.Error("expected the copy in the home directory to be removed")
+	}
+}
@@ -0,0 +1,234 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ExecFormatText = "text"
+	ExecFormatJSON = "json"
+)
+
+type ExecArgs struct {
+	Nodes []*inventory.Node
+	// Run by the rancher user with sh, prefix with sudo to run as root.
+	Command string
+	Cluster *inventory.Cluster
+	// Max number of nodes the command runs on at the same time, 0 means all.
+	Parallel int
+	// Max time the command runs on each node, 0 means no limit.
+	Timeout time.Duration
+	// Creates the operators that connect to the nodes, ssh when nil.
+	OperatorFactory *pkg.CmdOperatorFactory
+}
+
+// The output of a command on one node.
+type ExecResult struct {
+	Hostname string `json:"hostname"`
+	Address  string `json:"address"`
+	Role     string `json:"role"`
+	// Exit code of the command, -1 if it did not run or did not exit.
+	ExitCode int `json:"exit_code"`
+	// The command rebooted or powered off the node, which closed the session
+	// before the command exited.
+	Rebooted bool   `json:"rebooted,omitempty"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	// Why the command could not run or did not exit.
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"-"`
+}
+
+// Marshals the result with the duration in seconds.
+func (r *ExecResult) MarshalJSON() ([]byte, error) {
+	type plain ExecResult
+	return json.Marshal(&struct {
+		*plain
+		DurationSeconds float64 `json:"duration_seconds"`
+	}{(*plain)(r), r.Duration.Round(time.Millisecond).Seconds()})
+}
+
+func (r *ExecResult) Succeeded() bool {
+	return r.Error == "" && (r.ExitCode == 0 || r.Rebooted)
+}
+
+// The results of a command, in the order of the nodes.
+type ExecReport struct {
+	Command string        `json:"command"`
+	Results []*ExecResult `json:"results"`
+}
+
+// Returns the number of nodes the command did not succeed on.
+func (r *ExecReport) Failed() int {
+	failed := 0
+	for _, result := range r.Results {
+		if !result.Succeeded() {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Runs the command on all nodes in parallel as the rancher user. Failing
+// nodes do not stop the command on other nodes, they are reported in the
+// results.
+func Exec(ctx context.Context, args *ExecArgs) *ExecReport {
+	cmdOperatorFactory := args.OperatorFactory
+	if cmdOperatorFactory == nil {
+		cmdOperatorFactory = &pkg.CmdOperatorFactory{Create: ssh.NewCmdOperator}
+	}
+	parallel := args.Parallel
+	if parallel <= 0 || parallel > len(args.Nodes) {
+		parallel = len(args.Nodes)
+	}
+
+	report := &ExecReport{Command: args.Command, Results: make([]*ExecResult, len(args.Nodes))}
+	sem := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+	for i, node := range args.Nodes {
+		wg.Add(1)
+		go func(i int, node *inventory.Node) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			report.Results[i] = execNode(ctx, node, args, cmdOperatorFactory)
+		}(i, node)
+	}
+	wg.Wait()
+	return report
+}
+
+func execNode(ctx context.Context, node *inventory.Node, args *ExecArgs, cmdOperatorFactory *pkg.CmdOperatorFactory) *ExecResult {
+	result := &ExecResult{Hostname: node.Hostname, Address: node.Address, Role: node.Role, ExitCode: -1}
+	if err := ctx.Err(); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if args.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, args.Timeout)
+		defer cancel()
+	}
+
+	started := time.Now()
+	operator, err := connectRancher(&node.Node, cmdOperatorFactory, args.Cluster.KeyPaths()...)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer operator.Close()
+
+	res, err := operator.ExecuteContext(ctx, args.Command)
+	result.Duration = time.Since(started)
+	if res != nil {
+		result.ExitCode = res.ExitCode
+		result.Stdout, result.Stderr = string(res.StdOut), string(res.StdErr)
+	}
+	// A reboot drops the session before the command exits.
+	var exitMissing *gossh.ExitMissingError
+	if errors.As(err, &exitMissing) && ctx.Err() == nil && isReboot(args.Command) {
+		result.Rebooted = true
+		return result
+	}
+	// A non zero exit code is reported by the exit code alone.
+	if err != nil && result.ExitCode == -1 {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// Returns true if command is a single reboot, poweroff or shutdown command,
+// optionally run with sudo.
+func isReboot(command string) bool {
+	if strings.ContainsAny(command, ";&|<>()`$\n") {
+		return false
+	}
+	fields := strings.Fields(command)
+	if len(fields) > 0 && fields[0] == "sudo" {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return false
+	}
+	switch fields[0] {
+	case "reboot", "poweroff", "shutdown", "halt":
+		return true
+	}
+	return false
+}
+
+// Writes the report in format, text or json.
+func (r *ExecReport) Write(out io.Writer, format string) error {
+	switch format {
+	case "", ExecFormatText:
+		return r.WriteText(out)
+	case ExecFormatJSON:
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	default:
+		return fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
+// Writes the output of each node under a header followed by a summary of
+// the exit codes.
+func (r *ExecReport) WriteText(out io.Writer) error {
+	var failed []string
+	for _, result := range r.Results {
+		status := fmt.Sprintf("exit %d", result.ExitCode)
+		if result.Error != "" {
+			status = "error: " + result.Error
+		} else if result.Rebooted {
+			status = "rebooted"
+		}
+		_, _ = fmt.Fprintf(out, "==> %s (%s) %s, %s <==\n", result.Hostname, result.Address, status, result.Duration.Round(time.Millisecond))
+		for _, output := range []string{result.Stdout, result.Stderr} {
+			if output != "" {
+				_, _ = io.WriteString(out, strings.TrimSuffix(output, "\n")+"\n")
+			}
+		}
+		_, _ = fmt.Fprintln(out)
+		if !result.Succeeded() {
+			failed = append(failed, result.Hostname)
+		}
+	}
+	summary := fmt.Sprintf("%d nodes, %d succeeded, %d failed", len(r.Results), len(r.Results)-len(failed), len(failed))
+	if len(failed) > 0 {
+		summary += ": " + strings.Join(failed, ", ")
+	}
+	_, err := fmt.Fprintln(out, summary)
+	return err
+}
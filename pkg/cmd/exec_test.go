@@ -0,0 +1,163 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh/sshtest"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestExec(t *testing.T) {
+	cluster, clusterKey, cleanup := testClusterWithKey(t)
+	defer cleanup()
+
+	pis := map[string]*sshtest.Server{"10.0.0.1": startK3osPi(t, clusterKey), "10.0.0.2": startK3osPi(t, clusterKey)}
+	for address, pi := range pis {
+		defer pi.Close()
+		address := address
+		pi.Handle("df -h", func(command string, stdout, stderr io.Writer) int {
+			if address == "10.0.0.2" {
+				_, _ = fmt.Fprintln(stderr, "df: /: No such file or directory")
+				return 1
+			}
+			_, _ = fmt.Fprintln(stdout, "/dev/mmcblk0p2 29G 1.2G 27G 5% /")
+			return 0
+		})
+	}
+
+	args := &ExecArgs{
+		Nodes: []*inventory.Node{
+			{Node: pkg.Node{Hostname: "k3-node1", Address: "10.0.0.1"}, Role: "server"},
+			{Node: pkg.Node{Hostname: "k3-node2", Address: "10.0.0.2"}, Role: "agent"},
+			{Node: pkg.Node{Hostname: "k3-node3", Address: "127.0.0.1", K3osPort: 1}, Role: "agent"},
+		},
+		Command:         "df -h",
+		Cluster:         cluster,
+		Parallel:        2,
+		OperatorFactory: &pkg.CmdOperatorFactory{Create: sshtest.Rewrite(ssh.NewCmdOperator, pis)},
+	}
+	report := Exec(context.Background(), args)
+
+	if report.Failed() != 2 {
+		t.Errorf("expected 2 failed nodes, actual %d", report.Failed())
+	}
+	node1, node2, node3 := report.Results[0], report.Results[1], report.Results[2]
+	if !node1.Succeeded() || !strings.Contains(node1.Stdout, "mmcblk0p2") {
+		t.Errorf("expected the output of df on k3-node1: %+v", node1)
+	}
+	if node2.ExitCode != 1 || node2.Error != "" || !strings.Contains(node2.Stderr, "No such file") {
+		t.Errorf("expected exit code 1 on k3-node2: %+v", node2)
+	}
+	if node3.ExitCode != -1 || node3.Error == "" {
+		t.Errorf("expected a connection error on k3-node3: %+v", node3)
+	}
+
+	out := &bytes.Buffer{}
+	if err := report.WriteText(out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "==> k3-node2 (10.0.0.2) exit 1") || !strings.HasSuffix(out.String(), "3 nodes, 1 succeeded, 2 failed: k3-node2, k3-node3\n") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	out.Reset()
+	if err := report.Write(out, ExecFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	decoded := &ExecReport{}
+	if err := json.Unmarshal(out.Bytes(), decoded); err != nil || len(decoded.Results) != 3 || decoded.Results[1].ExitCode != 1 {
+		t.Errorf("unexpected json report: %s", out)
+	}
+	if !strings.Contains(out.String(), `"duration_seconds": `) {
+		t.Errorf("expected the duration in seconds: %s", out)
+	}
+}
+
+func TestExec_Reboot(t *testing.T) {
+	cluster, clusterKey, cleanup := testClusterWithKey(t)
+	defer cleanup()
+
+	pi := startK3osPi(t, clusterKey)
+	defer pi.Close()
+	// Drops the session before the exit status is sent.
+	pi.Handle("reboot", func(command string, stdout, stderr io.Writer) int {
+		pi.Reboot()
+		return 0
+	})
+
+	args := &ExecArgs{
+		Nodes:           []*inventory.Node{{Node: pkg.Node{Hostname: "k3-node1", Address: "10.0.0.1"}, Role: "agent"}},
+		Command:         "sudo reboot",
+		Cluster:         cluster,
+		OperatorFactory: &pkg.CmdOperatorFactory{Create: sshtest.Rewrite(ssh.NewCmdOperator, map[string]*sshtest.Server{"10.0.0.1": pi})},
+	}
+	report := Exec(context.Background(), args)
+
+	if result := report.Results[0]; !result.Succeeded() || !result.Rebooted || result.ExitCode != -1 || pi.Reboots() != 1 {
+		t.Errorf("expected the reboot to succeed: %+v", result)
+	}
+	out := &bytes.Buffer{}
+	_ = report.WriteText(out)
+	if !strings.Contains(out.String(), "==> k3-node1 (10.0.0.1) rebooted") {
+		t.Errorf("expected the node to be reported as rebooted:\n%s", out)
+	}
+
+	// A session dropped by any other command is a failure.
+	dropped := startK3osPi(t, clusterKey)
+	defer dropped.Close()
+	dropped.Handle("reboot", func(command string, stdout, stderr io.Writer) int {
+		dropped.Reboot()
+		return 0
+	})
+	args.OperatorFactory = &pkg.CmdOperatorFactory{Create: sshtest.Rewrite(ssh.NewCmdOperator, map[string]*sshtest.Server{"10.0.0.1": dropped})}
+	args.Command = "sudo reboot; echo done"
+	if result := Exec(context.Background(), args).Results[0]; result.Succeeded() || result.Rebooted || result.Error == "" {
+		t.Errorf("expected the dropped session to fail: %+v", result)
+	}
+}
+
+func TestIsReboot(t *testing.T) {
+	for command, expected := range map[string]bool{
+		"sudo reboot":                     true,
+		"reboot -f":                       true,
+		"sudo shutdown -h now":            true,
+		"poweroff":                        true,
+		"sudo reboot; echo done":          false,
+		"sudo apk upgrade && sudo reboot": false,
+		"echo reboot":                     false,
+		"cat /var/log/shutdown":           false,
+		"sudo":                            false,
+	} {
+		if actual := isReboot(command); actual != expected {
+			t.Errorf("expected %v for %q, actual: %v", expected, command, actual)
+		}
+	}
+}
@@ -24,18 +24,23 @@ package cmd
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/TheNatureOfSoftware/k3pi/pkg"
 	"github.com/TheNatureOfSoftware/k3pi/pkg/config"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/logging"
 	"github.com/TheNatureOfSoftware/k3pi/pkg/misc"
 	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
-	"github.com/bramvdbogaerde/go-scp"
 	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -43,98 +48,241 @@ var checkSumFileTemplate = "sha256sum-%s.txt"
 
 const DefaultSSHAuthorizedKey = "~/.ssh/id_rsa.pub"
 
+// Version of the k3os image installed.
+const K3osVersion = "v0.3.0"
+
+const (
+	DefaultUploadTimeout  = time.Minute * 10
+	DefaultExtractTimeout = time.Minute * 5
+	DefaultRebootTimeout  = time.Minute
+	DefaultBootTimeout    = time.Minute
+)
+
+// Max duration of the install phases that may hang, zero uses the default.
+type PhaseTimeouts struct {
+	Upload, Extract, Reboot time.Duration
+	// Max time for a rebooted node to accept ssh connections again.
+	Boot time.Duration
+}
+
+// Returns the timeouts with zero values replaced by the defaults.
+func (t PhaseTimeouts) withDefaults() PhaseTimeouts {
+	if t.Upload == 0 {
+		t.Upload = DefaultUploadTimeout
+	}
+	if t.Extract == 0 {
+		t.Extract = DefaultExtractTimeout
+	}
+	if t.Reboot == 0 {
+		t.Reboot = DefaultRebootTimeout
+	}
+	if t.Boot == 0 {
+		t.Boot = DefaultBootTimeout
+	}
+	return t
+}
+
 type installer struct {
 	resourceDir     string
 	config          *[]byte
 	target          *pkg.Target
 	operatorFactory *pkg.CmdOperatorFactory
+	state           *InstallState
+	timeouts        PhaseTimeouts
+
+	operator pkg.CmdOperator
+	log      *logging.Logger
+	output   io.WriteCloser
 }
 
-func (ins *installer) Install() error {
+// Installs k3os on the target node. The install is split in phases that are
+// recorded in the install state, an install is resumed from the last safe phase.
+// Cancelling ctx aborts the running phase.
+func (ins *installer) Install(ctx context.Context) error {
+	node := ins.target.Node
+	ins.log = logging.Default().WithNode(node.Hostname)
+	ins.timeouts = ins.timeouts.withDefaults()
+	start := ins.state.ResumePhase(node)
+	if start == pkg.PhaseJoined {
+		// Only joining the cluster remains, that is checked by the stage gate.
+		return nil
+	}
+
+	output, err := logging.NodeOutput(node.Hostname)
+	if err != nil {
+		return errors.Wrap(err, "failed to open node log")
+	}
+	defer output.Close()
+	ins.output = output
+
+	err = ins.state.Run(node, pkg.PhaseConnected, ins.connect)
+	if err != nil {
+		return err
+	}
+	defer ins.operator.Close()
+
+	steps := []struct {
+		phase pkg.Phase
+		run   func(ctx context.Context) error
+	}{
+		{pkg.PhaseUploaded, ins.upload},
+		{pkg.PhaseVerified, ins.verify},
+		{pkg.PhaseExtracted, ins.extract},
+		{pkg.PhaseConfigured, ins.configure},
+		{pkg.PhaseRebooted, ins.reboot},
+	}
+	for _, step := range steps {
+		if step.phase.Before(start) {
+			ins.log.Debugf("Skipping %s, resuming at %s", step.phase, start)
+			continue
+		}
+		run := step.run
+		if err := ins.state.Run(node, step.phase, func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return run(ctx)
+		}); err != nil {
+			return err
+		}
+		ins.log.Debugf("Phase %s completed", step.phase)
+	}
+
+	return nil
+}
+
+func (ins *installer) connect() error {
 	sshConfig, sshAgentCloseHandler, err := ssh.NewClientConfigFor(ins.target.Node)
-	misc.PanicOnError(err, "failed to create ssh config")
+	if err != nil {
+		return errors.Wrap(err, "failed to create ssh config")
+	}
 	defer sshAgentCloseHandler()
 
-	address := ins.target.Node.Address
-	sshAddress := fmt.Sprintf("%s:%d", address, 22)
+	ctx := &pkg.CmdOperatorCtx{
+		Address:         ins.target.Node.SSHAddress(),
+		SSHClientConfig: sshConfig,
+		EnableStdOut:    false,
+		JumpHost:        ins.target.Node.JumpHost,
+		Log:             ins.output,
+		OnLine: func(line string, stderr bool) {
+			ins.log.Debugf("%s", line)
+		},
+	}
 
-	scpClient := scp.NewClient(sshAddress, sshConfig)
-	err = scpClient.Connect()
-	misc.PanicOnError(err, fmt.Sprintf("scp client failed to connect to %s", address))
+	ins.operator, err = ins.operatorFactory.Create(ctx)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to connect to %s", ctx.Address))
+	}
+	return nil
+}
+
+// Copies the image and the cloud config to the home directory.
+func (ins *installer) upload(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, ins.timeouts.Upload)
+	defer cancel()
 
 	imageFile, err := os.Open(ins.target.GetImageFilePath(ins.resourceDir))
-	misc.PanicOnError(err, "failed to open image file")
+	if err != nil {
+		return errors.Wrap(err, "failed to open image file")
+	}
 	defer imageFile.Close()
 	stat, err := imageFile.Stat()
-	misc.PanicOnError(err, "failed to get file info")
+	if err != nil {
+		return errors.Wrap(err, "failed to get file info")
+	}
 
-	err = scpClient.Copy(bufio.NewReader(imageFile), fmt.Sprintf("~/%s", ins.target.GetImageFilename()), "0655", stat.Size())
-	misc.PanicOnError(err, "failed to copy image file")
+	ins.log.Debugf("Copying %s (%d bytes)", ins.target.GetImageFilename(), stat.Size())
+	err = ins.copy(ctx, bufio.NewReader(imageFile), ins.target.GetImageFilename(), stat.Size(), 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to copy image file")
+	}
+	ins.state.AddTransferred(ins.target.Node, stat.Size())
 
-	// It's strange but we need to close and open for each file
-	_ = scpClient.Session.Close()
-	err = scpClient.Connect()
-	misc.PanicOnError(err, fmt.Sprintf("scp client failed to connect to %s", address))
-	defer scpClient.Session.Close()
+	err = ins.copy(ctx, bytes.NewReader(*ins.config), "config.yaml", int64(len(*ins.config)), 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to copy config file")
+	}
+	ins.state.AddTransferred(ins.target.Node, int64(len(*ins.config)))
+	return nil
+}
 
-	err = scpClient.Copy(bytes.NewReader(*ins.config), fmt.Sprintf("~/%s", "config.yaml"), "0655", int64(len(*ins.config)))
-	misc.PanicOnError(err, "failed to copy config file")
+// Copies r to filename in the home directory.
+func (ins *installer) copy(ctx context.Context, r io.Reader, filename string, size int64, mode os.FileMode) error {
+	return ins.operator.Copy(ctx, r, fmt.Sprintf("~/%s", filename), size, mode)
+}
 
-	ctx := &pkg.CmdOperatorCtx{
-		Address:         sshAddress,
-		SSHClientConfig: sshConfig,
-		EnableStdOut:    false,
+// Verifies the uploaded image against the checksum of the local image.
+func (ins *installer) verify(ctx context.Context) error {
+	checksum, err := misc.CalculateSHA256(ins.target.GetImageFilePath(ins.resourceDir))
+	if err != nil {
+		return errors.Wrap(err, "failed to calculate image checksum")
 	}
+	result, err := ins.operator.ExecuteContext(ctx, fmt.Sprintf("echo '%s  %s' | sha256sum -c -", checksum, ins.target.GetImageFilename()))
+	if ctx.Err() != nil {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w: uploaded %s, %v", pkg.ErrChecksumMismatch, ins.target.GetImageFilename(), result)
+	}
+	return nil
+}
 
-	operator, err := ins.operatorFactory.Create(ctx)
-	misc.PanicOnError(err, fmt.Sprintf("failed to connect to %s", ctx.Address))
+func (ins *installer) extract(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, ins.timeouts.Extract)
+	defer cancel()
 
-	result, err := operator.Execute(fmt.Sprintf("sudo tar zxvf %s --strip-components=1 -C /", ins.target.GetImageFilename()))
-	if err2 := errors.Wrap(err, fmt.Sprintf("failed to extract %s, result:\n %v", ins.target.GetImageFilename(), result)); err2 != nil {
-		return err2
-	}
+	result, err := ins.operator.ExecuteContext(ctx, fmt.Sprintf("sudo tar zxvf %s --strip-components=1 -C /", ins.target.GetImageFilename()))
+	return errors.Wrap(err, fmt.Sprintf("failed to extract %s, %v", ins.target.GetImageFilename(), result))
+}
 
-	result, err = operator.Execute("sudo cp config.yaml /k3os/system/config.yaml")
-	if err2 := errors.Wrap(err, fmt.Sprintf("failed to install config:\n %v", result)); err2 != nil {
-		return err2
-	}
+func (ins *installer) configure(ctx context.Context) error {
+	result, err := ins.operator.ExecuteContext(ctx, "sudo cp config.yaml /k3os/system/config.yaml")
+	return errors.Wrap(err, fmt.Sprintf("failed to install config, %v", result))
+}
 
-	_, _ = operator.Execute("sudo sync && sudo reboot -f")
+// Reboots into k3os, the connection is dropped by the reboot so the result
+// is ignored. The reboot command is abandoned when it hangs for longer than
+// the reboot timeout.
+func (ins *installer) reboot(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, ins.timeouts.Reboot)
+	defer cancel()
 
+	_, _ = ins.operator.ExecuteContext(ctx, "sudo sync && sudo reboot -f")
 	return nil
 }
 
-func MakeInstallers(task *pkg.InstallTask, resourceDir string) pkg.Installers {
-
-	var installers pkg.Installers
+func (ins *installer) GetTarget() *pkg.Target {
+	return ins.target
+}
 
+// Downloads and verifies the k3os images of all targets into a new resource
+// directory. Returns pkg.ErrUnsupportedArch if a target has an unknown arch.
+func MakeResourceDir(task *pkg.InstallTask) (string, error) {
+	targets := task.Agents
 	if task.Server != nil {
-		installers = append(installers, makeInstaller(task, task.Server, resourceDir, true))
+		targets = append(pkg.Targets{task.Server}, targets...)
 	}
 
-	for _, agent := range task.Agents {
-		installers = append(installers, makeInstaller(task, agent, resourceDir, false))
+	images := make(map[string]string)
+	for _, target := range targets {
+		arch := target.Node.GetArch()
+		if arch == "unknown" {
+			return "", &pkg.NodeError{Address: target.Node.Address, Op: "resolve image for", Err: pkg.ErrUnsupportedArch}
+		}
+		images[target.GetImageFilename()] = fmt.Sprintf(checkSumFileTemplate, arch)
 	}
 
-	return installers
-}
-
-func MakeResourceDir(task *pkg.InstallTask) string {
 	home, err := homedir.Dir()
-	misc.PanicOnError(err, "failed to resolve home directory")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to resolve home directory")
+	}
 
 	resourceDir, err := ioutil.TempDir(home, ".k3pi-")
-	misc.PanicOnError(err, "failed to create resource directory")
-
-	images := make(map[string]string)
-	if task.Server != nil {
-		images[task.Server.GetImageFilename()] = fmt.Sprintf(checkSumFileTemplate, task.Server.Node.GetArch())
-	}
-	for _, agent := range task.Agents {
-		images[agent.GetImageFilename()] = fmt.Sprintf(checkSumFileTemplate, agent.Node.GetArch())
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create resource directory")
 	}
 
-	url := "https://github.com/rancher/k3os/releases/download/v0.3.0/%s"
+	url := "https://github.com/rancher/k3os/releases/download/" + K3osVersion + "/%s"
 	pathSeparator := string(os.PathSeparator)
 	for imageFile, checkSumFile := range images {
 		download := misc.FileDownload{
@@ -143,31 +291,40 @@ func MakeResourceDir(task *pkg.InstallTask) string {
 			Url:              fmt.Sprintf(url, imageFile),
 			CheckSumUrl:      fmt.Sprintf(url, checkSumFile),
 		}
-		err := misc.DownloadAndVerify(download)
-		misc.PanicOnError(err, "failed to create resource directory")
+		if err := misc.DownloadAndVerify(download); err != nil {
+			return resourceDir, errors.Wrap(err, fmt.Sprintf("failed to download %s", imageFile))
+		}
 	}
 
-	return resourceDir
+	return resourceDir, nil
 }
 
-func makeInstaller(task *pkg.InstallTask, target *pkg.Target, resourceDir string, server bool) pkg.Installer {
-
-	var configYaml *[]byte
-	var err error
-
+// Returns the k3os config of target, the config of a saved plan or a config
+// generated from the server or agent template.
+func targetConfig(target *pkg.Target, server bool) (*[]byte, error) {
+	if len(target.Config) > 0 {
+		return &target.Config, nil
+	}
 	if server {
-		configYaml, err = config.NewServerConfig("", target)
-	} else {
-		configYaml, err = config.NewAgentConfig("", target)
+		return config.NewServerConfig("", target)
 	}
+	return config.NewAgentConfig("", target)
+}
 
-	misc.PanicOnError(err, "failed to create server installer")
+func makeInstaller(task *pkg.InstallTask, target *pkg.Target, resourceDir string, server bool, state *InstallState, timeouts PhaseTimeouts) (pkg.Installer, error) {
 
-	cmdOperatorFactory := &pkg.CmdOperatorFactory{}
-	if task.DryRun {
-		cmdOperatorFactory.Create = ssh.NewDryRunCmdOperator
-	} else {
-		cmdOperatorFactory.Create = ssh.NewCmdOperator
+	configYaml, err := targetConfig(target, server)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to create config for %s", target.Node))
+	}
+
+	cmdOperatorFactory := task.OperatorFactory
+	if cmdOperatorFactory == nil {
+		if task.DryRun {
+			cmdOperatorFactory = &pkg.CmdOperatorFactory{Create: ssh.NewRecorder().Create}
+		} else {
+			cmdOperatorFactory = &pkg.CmdOperatorFactory{Create: ssh.NewCmdOperator}
+		}
 	}
 
 	return &installer{
@@ -175,7 +332,9 @@ func makeInstaller(task *pkg.InstallTask, target *pkg.Target, resourceDir string
 		config:          configYaml,
 		target:          target,
 		operatorFactory: cmdOperatorFactory,
-	}
+		state:           state,
+		timeouts:        timeouts,
+	}, nil
 }
 
 type InstallArgs struct {
@@ -184,34 +343,89 @@ type InstallArgs struct {
 	Token, ServerID string
 	*pkg.HostnameSpec
 	DryRun, Confirmed bool
+	// Continue the install even if pre-flight checks fail.
+	SkipPreflight bool
+	// File where the install progress of each node is recorded.
+	StateFile string
+	// Skip completed nodes and restart failed nodes from the last safe phase.
+	Resume bool
+	// Report written when the install ends, json or junit format.
+	ReportFile, ReportFormat string
+	// Format of the plan printed by a dry run, text or json.
+	PlanFormat string
+	// Creates the operators that connect to the nodes, ssh when nil.
+	OperatorFactory *pkg.CmdOperatorFactory
+	// Keys the rancher user logs in with after the install, tried before
+	// ~/.ssh/id_rsa.
+	RancherKeyPaths []string
+	// Cluster whose inventory records the install and which keeps the
+	// kubeconfig, a kubeconfig k3s-*.yaml is written to the working
+	// directory when nil.
+	Cluster *inventory.Cluster
+	// Version of k3pi recorded in the inventory.
+	Version string
+	// Values merged into the k3os config by node address.
+	ConfigOverrides map[string]map[string]interface{}
+	// Saved plan to execute, it replaces the nodes, server, token, keys and
+	// hostnames of the args.
+	Plan *InstallPlan
+	// Max number of nodes installed concurrently.
+	Parallel int
+	// Stop scheduling new installers as soon as one fails.
+	FailFast bool
+	// Number of agents installed per batch, 0 installs all agents in one batch.
+	BatchSize int
+	// Max time to wait for the server to become ready and for each batch of
+	// agents to join.
+	ServerReadyTimeout, JoinTimeout time.Duration
+	PhaseTimeouts
 }
 
-// Installs k3os on all nodes.
-func Install(args *InstallArgs) error {
-
-	generateHostname(args.Nodes, args.HostnameSpec)
-
-	serverNode, agentNodes, err := SelectServerAndAgents(args.Nodes, args.ServerID)
-	misc.PanicOnError(err, "failed to resolve server and agents")
+// Installs k3os on all nodes. Cancelling ctx stops scheduling of new
+// installers and aborts the operations of installers already running, the
+// phase each node was left in is printed in the summary.
+func Install(ctx context.Context, args *InstallArgs) error {
+	started := time.Now()
 
-
-	if serverNode != nil {
-		misc.Info(fmt.Sprintf("Server:\t%s (%s)", serverNode.Hostname, serverNode.Address))
-	} else {
-		if len(args.Token) == 0 {
-			return fmt.Errorf("no server selected and no join token")
-		}
+	switch args.ReportFormat {
+	case "", ReportFormatJSON, ReportFormatJUnit:
+	default:
+		return fmt.Errorf("unknown report format: %s", args.ReportFormat)
+	}
+	switch args.PlanFormat {
+	case "", PlanFormatText, PlanFormatJSON:
+	default:
+		return fmt.Errorf("unknown plan format: %s", args.PlanFormat)
+	}
+	// Keeps stdout for the plan when it is written as JSON.
+	var out io.Writer = os.Stdout
+	if args.DryRun && args.PlanFormat == PlanFormatJSON {
+		out = os.Stderr
 	}
 
-	misc.Info(fmt.Sprintf("Agents:\t%s", agentNodes.Info(func(n *pkg.Node) string {
-		return fmt.Sprintf("%s (%s)", n.Hostname, n.Address)
-	})))
+	cmdOperatorFactory := operatorFactory(args.OperatorFactory)
+	prepared, err := prepareInstall(args)
+	if err != nil {
+		return err
+	}
+	installTask, serverNode, state := prepared.task, prepared.server, prepared.state
 
-	if ! args.Confirmed {
+	if args.Plan != nil {
+		if err = args.Plan.verify(ctx, installTask, args.RancherKeyPaths, cmdOperatorFactory); err != nil {
+			return err
+		}
+	} else if !args.Confirmed {
 		if misc.DataPipedIn() {
 			return fmt.Errorf("install needs to be confirmed (--yes|-y)")
 		}
-		fmt.Printf("Overwrire all nodes? (y/N): ")
+		plan, err := newInstallPlan(ctx, args, prepared, cmdOperatorFactory)
+		if err != nil {
+			return err
+		}
+		if err = plan.WriteText(out); err != nil {
+			return err
+		}
+		fmt.Printf("Overwrite the nodes to install? (y/N): ")
 		var reply string
 		_, _ = fmt.Scanln(&reply)
 		if answer := strings.TrimSpace(strings.ToUpper(string(reply))); answer != "YES" && answer != "Y" {
@@ -219,17 +433,140 @@ func Install(args *InstallArgs) error {
 		}
 	}
 
+	recorder := ssh.NewRecorder()
+	if args.DryRun {
+		installTask.OperatorFactory = &pkg.CmdOperatorFactory{Create: recorder.Create}
+	} else {
+		installTask.OperatorFactory = cmdOperatorFactory
+	}
+	if !args.Resume {
+		if installTask.Server != nil {
+			state.Reset(installTask.Server.Node, "server")
+		}
+		for _, agent := range installTask.Agents {
+			state.Reset(agent.Node, "agent")
+		}
+	}
+
+	resourceDir, err := MakeResourceDir(installTask)
+	if resourceDir != "" {
+		defer os.RemoveAll(resourceDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	preflightResults := RunPreflight(ctx, installTask, resourceDir, cmdOperatorFactory, state, args.Parallel)
+	preflightResults.Print(out)
+	if !preflightResults.Passed() {
+		if !args.SkipPreflight {
+			return &PreflightError{Results: preflightResults}
+		}
+		logging.Warnf("Pre-flight checks failed, continuing since pre-flight checks are skipped")
+	}
+
+	probeNode := serverNode
+	if probeNode == nil {
+		probeNode = &pkg.Node{Address: args.ServerID}
+	}
+	rancherSSHSettings := misc.RancherSSHSettings(args.RancherKeyPaths...)
+	stages, err := makeStages(installTask, resourceDir, args, NewReadinessProbe(probeNode, rancherSSHSettings, cmdOperatorFactory), state)
+	if err != nil {
+		return err
+	}
+
+	err = runStages(ctx, stages, args.Parallel, args.FailFast)
+	state.PrintSummary(out, args.Nodes)
+	if args.ReportFile != "" {
+		if reportErr := NewReport(state, args.Nodes, started).WriteFile(args.ReportFile, args.ReportFormat); reportErr != nil {
+			logging.Errorf("Failed to write report %s: %v", args.ReportFile, reportErr)
+		}
+	}
+	if args.DryRun {
+		if err != nil {
+			return err
+		}
+		return NewPlan(installTask, recorder).Write(os.Stdout, args.PlanFormat)
+	}
+
+	if err == nil && serverNode != nil {
+		err = fetchKubeconfig(ctx, serverNode, rancherSSHSettings, args.Cluster, args.PhaseTimeouts.withDefaults().Boot)
+	}
+	if args.Cluster != nil {
+		recordInstall(args, prepared.inv, state, installTask, started, err)
+	}
+	return err
+}
+
+// The nodes to install resolved from the install args.
+type preparedInstall struct {
+	// Targets to install, without completed nodes when resuming.
+	task *pkg.InstallTask
+	// Server node, nil when agents join an existing server.
+	server *pkg.Node
+	state  *InstallState
+	inv    *inventory.Inventory
+}
+
+// Names the nodes, selects the server and creates the targets with their
+// token and config overrides, or those of args.Plan when set. Completed nodes
+// are skipped when resuming.
+func prepareInstall(args *InstallArgs) (*preparedInstall, error) {
+	if args.Plan != nil {
+		if err := args.Plan.configure(args); err != nil {
+			return nil, err
+		}
+	}
+	if args.HostnameSpec != nil {
+		generateHostname(args.Nodes, args.HostnameSpec)
+	}
+
+	serverNode, agentNodes, err := SelectServerAndAgents(args.Nodes, args.ServerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to resolve server and agents")
+	}
+
+	inv := &inventory.Inventory{}
+	if args.Cluster != nil {
+		if inv, err = args.Cluster.Load(); err != nil {
+			return nil, errors.Wrap(err, "failed to load the cluster inventory")
+		}
+	}
+	token := args.Token
+	if token == "" {
+		token = inv.Token
+	}
+
+	if serverNode != nil {
+		logging.Infof("Server:\t%s", serverNode)
+	} else {
+		if len(token) == 0 {
+			return nil, fmt.Errorf("no server selected and no join token")
+		}
+	}
+
+	logging.Infof("Agents:\t%s", agentNodes.Info(func(n *pkg.Node) string {
+		return n.String()
+	}))
+
 	var serverTarget *pkg.Target
 	agentTargets := agentNodes.Targets(args.SSHKeys)
+	agentTargets.SetToken(token)
+	for _, target := range agentTargets {
+		target.ConfigOverrides = args.ConfigOverrides[target.Node.Address]
+	}
 
 	if serverNode != nil {
 		serverTarget = serverNode.GetTarget(args.SSHKeys)
+		serverTarget.Token = token
+		serverTarget.ConfigOverrides = args.ConfigOverrides[serverNode.Address]
 		agentTargets.SetServerIP(serverNode.Address)
 	} else {
 		serverIP := net.ParseIP(args.ServerID)
 		if serverIP == nil {
-			return fmt.Errorf("no server node found and --server '%s' is not a valid IP address", args.ServerID)
+			return nil, fmt.Errorf("no server node found and --server '%s' is not a valid IP address", args.ServerID)
 		}
+		agentTargets.SetServerIP(serverIP.String())
 	}
 
 	installTask := &pkg.InstallTask{
@@ -237,43 +574,114 @@ func Install(args *InstallArgs) error {
 		Server: serverTarget,
 		Agents: agentTargets,
 	}
+	if args.Plan != nil {
+		args.Plan.setConfigs(installTask)
+	}
 
-	resourceDir := MakeResourceDir(installTask)
-	defer os.RemoveAll(resourceDir)
+	state, err := LoadInstallState(args.StateFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load install state")
+	}
+	if args.DryRun {
+		state.path = ""
+	}
+	if args.Resume {
+		installTask = skipCompleted(installTask, state)
+	}
+	return &preparedInstall{task: installTask, server: serverNode, state: state, inv: inv}, nil
+}
 
-	installers := MakeInstallers(installTask, resourceDir)
+// Copies the kubeconfig from the server into the cluster directory, or a new
+// file k3s-*.yaml in the working directory when cluster is nil. The server
+// must accept ssh connections within bootTimeout. Stops waiting when ctx is
+// cancelled.
+func fetchKubeconfig(ctx context.Context, serverNode *pkg.Node, sshSettings *ssh.Settings, cluster *inventory.Cluster, bootTimeout time.Duration) error {
+	if err := misc.WaitForNode(ctx, serverNode, sshSettings, bootTimeout); err != nil {
+		return err
+	}
 
-	err = runInstall(installers)
+	logging.Infof("Waiting for kubeconfig ...")
+	var fn string
+	var err error
+	if cluster != nil {
+		fn = cluster.KubeconfigPath()
+		err = cluster.Init()
+	} else {
+		fn, err = misc.CreateTempFileName(".", "k3s-*.yaml")
+	}
 	if err != nil {
 		return err
 	}
 
-	if serverNode != nil && !args.DryRun {
-		if err = misc.WaitForNode(serverNode, nil, time.Second*60); err == nil {
+	for i := 0; i < 6; i++ {
+		if err = misc.CopyKubeconfig(ctx, fn, serverNode, sshSettings); err == nil {
+			logging.Infof("Waiting for kubeconfig ... OK, saved to: %s", fn)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			logging.Errorf("Waiting for kubeconfig ... Cancelled")
+			return fmt.Errorf("%v: %v", ctx.Err(), err)
+		case <-time.After(time.Second * 15):
+		}
+	}
+	logging.Errorf("Waiting for kubeconfig ... Failed")
+	return err
+}
 
-			fmt.Printf("Waiting for kubeconfig ... ")
-			fn := misc.CreateTempFileName(".", "k3s-*.yaml")
+// Records the installed nodes and the outcome of the install in the
+// inventory of the cluster.
+func recordInstall(args *InstallArgs, inv *inventory.Inventory, state *InstallState, task *pkg.InstallTask, started time.Time, installErr error) {
+	var token string
+	if task.Server != nil {
+		token = task.Server.GetToken()
+		inv.Server = task.Server.Node.Address
+	} else if len(task.Agents) > 0 {
+		token = task.Agents[0].GetToken()
+		inv.Server = task.Agents[0].ServerIP
+	}
+	if token != "" {
+		inv.Token = token
+	}
+	inv.Versions = inventory.Versions{K3os: K3osVersion, K3pi: args.Version}
 
-			for i := 0; i < 6; i++ {
-				err := misc.CopyKubeconfig(fn, serverNode)
-				if err != nil {
-					time.Sleep(time.Second * 15)
-				} else {
-					fmt.Printf(" OK\n")
-					fmt.Printf(" Saved to: %s\n", fn)
-					break
-				}
-			}
-			if err != nil {
-				fmt.Printf(" Failed\n")
-				return err
-			}
-		} else {
-			return err
+	event := inventory.Event{Time: started, Command: "install"}
+	for _, node := range args.Nodes {
+		event.Nodes = append(event.Nodes, node.Address)
+		if ns := state.Get(node); ns != nil && ns.Completed() {
+			inv.SetNode(node, ns.Role)
 		}
 	}
+	if installErr != nil {
+		event.Error = installErr.Error()
+	}
+	inv.Record(event)
 
-	return nil
+	if err := args.Cluster.Save(inv); err != nil {
+		logging.Errorf("Failed to save the inventory of cluster %s: %v", args.Cluster.Name, err)
+	}
+}
+
+// Removes all nodes that completed their install from the task.
+func skipCompleted(task *pkg.InstallTask, state *InstallState) *pkg.InstallTask {
+	completed := func(target *pkg.Target) bool {
+		if ns := state.Get(target.Node); ns != nil && ns.Completed() {
+			logging.Infof("%s already installed, skipping", target.Node)
+			return true
+		}
+		return false
+	}
+
+	resumed := &pkg.InstallTask{DryRun: task.DryRun, OperatorFactory: task.OperatorFactory}
+	if task.Server != nil && !completed(task.Server) {
+		resumed.Server = task.Server
+	}
+	for _, agent := range task.Agents {
+		if !completed(agent) {
+			resumed.Agents = append(resumed.Agents, agent)
+		}
+	}
+	return resumed
 }
 
 func generateHostname(nodes pkg.Nodes, spec *pkg.HostnameSpec) {
@@ -285,50 +693,120 @@ func generateHostname(nodes pkg.Nodes, spec *pkg.HostnameSpec) {
 type installResult struct {
 	installer pkg.Installer
 	err       error
+	skipped   bool
 }
 
-func runInstall(installers pkg.Installers) error {
-	installChan := make(chan pkg.Installer, 5)
+// Error returned when one or more installers failed or never ran.
+type InstallErrors struct {
+	Failed  map[*pkg.Node]error
+	Skipped pkg.Nodes
+}
+
+func newInstallErrors() *InstallErrors {
+	return &InstallErrors{Failed: make(map[*pkg.Node]error)}
+}
+
+func (e *InstallErrors) empty() bool {
+	return len(e.Failed) == 0 && len(e.Skipped) == 0
+}
+
+func (e *InstallErrors) merge(other *InstallErrors) {
+	for node, err := range other.Failed {
+		e.Failed[node] = err
+	}
+	e.Skipped = append(e.Skipped, other.Skipped...)
+}
+
+func (e *InstallErrors) Error() string {
+	var msgs []string
+	for node, err := range e.Failed {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", node, err))
+	}
+	sort.Strings(msgs)
+	if len(e.Skipped) > 0 {
+		msgs = append(msgs, fmt.Sprintf("skipped: %s", strings.Join(e.Skipped.Info(func(n *pkg.Node) string {
+			return n.String()
+		}), ", ")))
+	}
+	return fmt.Sprintf("install failed on %d node(s), %d skipped: %s", len(e.Failed), len(e.Skipped), strings.Join(msgs, "; "))
+}
+
+// Runs all installers using a pool of parallel workers. With failFast the first
+// failure stops scheduling, the same happens when ctx is cancelled. Installers
+// that never started are reported as skipped. Returns the successfully
+// installed nodes.
+func runInstall(ctx context.Context, installers pkg.Installers, parallel int, failFast bool) (pkg.Nodes, *InstallErrors) {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	// Cancelled on fail fast, stops scheduling but lets running installers finish.
+	scheduleCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	installChan := make(chan pkg.Installer)
 	doneChan := make(chan installResult)
 
-	for i := 0; i < 5; i++ {
-		go func(installChan <-chan pkg.Installer, num int) {
-			//fmt.Printf("\r%s", strings.Repeat(" ", 35))
-			installer := <-installChan
-			fmt.Printf("Installer %d running ...\n", num)
-			err := installer.Install()
-			if err != nil {
-				fmt.Printf("Installer %d running ... Failed\n", num)
-			} else {
-				fmt.Printf("Installer %d running ... OK\n", num)
-			}
-			doneChan <- installResult{
-				installer: installer,
-				err:       err,
+	wg := sync.WaitGroup{}
+	for i := 0; i < parallel && i < len(installers); i++ {
+		wg.Add(1)
+		go func(installChan <-chan pkg.Installer) {
+			defer wg.Done()
+			for installer := range installChan {
+				node := installer.GetTarget().Node
+				log := logging.Default().WithNode(node.Hostname)
+				log.Infof("Installing %s ...", node.Address)
+				err := installer.Install(ctx)
+				if err != nil {
+					log.Errorf("Installing %s ... Failed: %v", node.Address, err)
+				} else {
+					log.Infof("Installing %s ... OK", node.Address)
+				}
+				doneChan <- installResult{installer: installer, err: err}
 			}
-		}(installChan, i)
+		}(installChan)
 	}
 
-	for _, installer := range installers {
-		installChan <- installer
-	}
+	go func() {
+		defer close(installChan)
+		for i, installer := range installers {
+			// select picks at random when both cases are ready, check ctx first
+			if scheduleCtx.Err() == nil {
+				select {
+				case installChan <- installer:
+					continue
+				case <-scheduleCtx.Done():
+				}
+			}
+			for _, skipped := range installers[i:] {
+				doneChan <- installResult{installer: skipped, skipped: true}
+			}
+			return
+		}
+	}()
 
-	var installErrors []error
+	var installed pkg.Nodes
+	installErrors := newInstallErrors()
 	for i := 0; i < len(installers); i++ {
 		result := <-doneChan
-		if result.err != nil {
-			installErrors = append(installErrors, errors.Wrap(result.err, fmt.Sprintf("install failed for installer: %v", result.installer)))
+		node := result.installer.GetTarget().Node
+		if result.skipped {
+			installErrors.Skipped = append(installErrors.Skipped, node)
+		} else if result.err != nil {
+			installErrors.Failed[node] = result.err
+			if failFast {
+				cancel()
+			}
+		} else {
+			installed = append(installed, node)
 		}
 	}
+	wg.Wait()
 
-	if len(installErrors) > 0 {
-		//fmt.Printf("\r%s", strings.Repeat(" ", 35))
-		fmt.Println("Install failed with errors")
-		return fmt.Errorf("install errors: %s", installErrors)
-	} else {
-		fmt.Println("Install OK")
-		return nil
+	if installErrors.empty() {
+		return installed, nil
 	}
+	return installed, installErrors
 }
 
 func SelectServerAndAgents(nodes pkg.Nodes, serverId string) (*pkg.Node, pkg.Nodes, error) {
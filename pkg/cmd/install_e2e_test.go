@@ -0,0 +1,256 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/replay"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh/sshtest"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Starts emulated Pis for nodes, keyed by node address.
+func startPis(t *testing.T, nodes pkg.Nodes) map[string]*sshtest.Server {
+	pis := make(map[string]*sshtest.Server)
+	for i, node := range nodes {
+		pi := sshtest.NewPi(fmt.Sprintf("black-pearl-%d", i))
+		pi.Arch = node.Arch
+		if err := pi.Start(); err != nil {
+			t.Fatal(err)
+		}
+		pis[node.Address] = pi
+	}
+	return pis
+}
+
+// Lists the Pis that booted into k3os as Ready nodes, once the server has.
+func kubectlGetNodes(server *sshtest.Server, pis map[string]*sshtest.Server) sshtest.Handler {
+	return func(command string, stdout, stderr io.Writer) int {
+		if server.Reboots() == 0 {
+			_, _ = fmt.Fprintln(stderr, "sh: k3s: not found")
+			return 127
+		}
+		for _, pi := range pis {
+			if content, _ := pi.File("/etc/os-release"); pi.Reboots() > 0 && parseOSRelease(string(content))["ID"] == "k3os" {
+				_, _ = fmt.Fprintf(stdout, "%s   Ready    <none>   1m   v1.16.2-k3s.1\n", pi.CurrentHostname())
+			}
+		}
+		return 0
+	}
+}
+
+func TestInstall_EndToEnd(t *testing.T) {
+	defer func(interval time.Duration) { readinessPollInterval = interval }(readinessPollInterval)
+	readinessPollInterval = time.Millisecond * 50
+
+	var nodes pkg.Nodes
+	for i := 1; i <= 3; i++ {
+		nodes = append(nodes, &pkg.Node{
+			Hostname: fmt.Sprintf("k3-node%d", i),
+			Address:  fmt.Sprintf("10.0.0.%d", i),
+			Arch:     "aarch64",
+			Auth:     pkg.Auth{Type: "basic-auth", User: "pirate", Password: "hypriot"},
+		})
+	}
+	pis := startPis(t, nodes)
+	for _, pi := range pis {
+		defer pi.Close()
+	}
+	pis["10.0.0.1"].Handle("k3s kubectl get nodes", kubectlGetNodes(pis["10.0.0.1"], pis))
+
+	// The last agent is only reachable on its custom ports.
+	nodes[2].Port = 2222
+	nodes[2].K3osPort = 2200
+	servers := map[string]*sshtest.Server{
+		"10.0.0.1":      pis["10.0.0.1"],
+		"10.0.0.2":      pis["10.0.0.2"],
+		"10.0.0.3:2222": pis["10.0.0.3"],
+		"10.0.0.3:2200": pis["10.0.0.3"],
+	}
+
+	resourceDir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(resourceDir)
+
+	factory := &pkg.CmdOperatorFactory{Create: sshtest.Rewrite(ssh.NewCmdOperator, servers)}
+	agentNodes := nodes[1:]
+	agents := agentNodes.Targets(pkg.SSHKeys{"ssh-rsa AAAA"})
+	agents.SetServerIP("10.0.0.1")
+	task := &pkg.InstallTask{
+		Server:          nodes[0].GetTarget(pkg.SSHKeys{"ssh-rsa AAAA"}),
+		Agents:          agents,
+		OperatorFactory: factory,
+	}
+	if err := ioutil.WriteFile(filepath.Join(resourceDir, task.Server.GetImageFilename()), []byte("k3os image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state, _ := LoadInstallState("")
+	state.Reset(nodes[0], "server")
+	for _, node := range nodes[1:] {
+		state.Reset(node, "agent")
+	}
+
+	if results := RunPreflight(context.Background(), task, resourceDir, factory, state, 2); !results.Passed() {
+		t.Fatalf("pre-flight checks failed: %v", results)
+	}
+
+	probe := &kubectlProbe{
+		server: nodes[0],
+		connect: func(node *pkg.Node) (pkg.CmdOperator, error) {
+			config, _ := ssh.PasswordClientConfig("rancher", "")
+			return factory.Create(&pkg.CmdOperatorCtx{Address: node.K3osSSHAddress(), SSHClientConfig: config})
+		},
+	}
+	args := &InstallArgs{BatchSize: 1, ServerReadyTimeout: time.Second * 10, JoinTimeout: time.Second * 10}
+	stages, err := makeStages(task, resourceDir, args, probe, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runStages(context.Background(), stages, 2, false); err != nil {
+		t.Fatalf("install failed: %v", err)
+	}
+
+	for _, node := range nodes {
+		pi := pis[node.Address]
+		if hostname := pi.CurrentHostname(); hostname != node.Hostname {
+			t.Errorf("expected hostname %s, actual: %s", node.Hostname, hostname)
+		}
+		if reboots := pi.Reboots(); reboots != 1 {
+			t.Errorf("expected %s to reboot once, actual: %d", node, reboots)
+		}
+		if ns := state.Get(node); !ns.Completed() {
+			t.Errorf("expected %s to be completed, actual: %s in %s", node, ns.Status(), ns.Phase)
+		}
+	}
+}
+
+func TestInstall_Replay_HypriotOS(t *testing.T) {
+	defer func(interval time.Duration) { readinessPollInterval = interval }(readinessPollInterval)
+	readinessPollInterval = time.Millisecond * 50
+
+	cassette, err := replay.Load("testdata/install-hypriotos.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	player := replay.NewPlayer(cassette)
+
+	var nodes pkg.Nodes
+	for i := 1; i <= 2; i++ {
+		nodes = append(nodes, &pkg.Node{
+			Hostname: fmt.Sprintf("k3-node%d", i),
+			Address:  fmt.Sprintf("10.0.0.%d", i),
+			Arch:     "aarch64",
+			Auth:     pkg.Auth{Type: "basic-auth", User: "pirate", Password: "hypriot"},
+		})
+	}
+
+	resourceDir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(resourceDir)
+
+	factory := &pkg.CmdOperatorFactory{Create: player.Create}
+	agentNodes := nodes[1:]
+	agents := agentNodes.Targets(pkg.SSHKeys{"ssh-rsa AAAA"})
+	agents.SetServerIP("10.0.0.1")
+	task := &pkg.InstallTask{
+		Server:          nodes[0].GetTarget(pkg.SSHKeys{"ssh-rsa AAAA"}),
+		Agents:          agents,
+		OperatorFactory: factory,
+	}
+	if err := ioutil.WriteFile(filepath.Join(resourceDir, task.Server.GetImageFilename()), []byte("k3os image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state, _ := LoadInstallState("")
+	state.Reset(nodes[0], "server")
+	state.Reset(nodes[1], "agent")
+
+	probe := &kubectlProbe{
+		server: nodes[0],
+		connect: func(node *pkg.Node) (pkg.CmdOperator, error) {
+			config, _ := ssh.PasswordClientConfig("rancher", "")
+			return factory.Create(&pkg.CmdOperatorCtx{Address: node.K3osSSHAddress(), SSHClientConfig: config})
+		},
+	}
+	args := &InstallArgs{BatchSize: 1, ServerReadyTimeout: time.Second * 10, JoinTimeout: time.Second * 10}
+	stages, err := makeStages(task, resourceDir, args, probe, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runStages(context.Background(), stages, 1, false); err != nil {
+		t.Fatalf("install failed: %v", err)
+	}
+
+	for _, node := range nodes {
+		if ns := state.Get(node); !ns.Completed() {
+			t.Errorf("expected %s to be completed, actual: %s in %s", node, ns.Status(), ns.Phase)
+		}
+	}
+	if unused := player.Unused(); len(unused) != 0 {
+		t.Errorf("expected all interactions to be replayed, unused: %v", unused)
+	}
+}
+
+func TestInstall_EndToEnd_Sudo_Fails_Preflight(t *testing.T) {
+	node := &pkg.Node{
+		Hostname: "k3-node1",
+		Address:  "10.0.0.1",
+		Arch:     "armv7l",
+		Auth:     pkg.Auth{Type: "basic-auth", User: "pirate", Password: "hypriot"},
+	}
+	pi := sshtest.NewPi("black-pearl")
+	pi.Sudo = false
+	if err := pi.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pi.Close()
+	pis := map[string]*sshtest.Server{node.Address: pi}
+
+	factory := &pkg.CmdOperatorFactory{Create: sshtest.Rewrite(ssh.NewCmdOperator, pis)}
+	task := &pkg.InstallTask{Server: node.GetTarget(pkg.SSHKeys{}), OperatorFactory: factory}
+	state, _ := LoadInstallState("")
+
+	results := RunPreflight(context.Background(), task, "", factory, state, 2)
+	if results.Passed() {
+		t.Fatal("expected pre-flight checks to fail")
+	}
+	for _, check := range results[0].Checks {
+		if check.Name == CheckSudo && check.Passed {
+			t.Errorf("expected %s check to fail", CheckSudo)
+		}
+	}
+}
@@ -22,12 +22,17 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"github.com/TheNatureOfSoftware/k3pi/pkg"
-	"github.com/TheNatureOfSoftware/k3pi/pkg/misc"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
+	"io/ioutil"
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var nodeYaml = `
@@ -70,22 +75,54 @@ func TestMakeInstaller(t *testing.T) {
 		Agents: agents,
 	}
 
-	resourceDir := MakeResourceDir(task)
+	resourceDir, err := MakeResourceDir(task)
 	defer os.RemoveAll(resourceDir)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	installers := MakeInstallers(task, resourceDir)
+	stages, err := makeStages(task, resourceDir, &InstallArgs{}, &mockProbe{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	want := 4
-	if count := len(installers); count != want {
+	count := 0
+	for _, stage := range stages {
+		count += len(stage.installers)
+	}
+	if count != want {
 		t.Errorf("expected %d installers, got %d", want, count)
 	}
 }
 
+func TestMakeResourceDir_UnsupportedArch(t *testing.T) {
+	task := &pkg.InstallTask{
+		Server: &pkg.Target{Node: &pkg.Node{Address: "192.168.1.10", Arch: "mips"}},
+	}
+
+	resourceDir, err := MakeResourceDir(task)
+
+	if resourceDir != "" {
+		defer os.RemoveAll(resourceDir)
+		t.Errorf("expected no resource dir, got: %s", resourceDir)
+	}
+	if !errors.Is(err, pkg.ErrUnsupportedArch) {
+		t.Errorf("expected ErrUnsupportedArch, got: %v", err)
+	}
+	var nodeErr *pkg.NodeError
+	if !errors.As(err, &nodeErr) || nodeErr.Address != "192.168.1.10" {
+		t.Errorf("expected NodeError for 192.168.1.10, got: %v", err)
+	}
+}
+
 func TestInstaller_Install(t *testing.T) {
 	t.Skip("manual test")
 	node := &pkg.Node{}
 	err := yaml.Unmarshal([]byte(nodeYaml), node)
-	misc.PanicOnError(err, "failed to load node from yaml string")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	node.Address = "192.168.1.128"
 	node.Hostname = "k3pi-1"
@@ -103,12 +140,18 @@ func TestInstaller_Install(t *testing.T) {
 		Agents: pkg.Targets{},
 	}
 
-	resourceDir := MakeResourceDir(task)
+	resourceDir, err := MakeResourceDir(task)
 	defer os.RemoveAll(resourceDir)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	installer := makeInstaller(task, &server, resourceDir, false)
+	installer, err := makeInstaller(task, &server, resourceDir, false, nil, PhaseTimeouts{})
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	_ = installer.Install()
+	_ = installer.Install(context.Background())
 }
 
 func TestSelectServerAndAgents_No_Match(t *testing.T) {
@@ -184,3 +227,205 @@ func TestSelectServerAndAgents_Match_Address(t *testing.T) {
 		t.Errorf("expected %d agents, actual: %d", expectedAgentCount, actual)
 	}
 }
+
+type mockInstaller struct {
+	target  *pkg.Target
+	err     error
+	running *int32
+	maxSeen *int32
+}
+
+func (m *mockInstaller) Install(ctx context.Context) error {
+	n := atomic.AddInt32(m.running, 1)
+	for {
+		max := atomic.LoadInt32(m.maxSeen)
+		if n <= max || atomic.CompareAndSwapInt32(m.maxSeen, max, n) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond * 10)
+	atomic.AddInt32(m.running, -1)
+	return m.err
+}
+
+func (m *mockInstaller) GetTarget() *pkg.Target {
+	return m.target
+}
+
+func mockInstallers(count int, failing map[int]bool) (pkg.Installers, *int32) {
+	var running, maxSeen int32
+	var installers pkg.Installers
+	for i := 0; i < count; i++ {
+		var err error
+		if failing[i] {
+			err = fmt.Errorf("installer %d failed", i)
+		}
+		installers = append(installers, &mockInstaller{
+			target:  &pkg.Target{Node: &pkg.Node{Hostname: fmt.Sprintf("node%d", i), Address: fmt.Sprintf("10.0.0.%d", i)}},
+			err:     err,
+			running: &running,
+			maxSeen: &maxSeen,
+		})
+	}
+	return installers, &maxSeen
+}
+
+func TestRunInstall_More_Nodes_Than_Workers(t *testing.T) {
+	installers, maxSeen := mockInstallers(12, nil)
+
+	installed, installErrors := runInstall(context.Background(), installers, 3, false)
+	if installErrors != nil {
+		t.Errorf("unexpected error: %v", installErrors)
+	}
+
+	if actual := len(installed); actual != 12 {
+		t.Errorf("expected 12 installed nodes, actual: %d", actual)
+	}
+
+	if max := atomic.LoadInt32(maxSeen); max > 3 {
+		t.Errorf("expected at most 3 parallel installers, got %d", max)
+	}
+}
+
+func TestRunInstall_Continue_On_Error(t *testing.T) {
+	installers, _ := mockInstallers(6, map[int]bool{1: true, 4: true})
+
+	installed, installErrors := runInstall(context.Background(), installers, 2, false)
+	if installErrors == nil {
+		t.Fatal("expected install errors")
+	}
+
+	if actual := len(installed); actual != 4 {
+		t.Errorf("expected 4 installed nodes, actual: %d", actual)
+	}
+
+	if actual := len(installErrors.Failed); actual != 2 {
+		t.Errorf("expected 2 failed nodes, actual: %d", actual)
+	}
+
+	if actual := len(installErrors.Skipped); actual != 0 {
+		t.Errorf("expected 0 skipped nodes, actual: %d", actual)
+	}
+}
+
+func TestRunInstall_Fail_Fast(t *testing.T) {
+	installers, _ := mockInstallers(6, map[int]bool{0: true})
+
+	_, installErrors := runInstall(context.Background(), installers, 1, true)
+	if installErrors == nil {
+		t.Fatal("expected install errors")
+	}
+
+	if actual := len(installErrors.Failed); actual != 1 {
+		t.Errorf("expected 1 failed node, actual: %d", actual)
+	}
+
+	if actual := len(installErrors.Skipped); actual == 0 {
+		t.Errorf("expected skipped nodes")
+	}
+}
+
+func TestRunInstall_Cancelled(t *testing.T) {
+	installers, _ := mockInstallers(4, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, installErrors := runInstall(ctx, installers, 2, false)
+	if installErrors == nil {
+		t.Fatal("expected install errors")
+	}
+
+	if actual := len(installErrors.Skipped); actual != 4 {
+		t.Errorf("expected 4 skipped nodes, actual: %d", actual)
+	}
+}
+
+type blockingInstaller struct {
+	target  *pkg.Target
+	started chan struct{}
+}
+
+func (b *blockingInstaller) Install(ctx context.Context) error {
+	b.started <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (b *blockingInstaller) GetTarget() *pkg.Target {
+	return b.target
+}
+
+func TestRunInstall_Cancel_Aborts_Running(t *testing.T) {
+	started := make(chan struct{}, 2)
+	installers := pkg.Installers{
+		&blockingInstaller{target: &pkg.Target{Node: &pkg.Node{Address: "10.0.0.1"}}, started: started},
+		&blockingInstaller{target: &pkg.Target{Node: &pkg.Node{Address: "10.0.0.2"}}, started: started},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		<-started
+		cancel()
+	}()
+
+	_, installErrors := runInstall(ctx, installers, 2, false)
+	if installErrors == nil {
+		t.Fatal("expected install errors")
+	}
+
+	if actual := len(installErrors.Failed); actual != 2 {
+		t.Errorf("expected 2 failed nodes, actual: %d", actual)
+	}
+	for node, err := range installErrors.Failed {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected %s to be cancelled, got: %v", node, err)
+		}
+	}
+}
+
+func TestPhaseTimeouts_WithDefaults(t *testing.T) {
+	timeouts := PhaseTimeouts{Extract: time.Second}.withDefaults()
+
+	expected := PhaseTimeouts{Upload: DefaultUploadTimeout, Extract: time.Second, Reboot: DefaultRebootTimeout, Boot: DefaultBootTimeout}
+	if timeouts != expected {
+		t.Errorf("expected %v, actual: %v", expected, timeouts)
+	}
+}
+
+func TestRecordInstall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cluster, _ := inventory.Open(dir, "pearl")
+
+	server := &pkg.Node{Address: "10.0.0.1", Hostname: "k3s-server"}
+	agent := &pkg.Node{Address: "10.0.0.2", Hostname: "k3s-agent"}
+	state, _ := LoadInstallState("")
+	state.Reset(server, "server")
+	state.Reset(agent, "agent")
+	state.Record(server, pkg.PhaseJoined, time.Now(), nil)
+	state.Record(agent, pkg.PhaseUploaded, time.Now(), fmt.Errorf("disk full"))
+
+	task := &pkg.InstallTask{
+		Server: &pkg.Target{Node: server, Token: "secret"},
+		Agents: pkg.Targets{{Node: agent, Token: "secret", ServerIP: server.Address}},
+	}
+	args := &InstallArgs{Nodes: pkg.Nodes{server, agent}, Cluster: cluster, Version: "v1.0.0"}
+	recordInstall(args, &inventory.Inventory{Name: cluster.Name}, state, task, time.Now(), fmt.Errorf("install failed"))
+
+	inv, err := cluster.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.Token != "secret" || inv.Server != server.Address || inv.Versions.K3os != K3osVersion || inv.Versions.K3pi != "v1.0.0" {
+		t.Errorf("unexpected inventory %+v", inv)
+	}
+	if len(inv.Nodes) != 1 || inv.Nodes[0].Role != "server" {
+		t.Errorf("expected only the installed server, got %v", inv.Nodes)
+	}
+	if len(inv.History) != 1 || inv.History[0].Error != "install failed" || len(inv.History[0].Nodes) != 2 {
+		t.Errorf("unexpected history %+v", inv.History)
+	}
+}
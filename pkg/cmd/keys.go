@@ -0,0 +1,221 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/config"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/logging"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/misc"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"os"
+	"strings"
+)
+
+const (
+	// The k3os config written by the installer, k3os mounts it read-only.
+	k3osSystemConfigPath = "/k3os/system/config.yaml"
+	// The k3os config written at runtime, it overrides the system config.
+	k3osConfigDir  = "/var/lib/rancher/k3os"
+	k3osConfigPath = k3osConfigDir + "/config.yaml"
+)
+
+// Creates the keypair the rancher user of cluster logs in with, an existing
+// key is only replaced when force is set. Returns the public key.
+func GenerateClusterKey(cluster *inventory.Cluster, force bool) (string, error) {
+	if _, err := os.Stat(cluster.KeyPath()); err == nil && !force {
+		return "", fmt.Errorf("cluster %s already has the key %s, use keys rotate to replace it on the nodes", cluster.Name, cluster.KeyPath())
+	}
+	return ssh.GenerateKey(cluster.KeyPath(), "k3pi@"+cluster.Name)
+}
+
+// Returns the public key of cluster, the keypair is generated if there is
+// none. created is true if the key was generated.
+func EnsureClusterKey(cluster *inventory.Cluster) (publicKey string, created bool, err error) {
+	publicKey, err = ssh.ReadAuthorizedKey(cluster.KeyPath())
+	if os.IsNotExist(err) {
+		publicKey, err = GenerateClusterKey(cluster, false)
+		return publicKey, err == nil, err
+	}
+	return publicKey, false, err
+}
+
+type RotateArgs struct {
+	Nodes   pkg.Nodes
+	Cluster *inventory.Cluster
+	// Creates the operators that connect to the nodes, ssh when nil.
+	OperatorFactory *pkg.CmdOperatorFactory
+}
+
+// Moves the rancher user of all nodes to a new cluster key. The new key is
+// added to the authorized keys and verified by logging in with it before it
+// replaces the old key in the k3os config and the authorized keys. The new
+// key becomes the cluster key once all nodes are rotated, until then both
+// keys are kept and a rerun continues the rotation.
+func RotateKeys(ctx context.Context, args *RotateArgs) error {
+	cluster := args.Cluster
+	oldKey, err := ssh.ReadAuthorizedKey(cluster.KeyPath())
+	if err != nil {
+		return fmt.Errorf("no key for cluster %s, use keys generate: %w", cluster.Name, err)
+	}
+	newKey, err := ssh.ReadAuthorizedKey(cluster.PendingKeyPath())
+	if os.IsNotExist(err) {
+		newKey, err = ssh.GenerateKey(cluster.PendingKeyPath(), "k3pi@"+cluster.Name)
+	}
+	if err != nil {
+		return err
+	}
+	cmdOperatorFactory := args.OperatorFactory
+	if cmdOperatorFactory == nil {
+		cmdOperatorFactory = &pkg.CmdOperatorFactory{Create: ssh.NewCmdOperator}
+	}
+
+	var failed []string
+	for _, node := range args.Nodes {
+		if ctx.Err() != nil {
+			failed = append(failed, node.String())
+			continue
+		}
+		log := logging.Default().WithNode(node.Hostname)
+		log.Infof("Rotating ssh key ...")
+		if err := rotateNode(ctx, node, cluster, oldKey, newKey, cmdOperatorFactory); err != nil {
+			log.Errorf("Rotating ssh key ... Failed: %v", err)
+			failed = append(failed, node.String())
+			continue
+		}
+		log.Infof("Rotating ssh key ... OK")
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("key rotation failed on %s, both keys are kept until a rerun completes the rotation", strings.Join(failed, ", "))
+	}
+
+	for _, suffix := range []string{"", ".pub"} {
+		if err := os.Rename(cluster.PendingKeyPath()+suffix, cluster.KeyPath()+suffix); err != nil {
+			return err
+		}
+	}
+	logging.Infof("Rotated the key of cluster %s, the new key is %s", cluster.Name, cluster.KeyPath())
+	return nil
+}
+
+func rotateNode(ctx context.Context, node *pkg.Node, cluster *inventory.Cluster, oldKey, newKey string, cmdOperatorFactory *pkg.CmdOperatorFactory) error {
+	operator, err := connectRancher(node, cmdOperatorFactory, cluster.KeyPaths()...)
+	if err != nil {
+		return err
+	}
+	defer operator.Close()
+
+	if err = replaceAuthorizedKey(ctx, operator, "", newKey); err != nil {
+		return err
+	}
+
+	verify, err := connectK3os(node, &ssh.Settings{User: "rancher", KeyPaths: []string{cluster.PendingKeyPath()}, IdentitiesOnly: true}, cmdOperatorFactory)
+	if err != nil {
+		return fmt.Errorf("login with the new key failed: %w", err)
+	}
+	_ = verify.Close()
+
+	current, err := readK3osConfig(ctx, operator)
+	if err != nil {
+		return err
+	}
+	content, err := config.ReplaceAuthorizedKey(current, oldKey, newKey)
+	if err != nil {
+		return err
+	}
+	if err = operator.Copy(ctx, bytes.NewReader(content), "~/k3pi-config.yaml", int64(len(content)), 0600); err != nil {
+		return err
+	}
+	command := fmt.Sprintf("sudo mkdir -p %s && sudo cp k3pi-config.yaml %s", k3osConfigDir, k3osConfigPath)
+	if result, err := operator.ExecuteContext(ctx, command); err != nil {
+		return fmt.Errorf("failed to update the k3os config, %v", result)
+	}
+
+	return replaceAuthorizedKey(ctx, operator, oldKey, "")
+}
+
+// Returns the k3os config of a node, the config written at runtime overrides
+// the one written by the installer.
+func readK3osConfig(ctx context.Context, operator pkg.CmdOperator) ([]byte, error) {
+	var result *pkg.Result
+	var err error
+	for _, path := range []string{k3osConfigPath, k3osSystemConfigPath} {
+		if result, err = operator.ExecuteContext(ctx, "sudo cat "+path); err == nil {
+			return result.StdOut, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to read the k3os config, %v", result)
+}
+
+// Connects as the rancher user trying keyPaths first.
+func connectRancher(node *pkg.Node, cmdOperatorFactory *pkg.CmdOperatorFactory, keyPaths ...string) (pkg.CmdOperator, error) {
+	return connectK3os(node, misc.RancherSSHSettings(keyPaths...), cmdOperatorFactory)
+}
+
+// Connects to the k3os ssh port of node with sshSettings.
+func connectK3os(node *pkg.Node, sshSettings *ssh.Settings, cmdOperatorFactory *pkg.CmdOperatorFactory) (pkg.CmdOperator, error) {
+	sshConfig, closeSSHAgent, err := ssh.NewClientConfig(sshSettings)
+	if err != nil {
+		return nil, err
+	}
+	defer closeSSHAgent()
+
+	return cmdOperatorFactory.Create(&pkg.CmdOperatorCtx{
+		Address:         node.K3osSSHAddress(),
+		SSHClientConfig: sshConfig,
+		EnableStdOut:    false,
+		JumpHost:        node.JumpHost,
+	})
+}
+
+// Rewrites ~/.ssh/authorized_keys without remove and with add, the file is
+// replaced in one move so a failed copy never locks the user out.
+func replaceAuthorizedKey(ctx context.Context, operator pkg.CmdOperator, remove, add string) error {
+	result, err := operator.ExecuteContext(ctx, "cat ~/.ssh/authorized_keys")
+	if err != nil {
+		return fmt.Errorf("failed to read authorized keys, %v", result)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(result.StdOut), "\n") {
+		if line == "" || config.SameAuthorizedKey(line, remove) || config.SameAuthorizedKey(line, add) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if add != "" {
+		lines = append(lines, add)
+	}
+	content := []byte(strings.Join(lines, "\n") + "\n")
+
+	if err = operator.Copy(ctx, bytes.NewReader(content), "~/.ssh/authorized_keys.k3pi", int64(len(content)), 0600); err != nil {
+		return err
+	}
+	if result, err = operator.ExecuteContext(ctx, "mv -f ~/.ssh/authorized_keys.k3pi ~/.ssh/authorized_keys"); err != nil {
+		return fmt.Errorf("failed to update authorized keys, %v", result)
+	}
+	return nil
+}
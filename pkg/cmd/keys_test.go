@@ -0,0 +1,142 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh/sshtest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testCluster(t *testing.T) *inventory.Cluster {
+	dir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := inventory.Open(dir, "pearl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cluster
+}
+
+// Returns a cluster with a generated key and a cleanup removing it. The ssh
+// agent is unset until the cleanup so only the cluster key is offered.
+func testClusterWithKey(t *testing.T) (*inventory.Cluster, string, func()) {
+	cluster := testCluster(t)
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	_ = os.Unsetenv("SSH_AUTH_SOCK")
+	cleanup := func() {
+		_ = os.Setenv("SSH_AUTH_SOCK", socket)
+		_ = os.RemoveAll(filepath.Dir(cluster.Dir))
+	}
+	clusterKey, err := GenerateClusterKey(cluster, false)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return cluster, clusterKey, cleanup
+}
+
+// Starts a Pi running k3os that authorizes the keys in its authorized_keys.
+func startK3osPi(t *testing.T, authorizedKeys ...string) *sshtest.Server {
+	pi := sshtest.NewPi("k3-node1")
+	pi.AuthorizedKeysFile = true
+	pi.SetFile("/etc/os-release", []byte("PRETTY_NAME=\"k3OS v0.3.0\"\nID=k3os\n"))
+	pi.SetFile("~/.ssh/authorized_keys", []byte(strings.Join(authorizedKeys, "\n")+"\n"))
+	pi.SetFile(sshtest.K3osConfigFile, []byte("hostname: k3-node1\nssh_authorized_keys:\n- \""+strings.Join(authorizedKeys, "\"\n- \"")+"\"\n"))
+	if err := pi.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return pi
+}
+
+func TestGenerateClusterKey(t *testing.T) {
+	cluster := testCluster(t)
+	defer os.RemoveAll(cluster.Dir)
+
+	publicKey, err := GenerateClusterKey(cluster, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(publicKey, "ssh-ed25519 ") {
+		t.Errorf("expected an ed25519 key, actual: %s", publicKey)
+	}
+
+	if _, err = GenerateClusterKey(cluster, false); err == nil {
+		t.Error("expected an existing key not to be replaced")
+	}
+	if _, created, _ := EnsureClusterKey(cluster); created {
+		t.Error("expected the existing key to be used")
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	cluster, oldKey, cleanup := testClusterWithKey(t)
+	defer cleanup()
+
+	pi := startK3osPi(t, "ssh-rsa AAAAB3NzaC1yc2EAAAADAQAB me@laptop", oldKey)
+	defer pi.Close()
+	pi.Sudo = false
+	node := &pkg.Node{Hostname: "k3-node1", Address: "10.0.0.1"}
+	args := &RotateArgs{
+		Nodes:           pkg.Nodes{node},
+		Cluster:         cluster,
+		OperatorFactory: &pkg.CmdOperatorFactory{Create: sshtest.Rewrite(ssh.NewCmdOperator, map[string]*sshtest.Server{"10.0.0.1": pi})},
+	}
+
+	if err := RotateKeys(context.Background(), args); err == nil {
+		t.Fatal("expected the rotation to fail without sudo")
+	}
+	if _, err := os.Stat(cluster.PendingKeyPath()); err != nil {
+		t.Errorf("expected the new key to be kept: %v", err)
+	}
+
+	pi.Sudo = true
+	if err := RotateKeys(context.Background(), args); err != nil {
+		t.Fatal(err)
+	}
+
+	newKey, _ := ssh.ReadAuthorizedKey(cluster.KeyPath())
+	if newKey == oldKey {
+		t.Fatal("expected a new cluster key")
+	}
+	if _, err := os.Stat(cluster.PendingKeyPath()); !os.IsNotExist(err) {
+		t.Errorf("expected the pending key to be moved: %v", err)
+	}
+	for _, path := range []string{"~/.ssh/authorized_keys", sshtest.K3osRuntimeConfigFile} {
+		content, _ := pi.File(path)
+		if strings.Contains(string(content), oldKey) || !strings.Contains(string(content), newKey) || !strings.Contains(string(content), "me@laptop") {
+			t.Errorf("expected only the new cluster key and the other keys in %s: %s", path, content)
+		}
+	}
+	if content, _ := pi.File(sshtest.K3osConfigFile); !strings.Contains(string(content), oldKey) {
+		t.Errorf("expected the read-only system config to be kept: %s", content)
+	}
+}
@@ -0,0 +1,451 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/config"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"github.com/kubernetes-sigs/yaml"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	PlanFormatText = "text"
+	PlanFormatJSON = "json"
+)
+
+// The steps a dry run would have executed on each node, in install order.
+type Plan struct {
+	Nodes []NodePlan `json:"nodes"`
+}
+
+type NodePlan struct {
+	Role     string     `json:"role"`
+	Hostname string     `json:"hostname"`
+	Address  string     `json:"address"`
+	Steps    []ssh.Step `json:"steps"`
+}
+
+// Creates the plan of task from the steps recorded by the dry run operators.
+func NewPlan(task *pkg.InstallTask, recorder *ssh.Recorder) *Plan {
+	plan := &Plan{}
+	add := func(target *pkg.Target, role string) {
+		plan.Nodes = append(plan.Nodes, NodePlan{
+			Role:     role,
+			Hostname: target.Node.Hostname,
+			Address:  target.Node.Address,
+			Steps:    recorder.Steps(target.Node.SSHAddress()),
+		})
+	}
+	if task.Server != nil {
+		add(task.Server, "server")
+	}
+	for _, agent := range task.Agents {
+		add(agent, "agent")
+	}
+	return plan
+}
+
+// Writes the plan in format, text or json.
+func (p *Plan) Write(out io.Writer, format string) error {
+	switch format {
+	case "", PlanFormatText:
+		return p.WriteText(out)
+	case PlanFormatJSON:
+		return p.WriteJSON(out)
+	default:
+		return fmt.Errorf("unknown plan format: %s", format)
+	}
+}
+
+func (p *Plan) WriteJSON(out io.Writer) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(p)
+}
+
+// Writes the numbered steps of each node.
+func (p *Plan) WriteText(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "Dry run, nothing was changed. Execution plan:")
+	for _, node := range p.Nodes {
+		_, _ = fmt.Fprintf(w, "\n%s (%s) %s\n", node.Hostname, node.Address, node.Role)
+		for i, step := range node.Steps {
+			switch step.Kind {
+			case ssh.StepCopy:
+				_, _ = fmt.Fprintf(w, "  %d.\t%s\t%s (%d bytes)\n", i+1, step.Kind, step.Destination, step.Size)
+			default:
+				_, _ = fmt.Fprintf(w, "  %d.\t%s\t%s\n", i+1, step.Kind, step.Command)
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// Version of the saved install plan format.
+const installPlanVersion = 1
+
+const (
+	// The OS of the node is overwritten with k3os.
+	ActionInstall = "install"
+	// The node is left as it is.
+	ActionUntouched = "untouched"
+)
+
+// What an install does to each node, shown before the install is confirmed.
+// A saved plan is executed exactly as saved: same nodes, hostnames, server,
+// token and k3os configs.
+type InstallPlan struct {
+	Version     int       `json:"version"`
+	Created     time.Time `json:"created"`
+	Cluster     string    `json:"cluster,omitempty"`
+	K3osVersion string    `json:"k3os_version"`
+	// Address of the server, or the server the agents join.
+	Server  string             `json:"server"`
+	Token   string             `json:"token,omitempty"`
+	SSHKeys []string           `json:"ssh_keys"`
+	Nodes   []*NodeInstallPlan `json:"nodes"`
+}
+
+type NodeInstallPlan struct {
+	Action string `json:"action"`
+	Role   string `json:"role,omitempty"`
+	// The node with its new hostname.
+	Node   *pkg.Node `json:"node"`
+	Reason string    `json:"reason,omitempty"`
+	// Image written to the node.
+	Image string `json:"image,omitempty"`
+	// The k3os config the node is installed with.
+	Config string `json:"config,omitempty"`
+	// State of the node when the plan was made, the config is only read from
+	// nodes running k3os.
+	CurrentHostname string `json:"current_hostname,omitempty"`
+	CurrentOS       string `json:"current_os,omitempty"`
+	CurrentConfig   string `json:"current_config,omitempty"`
+	// Why the current state could not be read.
+	Error string `json:"error,omitempty"`
+}
+
+// Plans the install of args without changing any node.
+func PlanInstall(ctx context.Context, args *InstallArgs) (*InstallPlan, error) {
+	prepared, err := prepareInstall(args)
+	if err != nil {
+		return nil, err
+	}
+	return newInstallPlan(ctx, args, prepared, operatorFactory(args.OperatorFactory))
+}
+
+// Creates the plan of the prepared install and reads the current state of
+// the nodes to install.
+func newInstallPlan(ctx context.Context, args *InstallArgs, prepared *preparedInstall, cmdOperatorFactory *pkg.CmdOperatorFactory) (*InstallPlan, error) {
+	plan := &InstallPlan{
+		Version:     installPlanVersion,
+		Created:     time.Now().UTC(),
+		K3osVersion: K3osVersion,
+		Server:      args.ServerID,
+		Token:       args.Token,
+		SSHKeys:     args.SSHKeys,
+	}
+	if args.Cluster != nil {
+		plan.Cluster = args.Cluster.Name
+	}
+	if plan.Token == "" {
+		plan.Token = prepared.inv.Token
+	}
+	if prepared.server != nil {
+		plan.Server = prepared.server.Address
+	}
+
+	var targets []*pkg.Target
+	var roles []string
+	if prepared.task.Server != nil {
+		targets, roles = append(targets, prepared.task.Server), append(roles, "server")
+	}
+	for _, agent := range prepared.task.Agents {
+		targets, roles = append(targets, agent), append(roles, "agent")
+	}
+
+	planned := make(map[string]bool)
+	for i, target := range targets {
+		content, err := targetConfig(target, roles[i] == "server")
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("failed to create config for %s", target.Node))
+		}
+		plan.Nodes = append(plan.Nodes, &NodeInstallPlan{
+			Action: ActionInstall,
+			Role:   roles[i],
+			Node:   planNode(target.Node),
+			Image:  target.GetImageFilename(),
+			Config: string(*content),
+		})
+		planned[target.Node.Address] = true
+	}
+
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(np *NodeInstallPlan, node *pkg.Node) {
+			defer wg.Done()
+			current, err := probeNode(ctx, node, args.RancherKeyPaths, cmdOperatorFactory)
+			if err != nil {
+				np.Error = err.Error()
+				return
+			}
+			np.CurrentHostname, np.CurrentOS, np.CurrentConfig = current.hostname, current.os, current.config
+		}(plan.Nodes[i], target.Node)
+	}
+	wg.Wait()
+
+	inFile := make(map[string]bool)
+	for _, node := range args.Nodes {
+		inFile[node.Address] = true
+		if !planned[node.Address] {
+			plan.Nodes = append(plan.Nodes, &NodeInstallPlan{Action: ActionUntouched, Node: planNode(node), Reason: "already installed"})
+		}
+	}
+	for _, n := range prepared.inv.Nodes {
+		if !inFile[n.Address] {
+			node := n.Node
+			plan.Nodes = append(plan.Nodes, &NodeInstallPlan{Action: ActionUntouched, Role: n.Role, Node: &node, Reason: "in the cluster, not in the nodes to install"})
+		}
+	}
+	return plan, nil
+}
+
+// Returns a copy of node without a password resolved from a reference.
+func planNode(node *pkg.Node) *pkg.Node {
+	copied := *node
+	if copied.Auth.HasPasswordRef() {
+		copied.Auth.Password = ""
+	}
+	return &copied
+}
+
+// Returns the nodes the plan installs, the nodes share no memory with the
+// plan.
+func (p *InstallPlan) InstallNodes() pkg.Nodes {
+	var nodes pkg.Nodes
+	for _, np := range p.Nodes {
+		if np.Action == ActionInstall {
+			node := *np.Node
+			nodes = append(nodes, &node)
+		}
+	}
+	return nodes
+}
+
+// Replaces what the plan decided in args.
+func (p *InstallPlan) configure(args *InstallArgs) error {
+	if p.Version != installPlanVersion {
+		return fmt.Errorf("unsupported plan version %d, expected %d", p.Version, installPlanVersion)
+	}
+	if p.K3osVersion != K3osVersion {
+		return fmt.Errorf("the plan installs k3os %s, this release installs %s", p.K3osVersion, K3osVersion)
+	}
+	if args.Cluster != nil && p.Cluster != "" && p.Cluster != args.Cluster.Name {
+		return fmt.Errorf("the plan is for cluster %s, not %s", p.Cluster, args.Cluster.Name)
+	}
+	if len(args.Nodes) == 0 {
+		args.Nodes = p.InstallNodes()
+	}
+	args.ServerID = p.Server
+	args.Token = p.Token
+	args.SSHKeys = p.SSHKeys
+	args.HostnameSpec = nil
+	args.ConfigOverrides = nil
+	args.Resume = false
+	return nil
+}
+
+// Sets the planned config of each target.
+func (p *InstallPlan) setConfigs(task *pkg.InstallTask) {
+	configs := make(map[string]string)
+	for _, np := range p.Nodes {
+		configs[np.Node.Address] = np.Config
+	}
+	targets := append(pkg.Targets{}, task.Agents...)
+	if task.Server != nil {
+		targets = append(targets, task.Server)
+	}
+	for _, target := range targets {
+		target.Config = []byte(configs[target.Node.Address])
+	}
+}
+
+// Reads the current state of the nodes to install again, the plan is stale
+// if a node changed since the plan was made.
+func (p *InstallPlan) verify(ctx context.Context, task *pkg.InstallTask, keyPaths []string, cmdOperatorFactory *pkg.CmdOperatorFactory) error {
+	targets := make(map[string]*pkg.Target)
+	for _, agent := range task.Agents {
+		targets[agent.Node.Address] = agent
+	}
+	if task.Server != nil {
+		targets[task.Server.Node.Address] = task.Server
+	}
+
+	var changed []string
+	for _, np := range p.Nodes {
+		if np.Action != ActionInstall {
+			continue
+		}
+		target, ok := targets[np.Node.Address]
+		if !ok {
+			return fmt.Errorf("%s is missing from the install", np.Node)
+		}
+		current, err := probeNode(ctx, target.Node, keyPaths, cmdOperatorFactory)
+		if err != nil {
+			if np.Error == "" {
+				changed = append(changed, fmt.Sprintf("%s is unreachable: %v", np.Node, err))
+			}
+			continue
+		}
+		if current.hostname != np.CurrentHostname || current.os != np.CurrentOS || current.config != np.CurrentConfig {
+			changed = append(changed, fmt.Sprintf("%s changed", np.Node))
+		}
+	}
+	if len(changed) > 0 {
+		return fmt.Errorf("the plan is stale, %s since it was made", strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// Writes the plan as YAML, readable by the owner only since it holds the
+// token.
+func (p *InstallPlan) Save(path string) error {
+	b, err := yaml.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+func LoadInstallPlan(path string) (*InstallPlan, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plan := &InstallPlan{}
+	if err = yaml.Unmarshal(b, plan); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return plan, nil
+}
+
+// Writes the plan in format, text or json.
+func (p *InstallPlan) Write(out io.Writer, format string) error {
+	switch format {
+	case "", PlanFormatText:
+		return p.WriteText(out)
+	case PlanFormatJSON:
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(p)
+	default:
+		return fmt.Errorf("unknown plan format: %s", format)
+	}
+}
+
+// Writes what happens to each node, with the config diff of nodes already
+// running k3os.
+func (p *InstallPlan) WriteText(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(w, "Install plan, k3os %s, server %s\n", p.K3osVersion, p.Server)
+	for _, np := range p.Nodes {
+		_, _ = fmt.Fprintf(w, "\n%s (%s) %s\n", np.Node.Hostname, np.Node.Address, np.Role)
+		if np.Action == ActionUntouched {
+			_, _ = fmt.Fprintf(w, "  untouched, %s\n", np.Reason)
+			continue
+		}
+		if np.Error != "" {
+			_, _ = fmt.Fprintf(w, "  current state unknown:\t%s\n", np.Error)
+			_, _ = fmt.Fprintf(w, "  os:\toverwritten with k3os %s (%s)\n", p.K3osVersion, np.Image)
+			_, _ = fmt.Fprintf(w, "  hostname:\t%s\n", np.Node.Hostname)
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "  os:\t%s, overwritten with k3os %s (%s)\n", np.CurrentOS, p.K3osVersion, np.Image)
+		if np.CurrentHostname == np.Node.Hostname {
+			_, _ = fmt.Fprintf(w, "  hostname:\t%s, unchanged\n", np.Node.Hostname)
+		} else {
+			_, _ = fmt.Fprintf(w, "  hostname:\t%s -> %s\n", np.CurrentHostname, np.Node.Hostname)
+		}
+		switch diff := config.Diff(np.CurrentConfig, np.Config); {
+		case np.CurrentConfig == "":
+			_, _ = fmt.Fprintln(w, "  config:\tnew")
+		case diff == "":
+			_, _ = fmt.Fprintln(w, "  config:\tunchanged")
+		default:
+			_, _ = fmt.Fprintln(w, "  config:\tchanged")
+			for _, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+				_, _ = fmt.Fprintf(w, "    %s\n", line)
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// The state of a node read by probeNode.
+type nodeProbe struct {
+	hostname, os, config string
+}
+
+// Reads the hostname, OS and, on k3os, the k3os config of node. The node is
+// reached with its own credentials or, once it runs k3os, as the rancher
+// user.
+func probeNode(ctx context.Context, node *pkg.Node, keyPaths []string, cmdOperatorFactory *pkg.CmdOperatorFactory) (*nodeProbe, error) {
+	operator, err := connect(node, cmdOperatorFactory)
+	if err != nil {
+		var rancherErr error
+		if operator, rancherErr = connectRancher(node, cmdOperatorFactory, keyPaths...); rancherErr != nil {
+			return nil, err
+		}
+	}
+	defer operator.Close()
+
+	result, err := operator.ExecuteContext(ctx, "hostname")
+	if err != nil {
+		return nil, fmt.Errorf("hostname failed: %w", err)
+	}
+	probe := &nodeProbe{hostname: strings.TrimSpace(string(result.StdOut))}
+
+	if result, err = operator.ExecuteContext(ctx, "cat /etc/os-release"); err != nil {
+		return nil, fmt.Errorf("failed to read /etc/os-release: %w", err)
+	}
+	osRelease := parseOSRelease(string(result.StdOut))
+	probe.os = osRelease["PRETTY_NAME"]
+
+	if osRelease["ID"] == "k3os" {
+		if content, err := readK3osConfig(ctx, operator); err == nil {
+			probe.config = string(content)
+		}
+	}
+	return probe, nil
+}
@@ -0,0 +1,216 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh/sshtest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInstaller_Install_DryRun_Plan(t *testing.T) {
+	resourceDir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(resourceDir)
+
+	node := &pkg.Node{
+		Hostname: "k3-node1",
+		Address:  "10.0.0.1",
+		Arch:     "aarch64",
+		Auth:     pkg.Auth{Type: "basic-auth", User: "pirate", Password: "hypriot"},
+	}
+	target := &pkg.Target{Node: node}
+	if err := ioutil.WriteFile(filepath.Join(resourceDir, target.GetImageFilename()), []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := ssh.NewRecorder()
+	task := &pkg.InstallTask{
+		DryRun:          true,
+		Server:          target,
+		OperatorFactory: &pkg.CmdOperatorFactory{Create: recorder.Create},
+	}
+	state, _ := LoadInstallState("")
+	ins, err := makeInstaller(task, target, resourceDir, true, state, PhaseTimeouts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ins.Install(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	plan := NewPlan(task, recorder)
+	if len(plan.Nodes) != 1 || plan.Nodes[0].Role != "server" {
+		t.Fatalf("expected a plan for the server, actual: %v", plan.Nodes)
+	}
+	var kinds []ssh.StepKind
+	for _, step := range plan.Nodes[0].Steps {
+		kinds = append(kinds, step.Kind)
+	}
+	expected := []ssh.StepKind{ssh.StepCopy, ssh.StepCopy, ssh.StepCommand, ssh.StepCommand, ssh.StepCommand, ssh.StepReboot}
+	if !reflect.DeepEqual(expected, kinds) {
+		t.Errorf("expected %v, actual: %v", expected, kinds)
+	}
+	if step := plan.Nodes[0].Steps[0]; step.Destination != "~/k3os-rootfs-arm64.tar.gz" || step.Size != 5 {
+		t.Errorf("unexpected image copy: %v", step)
+	}
+}
+
+func TestPlan_Write(t *testing.T) {
+	plan := &Plan{Nodes: []NodePlan{{
+		Role:     "agent",
+		Hostname: "k3-node2",
+		Address:  "10.0.0.2",
+		Steps: []ssh.Step{
+			{Kind: ssh.StepCopy, Destination: "~/config.yaml", Size: 42},
+			{Kind: ssh.StepReboot, Command: "sudo sync && sudo reboot -f"},
+		},
+	}}}
+
+	out := &bytes.Buffer{}
+	if err := plan.Write(out, PlanFormatText); err != nil {
+		t.Fatal(err)
+	}
+	text := out.String()
+	for _, expected := range []string{"k3-node2 (10.0.0.2) agent", "~/config.yaml (42 bytes)", "2.  reboot  sudo sync && sudo reboot -f"} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("expected %q in:\n%s", expected, text)
+		}
+	}
+
+	out.Reset()
+	if err := plan.Write(out, PlanFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	decoded := &Plan{}
+	if err := json.Unmarshal(out.Bytes(), decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plan, decoded) {
+		t.Errorf("expected %v, actual: %v", plan, decoded)
+	}
+
+	if err := plan.Write(out, "yaml"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestPlanInstall(t *testing.T) {
+	cluster, clusterKey, cleanup := testClusterWithKey(t)
+	defer cleanup()
+
+	raspbian := sshtest.NewPi("black-pearl")
+	if err := raspbian.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer raspbian.Close()
+	k3os := startK3osPi(t, clusterKey)
+	defer k3os.Close()
+	k3os.Password = "rancher-only"
+	k3os.SetFile("/etc/os-release", []byte("PRETTY_NAME=\"k3OS v0.3.0\"\nID=k3os\n"))
+
+	inv := &inventory.Inventory{Name: cluster.Name}
+	inv.SetNode(&pkg.Node{Address: "10.0.0.3", Hostname: "k3-node3"}, "agent")
+	_ = cluster.Save(inv)
+
+	newArgs := func() *InstallArgs {
+		auth := pkg.Auth{Type: "basic-auth", User: "pirate", Password: "hypriot"}
+		return &InstallArgs{
+			Nodes: pkg.Nodes{
+				{Address: "10.0.0.1", Arch: "aarch64", Auth: auth},
+				{Address: "10.0.0.2", Arch: "aarch64", Auth: auth},
+			},
+			SSHKeys:         pkg.SSHKeys{clusterKey},
+			ServerID:        "10.0.0.1",
+			HostnameSpec:    &pkg.HostnameSpec{Pattern: "%s%d", Prefix: "k3-node"},
+			Cluster:         cluster,
+			RancherKeyPaths: cluster.KeyPaths(),
+			OperatorFactory: &pkg.CmdOperatorFactory{Create: sshtest.Rewrite(ssh.NewCmdOperator, map[string]*sshtest.Server{"10.0.0.1": raspbian, "10.0.0.2": k3os})},
+		}
+	}
+
+	plan, err := PlanInstall(context.Background(), newArgs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Nodes) != 3 {
+		t.Fatalf("expected 3 nodes, actual: %d", len(plan.Nodes))
+	}
+	server, agent, untouched := plan.Nodes[0], plan.Nodes[1], plan.Nodes[2]
+	if server.Action != ActionInstall || server.Role != "server" || server.CurrentHostname != "black-pearl" || server.Node.Hostname != "k3-node1" || server.CurrentConfig != "" {
+		t.Errorf("unexpected server plan %+v", server)
+	}
+	if agent.Action != ActionInstall || agent.CurrentOS != "k3OS v0.3.0" || agent.CurrentConfig == "" {
+		t.Errorf("unexpected agent plan %+v", agent)
+	}
+	if untouched.Action != ActionUntouched || untouched.Node.Address != "10.0.0.3" {
+		t.Errorf("expected 10.0.0.3 to be untouched, actual: %+v", untouched)
+	}
+
+	var text bytes.Buffer
+	_ = plan.WriteText(&text)
+	for _, want := range []string{"black-pearl -> k3-node1", "Raspbian GNU/Linux 10 (buster), overwritten", "- hostname: k3-node1", "+ hostname: k3-node2", "untouched, in the cluster"} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("expected %q in the plan:\n%s", want, text.String())
+		}
+	}
+
+	path := filepath.Join(cluster.Dir, "plan.yaml")
+	if err := plan.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := LoadInstallPlan(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := newArgs()
+	args.Nodes, args.HostnameSpec, args.Plan = saved.InstallNodes(), &pkg.HostnameSpec{Pattern: "%s%d", Prefix: "other"}, saved
+	prepared, err := prepareInstall(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prepared.task.Server.Node.Hostname != "k3-node1" || string(prepared.task.Agents[0].Config) != agent.Config {
+		t.Errorf("expected the hostnames and configs of the plan, actual: %s", prepared.task.Server.Node.Hostname)
+	}
+	if err := saved.verify(context.Background(), prepared.task, args.RancherKeyPaths, args.OperatorFactory); err != nil {
+		t.Errorf("expected the plan to be current: %v", err)
+	}
+
+	raspbian.SetFile("/etc/os-release", []byte("PRETTY_NAME=\"Raspbian GNU/Linux 11 (bullseye)\"\nID=raspbian\n"))
+	if err := saved.verify(context.Background(), prepared.task, args.RancherKeyPaths, args.OperatorFactory); err == nil {
+		t.Error("expected the plan to be stale")
+	}
+}
@@ -0,0 +1,332 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	CheckSSH    = "ssh"
+	CheckDisk   = "disk"
+	CheckSudo   = "sudo"
+	CheckTools  = "tools"
+	CheckBoard  = "board"
+	CheckClock  = "clock"
+	CheckServer = "server"
+
+	// Max allowed difference between the node clock and the local clock.
+	MaxClockSkew = time.Second * 60
+	k3sAPIPort   = 6443
+)
+
+// Board models, as found in /proc/device-tree/model, that k3os supports.
+var SupportedBoards = []string{
+	"Raspberry Pi 2",
+	"Raspberry Pi 3",
+	"Raspberry Pi 4",
+}
+
+// Tools the installer needs on the node.
+var requiredTools = []string{"tar", "sync"}
+
+var preflightChecks = []string{CheckSSH, CheckDisk, CheckSudo, CheckTools, CheckBoard, CheckClock, CheckServer}
+
+// The outcome of one pre-flight check.
+type PreflightCheck struct {
+	Name    string
+	Passed  bool
+	Skipped bool
+	Message string
+}
+
+// All pre-flight checks for one node.
+type PreflightResult struct {
+	Node   *pkg.Node
+	Role   string
+	Checks []*PreflightCheck
+}
+
+func (r *PreflightResult) Passed() bool {
+	for _, check := range r.Checks {
+		if !check.Passed && !check.Skipped {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *PreflightResult) add(name string, err error) {
+	check := &PreflightCheck{Name: name, Passed: err == nil}
+	if err != nil {
+		check.Message = err.Error()
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+func (r *PreflightResult) skip(name string, message string) {
+	r.Checks = append(r.Checks, &PreflightCheck{Name: name, Skipped: true, Message: message})
+}
+
+type PreflightResults []*PreflightResult
+
+func (results PreflightResults) Passed() bool {
+	for _, r := range results {
+		if !r.Passed() {
+			return false
+		}
+	}
+	return true
+}
+
+// Prints a pass/fail table followed by the reason for each failed check.
+func (results PreflightResults) Print(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(w, "NODE\tROLE\t%s\n", strings.ToUpper(strings.Join(preflightChecks, "\t")))
+	var failures []string
+	for _, r := range results {
+		_, _ = fmt.Fprintf(w, "%s\t%s", r.Node, r.Role)
+		for _, check := range r.Checks {
+			switch {
+			case check.Skipped:
+				_, _ = fmt.Fprint(w, "\t-")
+			case check.Passed:
+				_, _ = fmt.Fprint(w, "\tok")
+			default:
+				_, _ = fmt.Fprint(w, "\tFAIL")
+				failures = append(failures, fmt.Sprintf("%s %s: %s", r.Node, check.Name, check.Message))
+			}
+		}
+		_, _ = fmt.Fprintln(w)
+	}
+	_ = w.Flush()
+	for _, failure := range failures {
+		_, _ = fmt.Fprintln(out, failure)
+	}
+}
+
+// Error returned when one or more nodes failed the pre-flight checks.
+type PreflightError struct {
+	Results PreflightResults
+}
+
+func (e *PreflightError) Error() string {
+	var failed []string
+	for _, r := range e.Results {
+		if !r.Passed() {
+			failed = append(failed, r.Node.String())
+		}
+	}
+	return fmt.Sprintf("pre-flight checks failed for: %s", strings.Join(failed, ", "))
+}
+
+// Runs the pre-flight checks for the server and all agents in the task, on at
+// most parallel nodes at a time. The checks only read from the nodes. Nodes
+// resumed after the image was extracted are not checked. Cancelling ctx stops
+// the running checks.
+func RunPreflight(ctx context.Context, task *pkg.InstallTask, resourceDir string, cmdOperatorFactory *pkg.CmdOperatorFactory, state *InstallState, parallel int) PreflightResults {
+	var targets pkg.Targets
+	var roles []string
+	if task.Server != nil {
+		targets = append(targets, task.Server)
+		roles = append(roles, "server")
+	}
+	for _, agent := range task.Agents {
+		targets = append(targets, agent)
+		roles = append(roles, "agent")
+	}
+
+	if parallel < 1 {
+		parallel = 1
+	}
+	results := make(PreflightResults, len(targets))
+	sem := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+	for i := range targets {
+		if resumePhase := state.ResumePhase(targets[i].Node); pkg.PhaseExtracted.Before(resumePhase) {
+			results[i] = &PreflightResult{Node: targets[i].Node, Role: roles[i]}
+			for _, name := range preflightChecks {
+				results[i].skip(name, fmt.Sprintf("resumed at %s", resumePhase))
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = preflight(ctx, targets[i], roles[i], task.Server != nil, resourceDir, cmdOperatorFactory)
+		}(i)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func preflight(ctx context.Context, target *pkg.Target, role string, serverInstalled bool, resourceDir string, cmdOperatorFactory *pkg.CmdOperatorFactory) *PreflightResult {
+	result := &PreflightResult{Node: target.Node, Role: role}
+
+	operator, err := connect(target.Node, cmdOperatorFactory)
+	result.add(CheckSSH, err)
+	if err != nil {
+		for _, name := range preflightChecks[1:] {
+			result.skip(name, "no ssh connection")
+		}
+		return result
+	}
+	defer operator.Close()
+
+	imageSize := int64(0)
+	if stat, err := os.Stat(target.GetImageFilePath(resourceDir)); err == nil {
+		imageSize = stat.Size()
+	}
+	result.add(CheckDisk, checkDiskSpace(ctx, operator, imageSize))
+	result.add(CheckSudo, checkSudo(ctx, operator))
+	result.add(CheckTools, checkTools(ctx, operator))
+	result.add(CheckBoard, checkBoard(ctx, operator))
+	result.add(CheckClock, checkClock(ctx, operator, time.Now()))
+
+	if role == "server" {
+		result.skip(CheckServer, "server node")
+	} else if len(target.ServerIP) == 0 {
+		result.skip(CheckServer, "no server address")
+	} else {
+		result.add(CheckServer, checkServer(ctx, operator, target.ServerIP, serverInstalled))
+	}
+
+	return result
+}
+
+func connect(node *pkg.Node, cmdOperatorFactory *pkg.CmdOperatorFactory) (pkg.CmdOperator, error) {
+	sshConfig, sshAgentCloseHandler, err := ssh.NewClientConfigFor(node)
+	if err != nil {
+		return nil, err
+	}
+	defer sshAgentCloseHandler()
+
+	return cmdOperatorFactory.Create(&pkg.CmdOperatorCtx{
+		Address:         node.SSHAddress(),
+		SSHClientConfig: sshConfig,
+		EnableStdOut:    false,
+		JumpHost:        node.JumpHost,
+	})
+}
+
+// The home directory must hold the image and leave room for extracting it.
+func checkDiskSpace(ctx context.Context, operator pkg.CmdOperator, imageSize int64) error {
+	result, err := operator.ExecuteContext(ctx, "df -Pk ~ | tail -1")
+	if err != nil {
+		return fmt.Errorf("df failed: %v", err)
+	}
+	fields := strings.Fields(string(result.StdOut))
+	if len(fields) < 4 {
+		return fmt.Errorf("unexpected df output: %q", string(result.StdOut))
+	}
+	availableKB, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return fmt.Errorf("unexpected df output: %q", string(result.StdOut))
+	}
+	if required := imageSize * 2; availableKB*1024 < required {
+		return fmt.Errorf("%d MB available, %d MB required", availableKB/1024, required/(1024*1024))
+	}
+	return nil
+}
+
+func checkSudo(ctx context.Context, operator pkg.CmdOperator) error {
+	if _, err := operator.ExecuteContext(ctx, "sudo -n true"); err != nil {
+		return fmt.Errorf("passwordless sudo is required")
+	}
+	return nil
+}
+
+func checkTools(ctx context.Context, operator pkg.CmdOperator) error {
+	var missing []string
+	for _, tool := range requiredTools {
+		if _, err := operator.ExecuteContext(ctx, fmt.Sprintf("command -v %s", tool)); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func checkBoard(ctx context.Context, operator pkg.CmdOperator) error {
+	result, err := operator.ExecuteContext(ctx, "cat /proc/device-tree/model")
+	if err != nil {
+		return fmt.Errorf("unknown board model")
+	}
+	model := strings.Trim(string(result.StdOut), "\x00\n ")
+	for _, board := range SupportedBoards {
+		if strings.HasPrefix(model, board) {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported board: %s", model)
+}
+
+func checkClock(ctx context.Context, operator pkg.CmdOperator, now time.Time) error {
+	result, err := operator.ExecuteContext(ctx, "date +%s")
+	if err != nil {
+		return fmt.Errorf("date failed: %v", err)
+	}
+	seconds, err := strconv.ParseInt(strings.TrimSpace(string(result.StdOut)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("unexpected date output: %q", string(result.StdOut))
+	}
+	skew := time.Unix(seconds, 0).Sub(now)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > MaxClockSkew {
+		return fmt.Errorf("clock differs %s from local clock", skew.Round(time.Second))
+	}
+	return nil
+}
+
+// Checks that the agent can connect to port 6443 on the server. A server that
+// is installed in the same run is not listening yet, then only checks that the
+// server answers ping.
+func checkServer(ctx context.Context, operator pkg.CmdOperator, serverIP string, serverInstalled bool) error {
+	if serverInstalled {
+		if _, err := operator.ExecuteContext(ctx, fmt.Sprintf("ping -c 1 -W 3 %s", serverIP)); err != nil {
+			return fmt.Errorf("server %s not reachable", serverIP)
+		}
+		return nil
+	}
+	command := fmt.Sprintf("timeout 5 bash -c 'cat < /dev/null > /dev/tcp/%s/%d'", serverIP, k3sAPIPort)
+	if _, err := operator.ExecuteContext(ctx, command); err != nil {
+		return fmt.Errorf("%s:%d not reachable", serverIP, k3sAPIPort)
+	}
+	return nil
+}
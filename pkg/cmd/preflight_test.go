@@ -0,0 +1,137 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckDiskSpace(t *testing.T) {
+	operator := MockCmdOperator{Results: map[string]pkg.Result{
+		"df -Pk ~ | tail -1": {StdOut: []byte("/dev/root  14989948 1234567 1048576  8% /\n")},
+	}}
+
+	if err := checkDiskSpace(context.Background(), operator, 256*1024*1024); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := checkDiskSpace(context.Background(), operator, 1024*1024*1024); err == nil {
+		t.Error("expected not enough disk space")
+	}
+}
+
+func TestCheckTools(t *testing.T) {
+	operator := MockCmdOperator{Results: map[string]pkg.Result{
+		"command -v tar": {StdOut: []byte("/bin/tar\n")},
+	}}
+
+	err := checkTools(context.Background(), operator)
+	if err == nil || !strings.Contains(err.Error(), "sync") {
+		t.Errorf("expected sync to be missing, got: %v", err)
+	}
+}
+
+func TestCheckBoard(t *testing.T) {
+	supported := MockCmdOperator{Results: map[string]pkg.Result{
+		"cat /proc/device-tree/model": {StdOut: []byte("Raspberry Pi 3 Model B Rev 1.2\x00")},
+	}}
+	if err := checkBoard(context.Background(), supported); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	unsupported := MockCmdOperator{Results: map[string]pkg.Result{
+		"cat /proc/device-tree/model": {StdOut: []byte("Raspberry Pi Zero W Rev 1.1\x00")},
+	}}
+	if err := checkBoard(context.Background(), unsupported); err == nil {
+		t.Error("expected unsupported board")
+	}
+}
+
+func TestCheckClock(t *testing.T) {
+	now := time.Unix(1570000000, 0)
+	operator := MockCmdOperator{Results: map[string]pkg.Result{
+		"date +%s": {StdOut: []byte("1570000030\n")},
+	}}
+	if err := checkClock(context.Background(), operator, now); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := checkClock(context.Background(), operator, now.Add(-time.Hour)); err == nil {
+		t.Error("expected clock skew")
+	}
+}
+
+func TestPreflightResults_Print(t *testing.T) {
+	result := &PreflightResult{Node: &pkg.Node{Hostname: "k3-node1", Address: "10.0.0.1"}, Role: "agent"}
+	result.add(CheckSSH, nil)
+	result.add(CheckDisk, fmt.Errorf("10 MB available, 500 MB required"))
+	results := PreflightResults{result}
+
+	if results.Passed() {
+		t.Error("expected pre-flight to fail")
+	}
+
+	out := &bytes.Buffer{}
+	results.Print(out)
+	if !strings.Contains(out.String(), "FAIL") || !strings.Contains(out.String(), "500 MB required") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+}
+
+func TestRunPreflight_Parallel(t *testing.T) {
+	var mu sync.Mutex
+	connecting, maxConnecting := 0, 0
+	factory := &pkg.CmdOperatorFactory{Create: func(ctx *pkg.CmdOperatorCtx) (pkg.CmdOperator, error) {
+		mu.Lock()
+		connecting++
+		if connecting > maxConnecting {
+			maxConnecting = connecting
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond * 20)
+		mu.Lock()
+		connecting--
+		mu.Unlock()
+		return nil, fmt.Errorf("connection refused")
+	}}
+
+	task := &pkg.InstallTask{}
+	for i := 1; i <= 5; i++ {
+		node := &pkg.Node{Hostname: fmt.Sprintf("k3-node%d", i), Address: fmt.Sprintf("10.0.0.%d", i)}
+		task.Agents = append(task.Agents, node.GetTarget(pkg.SSHKeys{}))
+	}
+	state, _ := LoadInstallState("")
+
+	if results := RunPreflight(context.Background(), task, "", factory, state, 2); results.Passed() || len(results) != 5 {
+		t.Fatalf("expected 5 failed results, actual %d", len(results))
+	}
+	if maxConnecting != 2 {
+		t.Errorf("expected 2 nodes to be checked at a time, actual %d", maxConnecting)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"strings"
+	"time"
+)
+
+// Checks the readiness of a k3s cluster.
+type ReadinessProbe interface {
+	// Returns nil when the k3s server answers requests and is Ready itself.
+	ServerReady(ctx context.Context) error
+	// Returns nil when all nodes are registered and Ready.
+	NodesReady(ctx context.Context, hostnames []string) error
+	// Returns nil when the node runs k3os with the expected hostname.
+	NodeVerified(ctx context.Context, node *pkg.Node) error
+}
+
+// Probes readiness by running k3s kubectl on the server over ssh.
+type kubectlProbe struct {
+	server  *pkg.Node
+	connect func(node *pkg.Node) (pkg.CmdOperator, error)
+}
+
+// Creates a readiness probe for server, the probe logs in on the k3os ssh port
+// with sshSettings and operators created by cmdOperatorFactory.
+func NewReadinessProbe(server *pkg.Node, sshSettings *ssh.Settings, cmdOperatorFactory *pkg.CmdOperatorFactory) ReadinessProbe {
+	return &kubectlProbe{
+		server: server,
+		connect: func(node *pkg.Node) (pkg.CmdOperator, error) {
+			clientConfig, closeSSHAgent, err := ssh.NewClientConfig(sshSettings)
+			if err != nil {
+				return nil, err
+			}
+			defer closeSSHAgent()
+
+			return cmdOperatorFactory.Create(&pkg.CmdOperatorCtx{
+				Address:         node.K3osSSHAddress(),
+				SSHClientConfig: clientConfig,
+				EnableStdOut:    false,
+				JumpHost:        node.JumpHost,
+			})
+		},
+	}
+}
+
+func (p *kubectlProbe) ServerReady(ctx context.Context) error {
+	return p.NodesReady(ctx, []string{p.server.Hostname})
+}
+
+func (p *kubectlProbe) NodesReady(ctx context.Context, hostnames []string) error {
+	status, err := p.getNodes(ctx)
+	if err != nil {
+		return err
+	}
+
+	var notReady []string
+	for _, hostname := range hostnames {
+		if s, ok := status[hostname]; !ok {
+			notReady = append(notReady, fmt.Sprintf("%s (not registered)", hostname))
+		} else if !strings.HasPrefix(s, "Ready") {
+			notReady = append(notReady, fmt.Sprintf("%s (%s)", hostname, s))
+		}
+	}
+
+	if len(notReady) > 0 {
+		return fmt.Errorf("nodes not ready: %s", strings.Join(notReady, ", "))
+	}
+	return nil
+}
+
+func (p *kubectlProbe) NodeVerified(ctx context.Context, node *pkg.Node) error {
+	operator, err := p.connect(node)
+	if err != nil {
+		return err
+	}
+	defer operator.Close()
+
+	result, err := operator.ExecuteContext(ctx, "cat /etc/os-release")
+	if err != nil {
+		return err
+	}
+	if osRelease := parseOSRelease(string(result.StdOut)); osRelease["ID"] != "k3os" {
+		return fmt.Errorf("%s is running %s, expected k3os", node, osRelease["PRETTY_NAME"])
+	}
+
+	result, err = operator.ExecuteContext(ctx, "hostname")
+	if err != nil {
+		return err
+	}
+	if hostname := strings.TrimSpace(string(result.StdOut)); hostname != node.Hostname {
+		return fmt.Errorf("%s has hostname %s", node, hostname)
+	}
+	return nil
+}
+
+// Parses the KEY=value lines of /etc/os-release.
+func parseOSRelease(content string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(content, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) == 2 {
+			values[parts[0]] = strings.Trim(parts[1], `"'`)
+		}
+	}
+	return values
+}
+
+// Returns the STATUS column of k3s kubectl get nodes by node name.
+func (p *kubectlProbe) getNodes(ctx context.Context) (map[string]string, error) {
+	operator, err := p.connect(p.server)
+	if err != nil {
+		return nil, err
+	}
+	defer operator.Close()
+
+	result, err := operator.ExecuteContext(ctx, "sudo k3s kubectl get nodes --no-headers")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseNodeStatus(string(result.StdOut)), nil
+}
+
+func parseNodeStatus(output string) map[string]string {
+	status := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			status[fields[0]] = fields[1]
+		}
+	}
+	return status
+}
+
+// Calls check every interval until it returns nil, the timeout expires or
+// ctx is cancelled. The ctx passed to check expires with the timeout.
+func waitUntil(ctx context.Context, timeout, interval time.Duration, check func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		err := check(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("%w: %v", pkg.ErrTimeout, err)
+			}
+			return fmt.Errorf("%v: %v", ctx.Err(), err)
+		case <-time.After(interval):
+		}
+	}
+}
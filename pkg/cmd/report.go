@@ -0,0 +1,203 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ReportFormatJSON  = "json"
+	ReportFormatJUnit = "junit"
+)
+
+// Machine readable result of an install.
+type Report struct {
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished"`
+	Status   string       `json:"status"`
+	Nodes    []NodeReport `json:"nodes"`
+}
+
+type NodeReport struct {
+	Role        string        `json:"role"`
+	Hostname    string        `json:"hostname"`
+	Address     string        `json:"address"`
+	Arch        string        `json:"arch"`
+	Status      string        `json:"status"`
+	Phase       pkg.Phase     `json:"phase"`
+	Transferred int64         `json:"transferred"`
+	Error       string        `json:"error,omitempty"`
+	Phases      []PhaseRecord `json:"phases"`
+}
+
+// Creates a report for nodes from the install state.
+func NewReport(state *InstallState, nodes pkg.Nodes, started time.Time) *Report {
+	report := &Report{Started: started, Finished: time.Now(), Status: "OK"}
+	for _, node := range nodes {
+		ns := state.Get(node)
+		if ns == nil {
+			ns = &NodeState{Hostname: node.Hostname, Address: node.Address, Arch: node.Arch}
+		}
+		report.Nodes = append(report.Nodes, NodeReport{
+			Role:        ns.Role,
+			Hostname:    node.Hostname,
+			Address:     node.Address,
+			Arch:        node.Arch,
+			Status:      ns.Status(),
+			Phase:       ns.Phase,
+			Transferred: ns.Transferred,
+			Error:       ns.Error,
+			Phases:      ns.History,
+		})
+		if !ns.Completed() {
+			report.Status = "FAILED"
+		}
+	}
+	return report
+}
+
+func (r *Report) WriteJSON(out io.Writer) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Content string `xml:",chardata"`
+}
+
+// Writes the report as JUnit XML with one test case per node, the phases of
+// each node are listed in system-out.
+func (r *Report) WriteJUnit(out io.Writer) error {
+	suite := junitTestSuite{
+		Name:      "k3pi install",
+		Tests:     len(r.Nodes),
+		Time:      seconds(r.Finished.Sub(r.Started)),
+		Timestamp: r.Started.Format(time.RFC3339),
+	}
+
+	for _, node := range r.Nodes {
+		testCase := junitTestCase{
+			ClassName: fmt.Sprintf("k3pi.%s", node.Role),
+			Name:      fmt.Sprintf("%s (%s)", node.Hostname, node.Address),
+		}
+		var phases []string
+		var elapsed time.Duration
+		for _, record := range node.Phases {
+			line := fmt.Sprintf("%s %s - %s", record.Phase, record.Started.Format(time.RFC3339), record.Finished.Format(time.RFC3339))
+			if record.Error != "" {
+				line += fmt.Sprintf(" error: %s", firstLine(record.Error))
+			}
+			phases = append(phases, line)
+			elapsed += record.Finished.Sub(record.Started)
+		}
+		phases = append(phases, fmt.Sprintf("arch: %s, transferred: %d bytes", node.Arch, node.Transferred))
+		testCase.Time = seconds(elapsed)
+		testCase.SystemOut = strings.Join(phases, "\n")
+
+		switch node.Status {
+		case "OK":
+		case "FAILED":
+			suite.Failures++
+			testCase.Failure = &junitMessage{Message: firstLine(node.Error), Content: node.Error}
+		default:
+			suite.Skipped++
+			testCase.Skipped = &junitMessage{Message: fmt.Sprintf("install stopped after phase %q", node.Phase)}
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+
+	if _, err := io.WriteString(out, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(out)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(out, "\n")
+	return err
+}
+
+// Writes the report to filename. Without a format, files ending with .xml are
+// written as JUnit XML and all other files as JSON.
+func (r *Report) WriteFile(filename, format string) error {
+	if format == "" {
+		format = ReportFormatJSON
+		if strings.EqualFold(filepath.Ext(filename), ".xml") {
+			format = ReportFormatJUnit
+		}
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch format {
+	case ReportFormatJSON:
+		return r.WriteJSON(f)
+	case ReportFormatJUnit:
+		return r.WriteJUnit(f)
+	default:
+		return fmt.Errorf("unknown report format: %s", format)
+	}
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
@@ -0,0 +1,95 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"testing"
+	"time"
+)
+
+func newTestReport() *Report {
+	state, _ := LoadInstallState("")
+	server := &pkg.Node{Hostname: "k3-node1", Address: "10.0.0.1", Arch: "aarch64"}
+	agent := &pkg.Node{Hostname: "k3-node2", Address: "10.0.0.2", Arch: "armv7l"}
+	skipped := &pkg.Node{Hostname: "k3-node3", Address: "10.0.0.3", Arch: "armv7l"}
+	started := time.Now().Add(-time.Minute)
+
+	state.Reset(server, "server")
+	state.Record(server, pkg.PhaseUploaded, started, nil)
+	state.AddTransferred(server, 1024)
+	state.Record(server, pkg.PhaseJoined, started, nil)
+	state.Reset(agent, "agent")
+	state.Record(agent, pkg.PhaseExtracted, started, fmt.Errorf("tar failed"))
+	state.Reset(skipped, "agent")
+
+	return NewReport(state, pkg.Nodes{server, agent, skipped}, started)
+}
+
+func TestReport_WriteJSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	if err := newTestReport().WriteJSON(out); err != nil {
+		t.Fatal(err)
+	}
+
+	report := &Report{}
+	if err := json.Unmarshal(out.Bytes(), report); err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Status != "FAILED" {
+		t.Errorf("expected: FAILED, actual: %s", report.Status)
+	}
+
+	if actual := report.Nodes[0].Transferred; actual != 1024 {
+		t.Errorf("expected: 1024, actual: %d", actual)
+	}
+
+	if actual := report.Nodes[1].Error; actual != "tar failed" {
+		t.Errorf("expected: tar failed, actual: %s", actual)
+	}
+}
+
+func TestReport_WriteJUnit(t *testing.T) {
+	out := &bytes.Buffer{}
+	if err := newTestReport().WriteJUnit(out); err != nil {
+		t.Fatal(err)
+	}
+
+	suites := &junitTestSuites{}
+	if err := xml.Unmarshal(out.Bytes(), suites); err != nil {
+		t.Fatalf("invalid xml: %v\n%s", err, out.String())
+	}
+
+	suite := suites.Suites[0]
+	if suite.Tests != 3 || suite.Failures != 1 || suite.Skipped != 1 {
+		t.Errorf("expected 3 tests, 1 failure and 1 skipped, actual: %d, %d, %d", suite.Tests, suite.Failures, suite.Skipped)
+	}
+
+	if actual := suite.Cases[1].Failure; actual == nil || actual.Message != "tar failed" {
+		t.Errorf("expected failure for %s", suite.Cases[1].Name)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/logging"
+	"time"
+)
+
+const (
+	DefaultServerReadyTimeout = time.Minute * 5
+	DefaultJoinTimeout        = time.Minute * 5
+)
+
+// Shortened by tests that run against emulated nodes.
+var readinessPollInterval = time.Second * 10
+
+// A group of installers that must pass the gate before the next stage starts.
+type installStage struct {
+	name       string
+	installers pkg.Installers
+	// When true, a failed installer stops all remaining stages.
+	required bool
+	// Blocks until the installed nodes are ready, nil means no gate.
+	gate func(ctx context.Context, installed pkg.Nodes) error
+}
+
+// Splits the install task into a server stage followed by agent batches.
+// The server stage is gated on the server becoming ready and each agent
+// batch is gated on its nodes joining the cluster.
+func makeStages(task *pkg.InstallTask, resourceDir string, args *InstallArgs, probe ReadinessProbe, state *InstallState) ([]*installStage, error) {
+	var stages []*installStage
+
+	serverReadyTimeout := args.ServerReadyTimeout
+	if serverReadyTimeout == 0 {
+		serverReadyTimeout = DefaultServerReadyTimeout
+	}
+	joinTimeout := args.JoinTimeout
+	if joinTimeout == 0 {
+		joinTimeout = DefaultJoinTimeout
+	}
+
+	if task.Server != nil {
+		installer, err := makeInstaller(task, task.Server, resourceDir, true, state, args.PhaseTimeouts)
+		if err != nil {
+			return nil, err
+		}
+		stage := &installStage{
+			name:       "server",
+			installers: pkg.Installers{installer},
+			required:   true,
+		}
+		if !task.DryRun {
+			stage.gate = func(ctx context.Context, installed pkg.Nodes) error {
+				logging.Default().WithNode(installed[0].Hostname).Infof("Waiting for server to become ready ...")
+				return state.Run(installed[0], pkg.PhaseJoined, func() error {
+					return waitUntil(ctx, serverReadyTimeout, readinessPollInterval, verified(probe, installed, probe.ServerReady))
+				})
+			}
+		}
+		stages = append(stages, stage)
+	}
+
+	batchSize := args.BatchSize
+	if batchSize < 1 || batchSize > len(task.Agents) {
+		batchSize = len(task.Agents)
+	}
+	for i := 0; i < len(task.Agents); i += batchSize {
+		end := i + batchSize
+		if end > len(task.Agents) {
+			end = len(task.Agents)
+		}
+		batchCount := (len(task.Agents) + batchSize - 1) / batchSize
+		stage := &installStage{name: fmt.Sprintf("agents %d/%d", i/batchSize+1, batchCount)}
+		for _, agent := range task.Agents[i:end] {
+			installer, err := makeInstaller(task, agent, resourceDir, false, state, args.PhaseTimeouts)
+			if err != nil {
+				return nil, err
+			}
+			stage.installers = append(stage.installers, installer)
+		}
+		if !task.DryRun {
+			stage.gate = func(ctx context.Context, installed pkg.Nodes) error {
+				hostnames := installed.Info(func(n *pkg.Node) string { return n.Hostname })
+				logging.Infof("Waiting for %v to join the cluster ...", hostnames)
+				started := time.Now()
+				err := waitUntil(ctx, joinTimeout, readinessPollInterval, verified(probe, installed, func(ctx context.Context) error {
+					return probe.NodesReady(ctx, hostnames)
+				}))
+				for _, node := range installed {
+					state.Record(node, pkg.PhaseJoined, started, err)
+				}
+				return err
+			}
+		}
+		stages = append(stages, stage)
+	}
+
+	return stages, nil
+}
+
+// Returns a check that verifies that all nodes booted k3os before calling ready.
+func verified(probe ReadinessProbe, nodes pkg.Nodes, ready func(ctx context.Context) error) func(ctx context.Context) error {
+	booted := make(map[*pkg.Node]bool)
+	return func(ctx context.Context) error {
+		for _, node := range nodes {
+			if booted[node] {
+				continue
+			}
+			if err := probe.NodeVerified(ctx, node); err != nil {
+				return err
+			}
+			booted[node] = true
+		}
+		return ready(ctx)
+	}
+}
+
+// Runs the stages in order. A stage that fails its gate, or a failed required
+// stage, stops the rollout and all remaining installers are reported as skipped.
+func runStages(ctx context.Context, stages []*installStage, parallel int, failFast bool) error {
+	installErrors := newInstallErrors()
+
+	for i, stage := range stages {
+		logging.Infof("Installing %s", stage.name)
+		installed, stageErrors := runInstall(ctx, stage.installers, parallel, failFast)
+
+		stop := ctx.Err() != nil
+		if stageErrors != nil {
+			installErrors.merge(stageErrors)
+			stop = stop || failFast || stage.required
+		}
+
+		if !stop && stage.gate != nil && len(installed) > 0 {
+			if err := stage.gate(ctx, installed); err != nil {
+				for _, node := range installed {
+					installErrors.Failed[node] = fmt.Errorf("%s not ready: %v", stage.name, err)
+				}
+				stop = true
+			}
+		}
+
+		if stop {
+			for _, remaining := range stages[i+1:] {
+				for _, installer := range remaining.installers {
+					installErrors.Skipped = append(installErrors.Skipped, installer.GetTarget().Node)
+				}
+			}
+			break
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		logging.Warnf("Install interrupted, see the summary for the phase each node was left in")
+		if installErrors.empty() {
+			return fmt.Errorf("install interrupted: %w", err)
+		}
+	}
+	if !installErrors.empty() {
+		logging.Errorf("Install failed with errors")
+		return installErrors
+	}
+	logging.Infof("Install OK")
+	return nil
+}
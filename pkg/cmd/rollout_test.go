@@ -0,0 +1,227 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"testing"
+)
+
+func TestKubectlProbe_NodesReady(t *testing.T) {
+	output := `k3-node1   Ready      master   3m    v1.15.4-k3s.1
+k3-node2   Ready      <none>   2m    v1.15.4-k3s.1
+k3-node3   NotReady   <none>   10s   v1.15.4-k3s.1
+`
+	probe := &kubectlProbe{
+		server: &pkg.Node{Hostname: "k3-node1"},
+		connect: func(node *pkg.Node) (pkg.CmdOperator, error) {
+			return MockCmdOperator{Results: map[string]pkg.Result{
+				"sudo k3s kubectl get nodes --no-headers": {StdOut: []byte(output)},
+			}}, nil
+		},
+	}
+
+	if err := probe.ServerReady(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	probe.server = &pkg.Node{Hostname: "k3-node3"}
+	if err := probe.ServerReady(context.Background()); err == nil {
+		t.Error("expected a NotReady server not to be ready")
+	}
+
+	probe.server = &pkg.Node{Hostname: "k3-node4"}
+	if err := probe.ServerReady(context.Background()); err == nil {
+		t.Error("expected a missing server not to be ready")
+	}
+
+	if err := probe.NodesReady(context.Background(), []string{"k3-node2"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := probe.NodesReady(context.Background(), []string{"k3-node2", "k3-node3"}); err == nil {
+		t.Error("expected k3-node3 not to be ready")
+	}
+
+	if err := probe.NodesReady(context.Background(), []string{"k3-node4"}); err == nil {
+		t.Error("expected k3-node4 not to be registered")
+	}
+}
+
+func TestKubectlProbe_NodeVerified(t *testing.T) {
+	osRelease := `NAME="k3OS"
+VERSION="v0.3.0"
+ID=k3os
+PRETTY_NAME="k3OS v0.3.0"
+`
+	probe := &kubectlProbe{
+		connect: func(node *pkg.Node) (pkg.CmdOperator, error) {
+			return MockCmdOperator{Results: map[string]pkg.Result{
+				"cat /etc/os-release": {StdOut: []byte(osRelease)},
+				"hostname":            {StdOut: []byte("k3-node2\n")},
+			}}, nil
+		},
+	}
+
+	if err := probe.NodeVerified(context.Background(), &pkg.Node{Hostname: "k3-node2"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := probe.NodeVerified(context.Background(), &pkg.Node{Hostname: "k3-node3"}); err == nil {
+		t.Error("expected hostname mismatch")
+	}
+}
+
+func TestParseOSRelease(t *testing.T) {
+	osRelease := parseOSRelease(`PRETTY_NAME="Raspbian GNU/Linux 10 (buster)"
+ID=raspbian
+`)
+
+	if actual := osRelease["ID"]; actual != "raspbian" {
+		t.Errorf("expected: raspbian, actual: %s", actual)
+	}
+
+	if actual := osRelease["PRETTY_NAME"]; actual != "Raspbian GNU/Linux 10 (buster)" {
+		t.Errorf("unexpected PRETTY_NAME: %s", actual)
+	}
+}
+
+func TestMakeStages_Batches(t *testing.T) {
+	node := pkg.Node{Arch: "aarch64"}
+	var agents pkg.Targets
+	for i := 0; i < 5; i++ {
+		agent := node
+		agent.Hostname = fmt.Sprintf("agent%d", i)
+		agents = append(agents, &pkg.Target{Node: &agent})
+	}
+	task := &pkg.InstallTask{
+		DryRun: true,
+		Server: &pkg.Target{Node: &node},
+		Agents: agents,
+	}
+
+	stages, err := makeStages(task, "", &InstallArgs{BatchSize: 2}, &mockProbe{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int{1, 2, 2, 1}
+	if len(stages) != len(expected) {
+		t.Fatalf("expected %d stages, actual: %d", len(expected), len(stages))
+	}
+	for i, stage := range stages {
+		if actual := len(stage.installers); actual != expected[i] {
+			t.Errorf("stage %s: expected %d installers, actual: %d", stage.name, expected[i], actual)
+		}
+	}
+}
+
+type mockProbe struct {
+	serverErr error
+	notReady  map[string]bool
+}
+
+func (p *mockProbe) ServerReady(ctx context.Context) error {
+	return p.serverErr
+}
+
+func (p *mockProbe) NodeVerified(ctx context.Context, node *pkg.Node) error {
+	return nil
+}
+
+func (p *mockProbe) NodesReady(ctx context.Context, hostnames []string) error {
+	for _, hostname := range hostnames {
+		if p.notReady[hostname] {
+			return fmt.Errorf("%s not ready", hostname)
+		}
+	}
+	return nil
+}
+
+func gatedStage(name string, installers pkg.Installers, required bool, gateErr error) *installStage {
+	return &installStage{
+		name:       name,
+		installers: installers,
+		required:   required,
+		gate: func(ctx context.Context, installed pkg.Nodes) error {
+			return gateErr
+		},
+	}
+}
+
+func TestRunStages_Server_Failure_Skips_Agents(t *testing.T) {
+	server, _ := mockInstallers(1, map[int]bool{0: true})
+	agents, _ := mockInstallers(3, nil)
+
+	err := runStages(context.Background(), []*installStage{
+		gatedStage("server", server, true, nil),
+		gatedStage("agents", agents, false, nil),
+	}, 5, false)
+
+	installErrors, ok := err.(*InstallErrors)
+	if !ok {
+		t.Fatalf("expected *InstallErrors, got %v", err)
+	}
+
+	if actual := len(installErrors.Skipped); actual != 3 {
+		t.Errorf("expected 3 skipped agents, actual: %d", actual)
+	}
+}
+
+func TestRunStages_Gate_Failure_Stops_Rollout(t *testing.T) {
+	batch1, _ := mockInstallers(2, nil)
+	batch2, _ := mockInstallers(2, nil)
+
+	err := runStages(context.Background(), []*installStage{
+		gatedStage("agents 1/2", batch1, false, fmt.Errorf("timeout")),
+		gatedStage("agents 2/2", batch2, false, nil),
+	}, 5, false)
+
+	installErrors, ok := err.(*InstallErrors)
+	if !ok {
+		t.Fatalf("expected *InstallErrors, got %v", err)
+	}
+
+	if actual := len(installErrors.Failed); actual != 2 {
+		t.Errorf("expected 2 failed agents, actual: %d", actual)
+	}
+
+	if actual := len(installErrors.Skipped); actual != 2 {
+		t.Errorf("expected 2 skipped agents, actual: %d", actual)
+	}
+}
+
+func TestRunStages_OK(t *testing.T) {
+	server, _ := mockInstallers(1, nil)
+	agents, _ := mockInstallers(3, nil)
+
+	err := runStages(context.Background(), []*installStage{
+		gatedStage("server", server, true, nil),
+		gatedStage("agents", agents, false, nil),
+	}, 5, false)
+
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -26,6 +26,8 @@ import (
 	"github.com/TheNatureOfSoftware/k3pi/pkg"
 	"github.com/TheNatureOfSoftware/k3pi/pkg/misc"
 	ssh2 "github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"github.com/pkg/errors"
+	"strconv"
 	"strings"
 )
 
@@ -51,9 +53,16 @@ func ScanForRaspberries(request *ScanRequest, hostScanner misc.HostScanner, cmdO
 	}
 
 	config, closeSSHAgent, err := ssh2.NewClientConfig(request.SSHSettings)
-	misc.PanicOnError(err, "failed to create ssh config")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create ssh config")
+	}
 	defer closeSSHAgent()
 
+	port, err := strconv.Atoi(settings.Port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh port %q", settings.Port)
+	}
+
 	raspberries := []pkg.Node{}
 	for i := range *alive {
 		ip := (*alive)[i]
@@ -69,12 +78,9 @@ func ScanForRaspberries(request *ScanRequest, hostScanner misc.HostScanner, cmdO
 				raspberries = append(raspberries, pkg.Node{
 					Hostname: hn,
 					Address:  ip,
+					Port:     port,
 					Arch:     arch,
-					Auth: pkg.Auth{
-						Type:   "ssh-key",
-						User:   settings.User,
-						SSHKey: settings.GetKeyPath(),
-					},
+					Auth:     keyAuth(settings),
 				})
 			}
 		} else {
@@ -87,6 +93,7 @@ func ScanForRaspberries(request *ScanRequest, hostScanner misc.HostScanner, cmdO
 						raspberries = append(raspberries, pkg.Node{
 							Hostname: hn,
 							Address:  ip,
+							Port:     port,
 							Arch:     arch,
 							Auth: pkg.Auth{
 								Type:     "basic-auth",
@@ -110,6 +117,7 @@ func checkIfHostnameMatch(hostnameSubStr string, ctx *pkg.CmdOperatorCtx, cmdOpe
 	if err != nil {
 		return "", false
 	}
+	defer cmdOperator.Close()
 
 	result, err := cmdOperator.Execute("hostname")
 	if err != nil {
@@ -125,6 +133,7 @@ func checkArch(ctx *pkg.CmdOperatorCtx, cmdOperatorFactory *pkg.CmdOperatorFacto
 	if err != nil {
 		return false, ""
 	}
+	defer cmdOperator.Close()
 
 	result, err := cmdOperator.Execute("uname -m")
 	if err != nil {
@@ -139,3 +148,16 @@ func checkArch(ctx *pkg.CmdOperatorCtx, cmdOperatorFactory *pkg.CmdOperatorFacto
 	}
 
 }
+
+// Returns the auth of nodes found with the keys of settings, a single key is
+// written as ssh_key.
+func keyAuth(settings *ssh2.Settings) pkg.Auth {
+	auth := pkg.Auth{Type: "ssh-key", User: settings.User}
+	keyPaths := settings.GetKeyPaths()
+	if len(keyPaths) == 1 {
+		auth.SSHKey = keyPaths[0]
+	} else {
+		auth.SSHKeys = keyPaths
+	}
+	return auth
+}
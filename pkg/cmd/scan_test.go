@@ -22,9 +22,16 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/replay"
 	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh/sshtest"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -40,6 +47,18 @@ func (op MockCmdOperator) Close() error {
 	return nil
 }
 
+func (op MockCmdOperator) ExecuteContext(ctx context.Context, command string) (*pkg.Result, error) {
+	return op.Execute(command)
+}
+
+func (op MockCmdOperator) Copy(ctx context.Context, r io.Reader, remotePath string, size int64, mode os.FileMode) error {
+	return nil
+}
+
+func (op MockCmdOperator) CopyFrom(ctx context.Context, remotePath string, create func(size int64, mode os.FileMode) (io.Writer, error)) error {
+	return nil
+}
+
 func (op MockCmdOperator) Execute(command string) (*pkg.Result, error) {
 	if result, ok := op.Results[command]; ok {
 		return &result, nil
@@ -65,11 +84,129 @@ func TestScanForRaspberries(t *testing.T) {
 		Cidr:              "127.0.0.1/32",
 		HostnameSubString: "",
 		SSHSettings: &ssh.Settings{
-			User:    "",
-			KeyPath: "~/.ssh/id_rsa",
-			Port:    "22",
+			User:     "",
+			KeyPaths: []string{"~/.ssh/id_rsa"},
+			Port:     "22",
 		},
 		UserCredentials: make(map[string]string),
 	}
 	ScanForRaspberries(scanRequest, &mockHostScanner{}, cmdOpFactory)
 }
+
+func TestScanForRaspberries_Emulated_Pi(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath, err := sshtest.WriteKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pi := sshtest.NewPi("black-pearl")
+	if err := pi.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pi.Close()
+
+	scanRequest := &ScanRequest{
+		Cidr:              "127.0.0.1/32",
+		HostnameSubString: "pearl",
+		SSHSettings:       &ssh.Settings{User: "pirate", KeyPaths: []string{keyPath}, Port: pi.Port()},
+		UserCredentials:   make(map[string]string),
+	}
+	nodes, err := ScanForRaspberries(scanRequest, &mockHostScanner{}, &pkg.CmdOperatorFactory{Create: ssh.NewCmdOperator})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*nodes) != 1 {
+		t.Fatalf("expected 1 node, actual: %d", len(*nodes))
+	}
+	node := (*nodes)[0]
+	if node.Hostname != "black-pearl" || node.Arch != "armv7l" || node.Auth.Type != "ssh-key" {
+		t.Errorf("unexpected node: %v", node)
+	}
+	if node.SSHAddress() != pi.Addr() {
+		t.Errorf("expected ssh address %s, actual: %s", pi.Addr(), node.SSHAddress())
+	}
+}
+
+func TestScanForRaspberries_Emulated_Pi_Password(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath, err := sshtest.WriteKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pi := sshtest.NewPi("black-pearl")
+	pi.Arch = "aarch64"
+	pi.Password = "hypriot"
+	// Rejects the key of the scan, only the password is accepted.
+	pi.AuthorizedKeys = []gossh.PublicKey{}
+	if err := pi.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pi.Close()
+
+	scanRequest := &ScanRequest{
+		Cidr:            "127.0.0.1/32",
+		SSHSettings:     &ssh.Settings{User: "pirate", KeyPaths: []string{keyPath}, Port: pi.Port()},
+		UserCredentials: map[string]string{"pirate": "hypriot"},
+	}
+	nodes, err := ScanForRaspberries(scanRequest, &mockHostScanner{}, &pkg.CmdOperatorFactory{Create: ssh.NewCmdOperator})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*nodes) != 1 {
+		t.Fatalf("expected 1 node, actual: %d", len(*nodes))
+	}
+	node := (*nodes)[0]
+	if node.Arch != "aarch64" || node.Auth.Type != "basic-auth" || node.Auth.Password != "hypriot" {
+		t.Errorf("unexpected node: %v", node)
+	}
+}
+
+func TestScanForRaspberries_Replay_HypriotOS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath, err := sshtest.WriteKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cassette, err := replay.Load("testdata/scan-hypriotos.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	player := replay.NewPlayer(cassette)
+
+	scanRequest := &ScanRequest{
+		Cidr:            "127.0.0.1/32",
+		SSHSettings:     &ssh.Settings{User: "root", KeyPaths: []string{keyPath}, Port: "22"},
+		UserCredentials: map[string]string{"pirate": "hypriot"},
+	}
+	nodes, err := ScanForRaspberries(scanRequest, &mockHostScanner{}, &pkg.CmdOperatorFactory{Create: player.Create})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*nodes) != 1 {
+		t.Fatalf("expected 1 node, actual: %d", len(*nodes))
+	}
+	node := (*nodes)[0]
+	if node.Hostname != "black-pearl" || node.Arch != "armv7l" || node.Auth.Type != "basic-auth" {
+		t.Errorf("unexpected node: %v", node)
+	}
+	if unused := player.Unused(); len(unused) != 0 {
+		t.Errorf("expected all interactions to be replayed, unused: %v", unused)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/misc"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"strconv"
+	"strings"
+)
+
+// Returns the nodes of the inventory followed by the scanned nodes that are
+// not in the inventory, which have no role.
+func ShellNodes(inv *inventory.Inventory, scanned pkg.Nodes) []*inventory.Node {
+	nodes := append([]*inventory.Node{}, inv.Nodes...)
+	for _, node := range scanned {
+		if inv.GetNode(node.Address) == nil {
+			nodes = append(nodes, &inventory.Node{Node: *node})
+		}
+	}
+	return nodes
+}
+
+// Returns the node with the hostname, the address or the index, counting
+// from 1, given by arg.
+func FindNode(nodes []*inventory.Node, arg string) (*inventory.Node, error) {
+	if index, err := strconv.Atoi(arg); err == nil {
+		if index < 1 || index > len(nodes) {
+			return nil, fmt.Errorf("no node %d, there are %d nodes", index, len(nodes))
+		}
+		return nodes[index-1], nil
+	}
+
+	var found []*inventory.Node
+	for _, node := range nodes {
+		if node.Hostname == arg {
+			found = append(found, node)
+		}
+	}
+	if len(found) == 0 {
+		for _, node := range nodes {
+			if node.Address == arg {
+				found = append(found, node)
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("no node with hostname or address %s", arg)
+	case 1:
+		return found[0], nil
+	default:
+		var addresses []string
+		for _, node := range found {
+			addresses = append(addresses, node.Address)
+		}
+		return nil, fmt.Errorf("%s is the hostname of %s, use the address", arg, strings.Join(addresses, ", "))
+	}
+}
+
+// Opens an interactive shell on node and returns its exit code. Installed
+// nodes are logged in to as rancher with the cluster key on the k3os port,
+// other nodes with the credentials and the port found by scan.
+func OpenShell(node *inventory.Node, cluster *inventory.Cluster, terminal *ssh.Terminal) (int, error) {
+	var sshConfig *gossh.ClientConfig
+	var closeSSHAgent func() error
+	var err error
+	address := node.SSHAddress()
+	if node.Role != "" {
+		address = node.K3osSSHAddress()
+		sshConfig, closeSSHAgent, err = ssh.NewClientConfig(misc.RancherSSHSettings(cluster.KeyPaths()...))
+	} else {
+		sshConfig, closeSSHAgent, err = ssh.NewClientConfigFor(&node.Node)
+	}
+	if err != nil {
+		return -1, err
+	}
+	defer closeSSHAgent()
+
+	return ssh.Shell(&pkg.CmdOperatorCtx{
+		Address:         address,
+		SSHClientConfig: sshConfig,
+		JumpHost:        node.JumpHost,
+	}, terminal)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFindNode(t *testing.T) {
+	inv := &inventory.Inventory{Nodes: []*inventory.Node{
+		{Node: pkg.Node{Hostname: "k3-node1", Address: "10.0.0.1"}, Role: "server"},
+	}}
+	nodes := ShellNodes(inv, pkg.Nodes{
+		{Hostname: "k3-node1", Address: "10.0.0.1"},
+		{Hostname: "raspberrypi", Address: "10.0.0.2"},
+		{Hostname: "raspberrypi", Address: "10.0.0.3"},
+	})
+	if len(nodes) != 3 || nodes[0].Role != "server" || nodes[1].Role != "" {
+		t.Fatalf("expected the inventory node followed by the scanned nodes, actual %v", nodes)
+	}
+
+	tests := []struct {
+		arg, expected string
+	}{
+		{"k3-node1", "10.0.0.1"},
+		{"10.0.0.2", "10.0.0.2"},
+		{"3", "10.0.0.3"},
+		{"raspberrypi", ""},
+		{"4", ""},
+		{"k3-node9", ""},
+	}
+	for _, test := range tests {
+		node, err := FindNode(nodes, test.arg)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("expected no node for %s, actual %s", test.arg, node.Address)
+			}
+		} else if err != nil || node.Address != test.expected {
+			t.Errorf("expected %s for %s, actual %v: %v", test.expected, test.arg, node, err)
+		}
+	}
+}
+
+func TestOpenShell(t *testing.T) {
+	cluster, clusterKey, cleanup := testClusterWithKey(t)
+	defer cleanup()
+
+	pi := startK3osPi(t, clusterKey)
+	defer pi.Close()
+	port, _ := strconv.Atoi(pi.Port())
+	installed := &inventory.Node{Node: pkg.Node{Hostname: "k3-node1", Address: "127.0.0.1", K3osPort: port}, Role: "server"}
+
+	stdout := &bytes.Buffer{}
+	terminal := &ssh.Terminal{Stdin: strings.NewReader("hostname\nexit\n"), Stdout: stdout, Stderr: &bytes.Buffer{}}
+	code, err := OpenShell(installed, cluster, terminal)
+	if err != nil || code != 0 {
+		t.Fatalf("expected the shell to exit with 0, actual %d: %v", code, err)
+	}
+	if stdout.String() != "k3-node1\n" {
+		t.Errorf("unexpected output: %q", stdout)
+	}
+
+	// Before the install the node is logged in to with the scan credentials.
+	pi.Password = "hypriot"
+	scanned := &inventory.Node{Node: pkg.Node{Address: "127.0.0.1", Port: port, Auth: pkg.Auth{Type: "basic-auth", User: "pirate", Password: "hypriot"}}}
+	terminal.Stdin = strings.NewReader("exit\n")
+	if _, err = OpenShell(scanned, cluster, terminal); err != nil {
+		t.Fatal(err)
+	}
+	scanned.Auth.Password = "wrong"
+	if _, err = OpenShell(scanned, cluster, terminal); err == nil {
+		t.Error("expected the wrong password to be rejected")
+	}
+}
@@ -0,0 +1,279 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/kubernetes-sigs/yaml"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const DefaultStateFile = "k3pi-state.yaml"
+
+// The phase to restart from given the last completed phase. An upload is
+// redone since a failed verify means the uploaded image is corrupt.
+var resumePhases = map[pkg.Phase]pkg.Phase{
+	pkg.PhaseNone:       pkg.PhaseConnected,
+	pkg.PhaseConnected:  pkg.PhaseUploaded,
+	pkg.PhaseUploaded:   pkg.PhaseUploaded,
+	pkg.PhaseVerified:   pkg.PhaseExtracted,
+	pkg.PhaseExtracted:  pkg.PhaseConfigured,
+	pkg.PhaseConfigured: pkg.PhaseRebooted,
+	pkg.PhaseRebooted:   pkg.PhaseJoined,
+	pkg.PhaseJoined:     pkg.PhaseJoined,
+}
+
+// One attempt at completing a phase.
+type PhaseRecord struct {
+	Phase    pkg.Phase `json:"phase"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Install progress of one node.
+type NodeState struct {
+	Hostname string `json:"hostname"`
+	Address  string `json:"address"`
+	Role     string `json:"role,omitempty"`
+	Arch     string `json:"arch,omitempty"`
+	// Bytes copied to the node.
+	Transferred int64 `json:"transferred,omitempty"`
+	// Last completed phase.
+	Phase   pkg.Phase     `json:"phase"`
+	Error   string        `json:"error,omitempty"`
+	History []PhaseRecord `json:"history,omitempty"`
+}
+
+func (ns *NodeState) Completed() bool {
+	return ns.Phase == pkg.PhaseJoined
+}
+
+// Returns the duration of the last successful attempt at phase.
+func (ns *NodeState) Duration(phase pkg.Phase) (time.Duration, bool) {
+	for i := len(ns.History) - 1; i >= 0; i-- {
+		if r := ns.History[i]; r.Phase == phase && r.Error == "" {
+			return r.Finished.Sub(r.Started), true
+		}
+	}
+	return 0, false
+}
+
+// Returns the time from the start of the first attempt to the end of the last.
+func (ns *NodeState) Elapsed() time.Duration {
+	if len(ns.History) == 0 {
+		return 0
+	}
+	return ns.History[len(ns.History)-1].Finished.Sub(ns.History[0].Started)
+}
+
+func (ns *NodeState) Status() string {
+	switch {
+	case ns.Completed():
+		return "OK"
+	case ns.Error != "":
+		return "FAILED"
+	default:
+		return "INCOMPLETE"
+	}
+}
+
+// Install progress of all nodes, persisted after each phase transition. All
+// methods are safe for concurrent use and a nil state tracks nothing.
+type InstallState struct {
+	Nodes map[string]*NodeState `json:"nodes"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// Loads the install state from path, a missing file gives an empty state. An
+// empty path gives a state that is never saved.
+func LoadInstallState(path string) (*InstallState, error) {
+	state := &InstallState{Nodes: make(map[string]*NodeState), path: path}
+	if path == "" {
+		return state, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = yaml.Unmarshal(b, state); err != nil {
+		return nil, err
+	}
+	if state.Nodes == nil {
+		state.Nodes = make(map[string]*NodeState)
+	}
+	return state, nil
+}
+
+// Forgets the progress of node.
+func (s *InstallState) Reset(node *pkg.Node, role string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Nodes[node.Address] = &NodeState{Hostname: node.Hostname, Address: node.Address, Role: role, Arch: node.Arch}
+	_ = s.save()
+}
+
+// Adds n to the number of bytes copied to node.
+func (s *InstallState) AddTransferred(node *pkg.Node, n int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ns, ok := s.Nodes[node.Address]; ok {
+		ns.Transferred += n
+	}
+}
+
+// Returns the state of node, nil if the node is unknown.
+func (s *InstallState) Get(node *pkg.Node) *NodeState {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ns, ok := s.Nodes[node.Address]; ok {
+		c := *ns
+		return &c
+	}
+	return nil
+}
+
+// Returns the phase the install of node should start from.
+func (s *InstallState) ResumePhase(node *pkg.Node) pkg.Phase {
+	if ns := s.Get(node); ns != nil {
+		return resumePhases[ns.Phase]
+	}
+	return pkg.PhaseConnected
+}
+
+// Runs fn and records the outcome as an attempt at phase.
+func (s *InstallState) Run(node *pkg.Node, phase pkg.Phase, fn func() error) error {
+	started := time.Now()
+	err := fn()
+	s.Record(node, phase, started, err)
+	return err
+}
+
+// Records an attempt at phase that started at started and ended now with err.
+func (s *InstallState) Record(node *pkg.Node, phase pkg.Phase, started time.Time, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns, ok := s.Nodes[node.Address]
+	if !ok {
+		ns = &NodeState{Hostname: node.Hostname, Address: node.Address}
+		s.Nodes[node.Address] = ns
+	}
+
+	record := PhaseRecord{Phase: phase, Started: started, Finished: time.Now()}
+	if err != nil {
+		record.Error = err.Error()
+		ns.Error = err.Error()
+	} else {
+		ns.Error = ""
+		if ns.Phase.Before(phase) {
+			ns.Phase = phase
+		}
+	}
+	ns.History = append(ns.History, record)
+	_ = s.save()
+}
+
+// Phases shown with timings in the summary.
+var summaryPhases = []pkg.Phase{pkg.PhaseUploaded, pkg.PhaseExtracted, pkg.PhaseJoined}
+
+// Prints the status of each node with the time spent in the slowest phases.
+func (s *InstallState) PrintSummary(out io.Writer, nodes pkg.Nodes) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprint(w, "NODE\tROLE\tSTATUS\tPHASE")
+	for _, phase := range summaryPhases {
+		_, _ = fmt.Fprintf(w, "\t%s", strings.ToUpper(string(phase)))
+	}
+	_, _ = fmt.Fprint(w, "\tTOTAL\tERROR\n")
+
+	for _, node := range nodes {
+		ns := s.Get(node)
+		if ns == nil {
+			ns = &NodeState{}
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s", node, ns.Role, ns.Status(), ns.Phase)
+		for _, phase := range summaryPhases {
+			if d, ok := ns.Duration(phase); ok {
+				_, _ = fmt.Fprintf(w, "\t%s", d.Round(time.Second))
+			} else {
+				_, _ = fmt.Fprint(w, "\t-")
+			}
+		}
+		_, _ = fmt.Fprintf(w, "\t%s\t%s\n", ns.Elapsed().Round(time.Second), firstLine(ns.Error))
+	}
+	_ = w.Flush()
+}
+
+func firstLine(s string) string {
+	return strings.SplitN(s, "\n", 2)[0]
+}
+
+// Writes the state to a temp file that replaces the state file, a crash never
+// leaves a truncated state file behind.
+func (s *InstallState) save() error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".k3pi-state-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,246 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstallState_Save_And_Load(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k3pi-state-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, DefaultStateFile)
+	node := &pkg.Node{Hostname: "k3-node1", Address: "10.0.0.1"}
+
+	state, err := LoadInstallState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Reset(node, "agent")
+	state.Record(node, pkg.PhaseConnected, time.Now(), nil)
+	state.Record(node, pkg.PhaseUploaded, time.Now(), nil)
+	state.Record(node, pkg.PhaseVerified, time.Now(), fmt.Errorf("checksum mismatch"))
+
+	loaded, err := LoadInstallState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns := loaded.Get(node)
+	if ns == nil {
+		t.Fatal("node state not found")
+	}
+
+	if ns.Phase != pkg.PhaseUploaded {
+		t.Errorf("expected: %s, actual: %s", pkg.PhaseUploaded, ns.Phase)
+	}
+
+	if ns.Error != "checksum mismatch" {
+		t.Errorf("expected error to be recorded, actual: %q", ns.Error)
+	}
+
+	if actual := len(ns.History); actual != 3 {
+		t.Errorf("expected 3 history records, actual: %d", actual)
+	}
+}
+
+func TestInstallState_ResumePhase(t *testing.T) {
+	state, _ := LoadInstallState("")
+	node := &pkg.Node{Address: "10.0.0.1"}
+
+	if actual := state.ResumePhase(node); actual != pkg.PhaseConnected {
+		t.Errorf("expected: %s, actual: %s", pkg.PhaseConnected, actual)
+	}
+
+	state.Record(node, pkg.PhaseExtracted, time.Now(), nil)
+	if actual := state.ResumePhase(node); actual != pkg.PhaseConfigured {
+		t.Errorf("expected: %s, actual: %s", pkg.PhaseConfigured, actual)
+	}
+
+	// A failed attempt at an earlier phase never moves the node backwards
+	state.Record(node, pkg.PhaseConnected, time.Now(), fmt.Errorf("timeout"))
+	if actual := state.ResumePhase(node); actual != pkg.PhaseConfigured {
+		t.Errorf("expected: %s, actual: %s", pkg.PhaseConfigured, actual)
+	}
+}
+
+func TestInstallState_PrintSummary(t *testing.T) {
+	state, _ := LoadInstallState("")
+	ok := &pkg.Node{Hostname: "k3-node1", Address: "10.0.0.1"}
+	failed := &pkg.Node{Hostname: "k3-node2", Address: "10.0.0.2"}
+	started := time.Now().Add(-time.Minute)
+	state.Reset(ok, "server")
+	state.Record(ok, pkg.PhaseUploaded, started, nil)
+	state.Record(ok, pkg.PhaseJoined, started, nil)
+	state.Reset(failed, "agent")
+	state.Record(failed, pkg.PhaseExtracted, started, fmt.Errorf("tar: write error\nmore output"))
+
+	out := &bytes.Buffer{}
+	state.PrintSummary(out, pkg.Nodes{ok, failed})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got:\n%s", out.String())
+	}
+
+	if !strings.Contains(lines[1], "OK") || !strings.Contains(lines[1], "1m0s") {
+		t.Errorf("unexpected status for %s: %s", ok, lines[1])
+	}
+
+	if !strings.Contains(lines[2], "FAILED") || !strings.HasSuffix(lines[2], "tar: write error") {
+		t.Errorf("unexpected status for %s: %s", failed, lines[2])
+	}
+}
+
+type recordingCmdOperator struct {
+	commands *[]string
+}
+
+func (op recordingCmdOperator) Close() error {
+	return nil
+}
+
+func (op recordingCmdOperator) ExecuteContext(ctx context.Context, command string) (*pkg.Result, error) {
+	return op.Execute(command)
+}
+
+func (op recordingCmdOperator) Copy(ctx context.Context, r io.Reader, remotePath string, size int64, mode os.FileMode) error {
+	return nil
+}
+
+func (op recordingCmdOperator) CopyFrom(ctx context.Context, remotePath string, create func(size int64, mode os.FileMode) (io.Writer, error)) error {
+	return nil
+}
+
+func (op recordingCmdOperator) Execute(command string) (*pkg.Result, error) {
+	*op.commands = append(*op.commands, command)
+	return &pkg.Result{}, nil
+}
+
+func TestInstaller_Install_Resume(t *testing.T) {
+	node := &pkg.Node{
+		Hostname: "k3-node1",
+		Address:  "10.0.0.1",
+		Arch:     "aarch64",
+		Auth:     pkg.Auth{Type: "basic-auth", User: "pirate", Password: "hypriot"},
+	}
+	state, _ := LoadInstallState("")
+	state.Record(node, pkg.PhaseVerified, time.Now(), nil)
+
+	var commands []string
+	config := []byte{}
+	ins := &installer{
+		config: &config,
+		target: &pkg.Target{Node: node},
+		operatorFactory: &pkg.CmdOperatorFactory{Create: func(ctx *pkg.CmdOperatorCtx) (pkg.CmdOperator, error) {
+			return recordingCmdOperator{commands: &commands}, nil
+		}},
+		state: state,
+	}
+
+	if err := ins.Install(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"sudo tar zxvf k3os-rootfs-arm64.tar.gz --strip-components=1 -C /",
+		"sudo cp config.yaml /k3os/system/config.yaml",
+		"sudo sync && sudo reboot -f",
+	}
+	if !reflect.DeepEqual(expected, commands) {
+		t.Errorf("expected: %v, actual: %v", expected, commands)
+	}
+
+	if actual := state.Get(node).Phase; actual != pkg.PhaseRebooted {
+		t.Errorf("expected: %s, actual: %s", pkg.PhaseRebooted, actual)
+	}
+}
+
+func TestSkipCompleted(t *testing.T) {
+	state, _ := LoadInstallState("")
+	server := &pkg.Target{Node: &pkg.Node{Address: "10.0.0.1"}}
+	agent := &pkg.Target{Node: &pkg.Node{Address: "10.0.0.2"}}
+	state.Record(server.Node, pkg.PhaseJoined, time.Now(), nil)
+	state.Record(agent.Node, pkg.PhaseRebooted, time.Now(), nil)
+
+	task := skipCompleted(&pkg.InstallTask{Server: server, Agents: pkg.Targets{agent}}, state)
+
+	if task.Server != nil {
+		t.Error("expected installed server to be skipped")
+	}
+
+	if actual := len(task.Agents); actual != 1 {
+		t.Errorf("expected 1 agent, actual: %d", actual)
+	}
+}
+
+func TestInstaller_Install_Cancelled(t *testing.T) {
+	node := &pkg.Node{
+		Hostname: "k3-node1",
+		Address:  "10.0.0.1",
+		Arch:     "aarch64",
+		Auth:     pkg.Auth{Type: "basic-auth", User: "pirate", Password: "hypriot"},
+	}
+	state, _ := LoadInstallState("")
+	state.Record(node, pkg.PhaseVerified, time.Now(), nil)
+
+	var commands []string
+	config := []byte{}
+	ins := &installer{
+		config: &config,
+		target: &pkg.Target{Node: node},
+		operatorFactory: &pkg.CmdOperatorFactory{Create: func(ctx *pkg.CmdOperatorCtx) (pkg.CmdOperator, error) {
+			return recordingCmdOperator{commands: &commands}, nil
+		}},
+		state: state,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := ins.Install(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+
+	if len(commands) != 0 {
+		t.Errorf("expected no commands, got: %v", commands)
+	}
+	ns := state.Get(node)
+	if ns.Phase != pkg.PhaseVerified || ns.Status() != "FAILED" {
+		t.Errorf("expected node to be left FAILED in %s, actual: %s in %s", pkg.PhaseVerified, ns.Status(), ns.Phase)
+	}
+}
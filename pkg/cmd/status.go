@@ -0,0 +1,377 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/dustin/go-humanize"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	StatusFormatTable = "table"
+	StatusFormatWide  = "wide"
+	StatusFormatJSON  = "json"
+
+	ReadinessReady    = "Ready"
+	ReadinessNotReady = "NotReady"
+	// The server does not know the node.
+	ReadinessNotRegistered = "NotRegistered"
+	// The server could not be asked or reports an unknown condition.
+	ReadinessUnknown = "Unknown"
+)
+
+type StatusArgs struct {
+	Inventory *inventory.Inventory
+	Cluster   *inventory.Cluster
+	// Max time spent on each node, 0 means no limit.
+	Timeout time.Duration
+	// Creates the operators that connect to the nodes, ssh when nil.
+	OperatorFactory *pkg.CmdOperatorFactory
+}
+
+// The status of one node, values that could not be read are left empty.
+type NodeStatus struct {
+	Hostname  string `json:"hostname"`
+	Address   string `json:"address"`
+	Role      string `json:"role"`
+	Reachable bool   `json:"reachable"`
+	// Why the node is unreachable.
+	Error string `json:"error,omitempty"`
+	// PRETTY_NAME of the os-release, k3OS with its version once installed.
+	OS         string `json:"os,omitempty"`
+	K3sVersion string `json:"k3s_version,omitempty"`
+	// State of the k3s service, like started or stopped.
+	K3sService string        `json:"k3s_service,omitempty"`
+	Uptime     time.Duration `json:"-"`
+	// Load averages over 1, 5 and 15 minutes.
+	Load []float64 `json:"load,omitempty"`
+	// Memory and disk of the root file system in bytes.
+	MemoryTotal uint64 `json:"memory_total,omitempty"`
+	MemoryUsed  uint64 `json:"memory_used,omitempty"`
+	DiskTotal   uint64 `json:"disk_total,omitempty"`
+	DiskUsed    uint64 `json:"disk_used,omitempty"`
+	// CPU temperature in degrees Celsius.
+	Temperature float64 `json:"temperature,omitempty"`
+	// Ready, NotReady, NotRegistered or Unknown.
+	Readiness string `json:"readiness"`
+}
+
+// Marshals the status with the uptime in seconds.
+func (s *NodeStatus) MarshalJSON() ([]byte, error) {
+	type plain NodeStatus
+	return json.Marshal(&struct {
+		*plain
+		UptimeSeconds int64 `json:"uptime_seconds,omitempty"`
+	}{(*plain)(s), int64(s.Uptime / time.Second)})
+}
+
+type ClusterStatus struct {
+	Name  string        `json:"name"`
+	Nodes []*NodeStatus `json:"nodes"`
+	// Why the readiness of the nodes is unknown.
+	ReadinessError string `json:"readiness_error,omitempty"`
+}
+
+// Reads the status of all nodes of the inventory in parallel, the readiness
+// of the nodes is read from the server.
+func Status(ctx context.Context, args *StatusArgs) *ClusterStatus {
+	cmdOperatorFactory := operatorFactory(args.OperatorFactory)
+	status := &ClusterStatus{Name: args.Inventory.Name, Nodes: make([]*NodeStatus, len(args.Inventory.Nodes))}
+	var readiness map[string]string
+	readinessErr := fmt.Errorf("cluster %s has no server", args.Inventory.Name)
+
+	wg := sync.WaitGroup{}
+	for i, node := range args.Inventory.Nodes {
+		wg.Add(1)
+		go func(i int, node *inventory.Node) {
+			defer wg.Done()
+			ctx, cancel := withTimeout(ctx, args.Timeout)
+			defer cancel()
+			status.Nodes[i] = nodeStatus(ctx, node, args.Cluster, cmdOperatorFactory)
+		}(i, node)
+	}
+	if server := serverNode(args.Inventory); server != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := withTimeout(ctx, args.Timeout)
+			defer cancel()
+			readiness, readinessErr = nodeReadiness(ctx, &server.Node, args.Cluster, cmdOperatorFactory)
+		}()
+	}
+	wg.Wait()
+
+	if readinessErr != nil {
+		status.ReadinessError = readinessErr.Error()
+	}
+	for _, ns := range status.Nodes {
+		switch r, ok := readiness[ns.Hostname]; {
+		case readinessErr != nil:
+			ns.Readiness = ReadinessUnknown
+		case !ok:
+			ns.Readiness = ReadinessNotRegistered
+		default:
+			ns.Readiness = r
+		}
+	}
+	return status
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Returns the server of the inventory, nil if there is none.
+func serverNode(inv *inventory.Inventory) *inventory.Node {
+	for _, n := range inv.Nodes {
+		if n.Role == "server" {
+			return n
+		}
+	}
+	return inv.GetNode(inv.Server)
+}
+
+// Logs in as rancher, or with the credentials of the node if it does not run
+// k3os, and reads the status. A command without output leaves its values
+// empty.
+func nodeStatus(ctx context.Context, node *inventory.Node, cluster *inventory.Cluster, cmdOperatorFactory *pkg.CmdOperatorFactory) *NodeStatus {
+	status := &NodeStatus{Hostname: node.Hostname, Address: node.Address, Role: node.Role}
+	operator, err := connectRancher(&node.Node, cmdOperatorFactory, cluster.KeyPaths()...)
+	if err != nil {
+		var nodeErr error
+		if operator, nodeErr = connect(&node.Node, cmdOperatorFactory); nodeErr != nil {
+			status.Error = err.Error()
+			return status
+		}
+	}
+	defer operator.Close()
+	status.Reachable = true
+
+	// The output is kept on failure, rc-service exits with 3 when the service
+	// is stopped.
+	run := func(command string) string {
+		result, _ := operator.ExecuteContext(ctx, command)
+		if result == nil {
+			return ""
+		}
+		return strings.TrimSpace(string(result.StdOut))
+	}
+
+	status.OS = parseOSRelease(run("cat /etc/os-release"))["PRETTY_NAME"]
+	if fields := strings.Fields(run("k3s --version")); len(fields) >= 3 && fields[0] == "k3s" {
+		status.K3sVersion = fields[2]
+	}
+	if service := run("sudo rc-service k3s-service status"); strings.Contains(service, "status: ") {
+		status.K3sService = strings.TrimSpace(service[strings.Index(service, "status: ")+len("status: "):])
+	}
+	if fields := strings.Fields(run("cat /proc/uptime")); len(fields) > 0 {
+		if seconds, err := strconv.ParseFloat(fields[0], 64); err == nil {
+			status.Uptime = time.Duration(seconds) * time.Second
+		}
+	}
+	if fields := strings.Fields(run("cat /proc/loadavg")); len(fields) >= 3 {
+		for _, field := range fields[:3] {
+			load, _ := strconv.ParseFloat(field, 64)
+			status.Load = append(status.Load, load)
+		}
+	}
+	memInfo := make(map[string]uint64)
+	for _, line := range strings.Split(run("cat /proc/meminfo"), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			memInfo[strings.TrimSuffix(fields[0], ":")] = kb * 1024
+		}
+	}
+	if total, available := memInfo["MemTotal"], memInfo["MemAvailable"]; total > 0 && available <= total {
+		status.MemoryTotal, status.MemoryUsed = total, total-available
+	}
+	if fields := strings.Fields(run("df -Pk / | tail -1")); len(fields) >= 3 {
+		total, _ := strconv.ParseUint(fields[1], 10, 64)
+		used, _ := strconv.ParseUint(fields[2], 10, 64)
+		status.DiskTotal, status.DiskUsed = total*1024, used*1024
+	}
+	if milli, err := strconv.ParseFloat(run("cat /sys/class/thermal/thermal_zone0/temp"), 64); err == nil {
+		status.Temperature = milli / 1000
+	}
+	return status
+}
+
+// Returns the Ready condition of each node registered with the server.
+func nodeReadiness(ctx context.Context, server *pkg.Node, cluster *inventory.Cluster, cmdOperatorFactory *pkg.CmdOperatorFactory) (map[string]string, error) {
+	operator, err := connectRancher(server, cmdOperatorFactory, cluster.KeyPaths()...)
+	if err != nil {
+		return nil, err
+	}
+	defer operator.Close()
+
+	result, err := operator.ExecuteContext(ctx, "sudo k3s kubectl get nodes -o json")
+	if err != nil {
+		return nil, fmt.Errorf("k3s kubectl get nodes failed on %s, %v", server, result)
+	}
+	return parseNodeReadiness(result.StdOut)
+}
+
+func parseNodeReadiness(output []byte) (map[string]string, error) {
+	list := struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Status struct {
+				Conditions []struct {
+					Type   string `json:"type"`
+					Status string `json:"status"`
+				} `json:"conditions"`
+			} `json:"status"`
+		} `json:"items"`
+	}{}
+	if err := json.Unmarshal(output, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse the nodes: %w", err)
+	}
+
+	readiness := make(map[string]string)
+	for _, item := range list.Items {
+		readiness[item.Metadata.Name] = ReadinessUnknown
+		for _, condition := range item.Status.Conditions {
+			if condition.Type != "Ready" {
+				continue
+			}
+			switch condition.Status {
+			case "True":
+				readiness[item.Metadata.Name] = ReadinessReady
+			case "False":
+				readiness[item.Metadata.Name] = ReadinessNotReady
+			}
+		}
+	}
+	return readiness, nil
+}
+
+// Writes the status in format, table, wide or json.
+func (s *ClusterStatus) Write(out io.Writer, format string) error {
+	switch format {
+	case "", StatusFormatTable:
+		return s.WriteTable(out, false)
+	case StatusFormatWide:
+		return s.WriteTable(out, true)
+	case StatusFormatJSON:
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(s)
+	default:
+		return fmt.Errorf("unknown status format: %s", format)
+	}
+}
+
+// Writes a row per node, wide adds the address and the resource usage.
+// Unreachable nodes and an unknown readiness are explained below the table.
+func (s *ClusterStatus) WriteTable(out io.Writer, wide bool) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	header := []string{"HOSTNAME", "ROLE", "STATUS", "OS", "K3S", "SERVICE", "READY", "UPTIME"}
+	if wide {
+		header = append(append(header[:1:1], "ADDRESS"), header[1:]...)
+		header = append(header, "LOAD", "MEMORY", "DISK", "TEMP")
+	}
+	_, _ = fmt.Fprintln(w, strings.Join(header, "\t"))
+
+	var errs []string
+	for _, ns := range s.Nodes {
+		reachable := "reachable"
+		if !ns.Reachable {
+			reachable = "unreachable"
+			errs = append(errs, fmt.Sprintf("%s: %s", ns.Hostname, ns.Error))
+		}
+		row := []string{ns.Hostname, ns.Role, reachable, ns.OS, ns.K3sVersion, ns.K3sService, ns.Readiness, formatUptime(ns.Uptime)}
+		if wide {
+			row = append(append(row[:1:1], ns.Address), row[1:]...)
+			row = append(row, formatLoad(ns.Load), formatUsage(ns.MemoryUsed, ns.MemoryTotal, humanize.IBytes),
+				formatUsage(ns.DiskUsed, ns.DiskTotal, humanize.Bytes), formatTemperature(ns.Temperature))
+		}
+		for i := range row {
+			if row[i] == "" {
+				row[i] = "-"
+			}
+		}
+		_, _ = fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if s.ReadinessError != "" {
+		errs = append(errs, "readiness unknown: "+s.ReadinessError)
+	}
+	if len(errs) > 0 {
+		_, _ = fmt.Fprintf(out, "\n%s\n", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// Returns the uptime in days, hours and minutes, like 3d4h.
+func formatUptime(d time.Duration) string {
+	switch {
+	case d <= 0:
+		return ""
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd%dh", d/(24*time.Hour), d%(24*time.Hour)/time.Hour)
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%dm", d/time.Hour, d%time.Hour/time.Minute)
+	default:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+}
+
+func formatLoad(load []float64) string {
+	var values []string
+	for _, l := range load {
+		values = append(values, strconv.FormatFloat(l, 'f', 2, 64))
+	}
+	return strings.Join(values, " ")
+}
+
+func formatUsage(used, total uint64, format func(uint64) string) string {
+	if total == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s", format(used), format(total))
+}
+
+// Formats like vcgencmd measure_temp.
+func formatTemperature(celsius float64) string {
+	if celsius == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%.1f'C", celsius)
+}
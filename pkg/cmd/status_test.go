@@ -0,0 +1,124 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/inventory"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh/sshtest"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+const kubectlNodesJSON = `{"items": [
+  {"metadata": {"name": "k3-node1"}, "status": {"conditions": [{"type": "MemoryPressure", "status": "False"}, {"type": "Ready", "status": "True"}]}},
+  {"metadata": {"name": "k3-node2"}, "status": {"conditions": [{"type": "Ready", "status": "False"}]}}
+]}`
+
+func TestStatus(t *testing.T) {
+	cluster, clusterKey, cleanup := testClusterWithKey(t)
+	defer cleanup()
+
+	server, agent := startK3osPi(t, clusterKey), startK3osPi(t, clusterKey)
+	defer server.Close()
+	defer agent.Close()
+	server.SetFile("/etc/os-release", []byte("PRETTY_NAME=\"k3OS v0.3.0\"\nID=k3os\n"))
+	server.SetFile("/proc/uptime", []byte("273600.52 1040000.10\n"))
+	server.SetFile("/proc/loadavg", []byte("0.52 0.38 0.31 1/240 4242\n"))
+	server.SetFile("/proc/meminfo", []byte("MemTotal:         948304 kB\nMemFree:          102400 kB\nMemAvailable:     524288 kB\n"))
+	server.SetFile("/sys/class/thermal/thermal_zone0/temp", []byte("48312\n"))
+	server.Handle("k3s --version", func(command string, stdout, stderr io.Writer) int {
+		_, _ = fmt.Fprintln(stdout, "k3s version v1.16.2-k3s.1 (b8b17ba5)")
+		return 0
+	})
+	server.Handle("rc-service k3s-service status", func(command string, stdout, stderr io.Writer) int {
+		_, _ = fmt.Fprintln(stdout, " * status: started")
+		return 0
+	})
+	server.Handle("k3s kubectl get nodes -o json", func(command string, stdout, stderr io.Writer) int {
+		_, _ = io.WriteString(stdout, kubectlNodesJSON)
+		return 0
+	})
+	agent.Handle("rc-service k3s-service status", func(command string, stdout, stderr io.Writer) int {
+		_, _ = fmt.Fprintln(stdout, " * status: stopped")
+		return 3
+	})
+
+	args := &StatusArgs{
+		Inventory: &inventory.Inventory{Name: "pearl", Nodes: []*inventory.Node{
+			{Node: pkg.Node{Hostname: "k3-node1", Address: "10.0.0.1"}, Role: "server"},
+			{Node: pkg.Node{Hostname: "k3-node2", Address: "10.0.0.2"}, Role: "agent"},
+			{Node: pkg.Node{Hostname: "k3-node3", Address: "127.0.0.1", K3osPort: 1}, Role: "agent"},
+		}},
+		Cluster:         cluster,
+		Timeout:         time.Second * 10,
+		OperatorFactory: &pkg.CmdOperatorFactory{Create: sshtest.Rewrite(ssh.NewCmdOperator, map[string]*sshtest.Server{"10.0.0.1": server, "10.0.0.2": agent})},
+	}
+	status := Status(context.Background(), args)
+
+	node1, node2, node3 := status.Nodes[0], status.Nodes[1], status.Nodes[2]
+	if !node1.Reachable || node1.OS != "k3OS v0.3.0" || node1.K3sVersion != "v1.16.2-k3s.1" || node1.K3sService != "started" || node1.Readiness != ReadinessReady {
+		t.Errorf("unexpected status of the server: %+v", node1)
+	}
+	if node1.Uptime != 76*time.Hour || len(node1.Load) != 3 || node1.Load[0] != 0.52 || node1.Temperature != 48.312 {
+		t.Errorf("unexpected uptime, load or temperature of the server: %+v", node1)
+	}
+	if node1.MemoryTotal != 948304*1024 || node1.MemoryUsed != (948304-524288)*1024 || node1.DiskTotal != 30000000*1024 || node1.DiskUsed != 1000000*1024 {
+		t.Errorf("unexpected memory or disk of the server: %+v", node1)
+	}
+	if !node2.Reachable || node2.K3sService != "stopped" || node2.Readiness != ReadinessNotReady {
+		t.Errorf("unexpected status of the agent: %+v", node2)
+	}
+	if node3.Reachable || node3.Error == "" || node3.Readiness != ReadinessNotRegistered {
+		t.Errorf("expected k3-node3 to be unreachable and not registered: %+v", node3)
+	}
+
+	out := &bytes.Buffer{}
+	if err := status.Write(out, StatusFormatWide); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"HOSTNAME  ADDRESS", "k3-node1  10.0.0.1", "3d4h", "0.52 0.38 0.31", "414 MiB/926 MiB", "48.3'C", "unreachable", "\nk3-node3: "} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in:\n%s", expected, out)
+		}
+	}
+
+	out.Reset()
+	if err := status.Write(out, StatusFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"uptime_seconds": 273600`) {
+		t.Errorf("expected the uptime in seconds in:\n%s", out)
+	}
+
+	server.Close()
+	status = Status(context.Background(), args)
+	if status.ReadinessError == "" || status.Nodes[1].Readiness != ReadinessUnknown {
+		t.Errorf("expected the readiness to be unknown without the server: %+v", status)
+	}
+}
@@ -28,7 +28,8 @@ import (
 	"github.com/TheNatureOfSoftware/k3pi/pkg"
 	"github.com/kubernetes-sigs/yaml"
 	"io/ioutil"
-	"log"
+	"reflect"
+	"strings"
 	"text/template"
 )
 
@@ -43,7 +44,7 @@ k3os:
   - "--disable-agent"
   - "--bind-address"
   - "{{.Node.Address}}"
-  token: myclustersecret
+  token: {{.GetToken}}
   password: rancher
   dns_nameservers:
   - 8.8.8.8
@@ -64,7 +65,7 @@ k3os:
   - "--node-ip"
   - "{{.Node.Address}}"
   server_url: https://{{.ServerIP}}:6443
-  token: myclustersecret
+  token: {{.GetToken}}
   password: rancher
   dns_nameservers:
   - 8.8.8.8
@@ -87,17 +88,20 @@ type K3os struct {
 	Environment map[string]string `json:"environment,omitempty"`
 }
 
-func (c *CloudConfig) LoadFromFile(filename string) *CloudConfig {
-	yamlFile, _ := ioutil.ReadFile(filename)
+func (c *CloudConfig) LoadFromFile(filename string) (*CloudConfig, error) {
+	yamlFile, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
 	return c.LoadFromBytes(yamlFile)
 }
 
-func (c *CloudConfig) LoadFromBytes(content []byte) *CloudConfig {
+func (c *CloudConfig) LoadFromBytes(content []byte) (*CloudConfig, error) {
 	err := yaml.Unmarshal(content, c)
 	if err != nil {
-		log.Fatalf("%s", err)
+		return nil, fmt.Errorf("failed to parse cloud-config: %w", err)
 	}
-	return c
+	return c, nil
 }
 
 func NewServerConfig(configTmpl string, target *pkg.Target) (*[]byte, error) {
@@ -120,16 +124,186 @@ func generateConfig(configTmpl string, target *pkg.Target) (*[]byte, error) {
 
 	tmpl, err := template.New("cloud-config").Parse(configTmpl)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse cloud-config template: %d", err)
+		return nil, fmt.Errorf("failed to parse cloud-config template: %w", err)
 	}
 
 	var b bytes.Buffer
 	wr := bufio.NewWriter(&b)
 	err = tmpl.Execute(wr, target)
 	if err != nil {
-		return nil, fmt.Errorf("failed to apply template to target %s: %v", target.Node.Address, err)
+		return nil, fmt.Errorf("failed to apply template to target %s: %w", target.Node.Address, err)
 	}
 	wr.Flush()
 	configAsBytes := b.Bytes()
+	if len(target.ConfigOverrides) > 0 {
+		if configAsBytes, err = Merge(configAsBytes, target.ConfigOverrides); err != nil {
+			return nil, err
+		}
+	}
 	return &configAsBytes, nil
 }
+
+// Merges overrides into the cloud-config in content. Maps are merged key by
+// key, any other value replaces the value in content.
+func Merge(content []byte, overrides map[string]interface{}) ([]byte, error) {
+	values := make(map[string]interface{})
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return nil, fmt.Errorf("failed to parse cloud-config: %w", err)
+	}
+	return yaml.Marshal(MergeValues(values, overrides))
+}
+
+// Returns a copy of values with overrides merged in, maps are merged key by
+// key and other values are replaced.
+func MergeValues(values, overrides map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(values)+len(overrides))
+	for key, value := range values {
+		merged[key] = value
+	}
+	for key, override := range overrides {
+		existing, ok := merged[key].(map[string]interface{})
+		if overrideMap, isMap := override.(map[string]interface{}); ok && isMap {
+			merged[key] = MergeValues(existing, overrideMap)
+		} else {
+			merged[key] = override
+		}
+	}
+	return merged
+}
+
+// Returns true if both cloud-configs have the same values, formatting and
+// key order are ignored.
+func Equal(a, b []byte) (bool, error) {
+	var va, vb interface{}
+	if err := yaml.Unmarshal(a, &va); err != nil {
+		return false, fmt.Errorf("failed to parse cloud-config: %w", err)
+	}
+	if err := yaml.Unmarshal(b, &vb); err != nil {
+		return false, fmt.Errorf("failed to parse cloud-config: %w", err)
+	}
+	return reflect.DeepEqual(va, vb), nil
+}
+
+// Removes the key remove from and adds the key add to the ssh_authorized_keys
+// of the cloud-config in content, an empty key is ignored.
+func ReplaceAuthorizedKey(content []byte, remove, add string) ([]byte, error) {
+	values := make(map[string]interface{})
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return nil, fmt.Errorf("failed to parse cloud-config: %w", err)
+	}
+
+	var keys []interface{}
+	existing, _ := values["ssh_authorized_keys"].([]interface{})
+	for _, key := range existing {
+		if s, ok := key.(string); ok && (SameAuthorizedKey(s, remove) || SameAuthorizedKey(s, add)) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if add != "" {
+		keys = append(keys, add)
+	}
+	values["ssh_authorized_keys"] = keys
+
+	return yaml.Marshal(values)
+}
+
+// Returns true if both keys have the same type and key, comments and options
+// are ignored.
+func SameAuthorizedKey(a, b string) bool {
+	keyFields := func(key string) string {
+		fields := strings.Fields(key)
+		for i := 0; i+1 < len(fields); i++ {
+			if strings.HasPrefix(fields[i], "ssh-") || strings.HasPrefix(fields[i], "ecdsa-") || strings.HasPrefix(fields[i], "sk-") {
+				return fields[i] + " " + fields[i+1]
+			}
+		}
+		return ""
+	}
+	ka := keyFields(a)
+	return ka != "" && ka == keyFields(b)
+}
+
+// Returns the lines removed from current, prefixed with "- ", and added in
+// desired, prefixed with "+ ", with context lines around each change. Empty
+// if both are the same.
+func Diff(current, desired string) string {
+	a := strings.Split(strings.TrimSuffix(current, "\n"), "\n")
+	b := strings.Split(strings.TrimSuffix(desired, "\n"), "\n")
+
+	// Length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type line struct {
+		op   byte
+		text string
+	}
+	var lines []line
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, line{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, line{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, line{'+', b[j]})
+			j++
+		}
+	}
+
+	const context = 2
+	var out strings.Builder
+	printed := -1
+	for k := 0; k < len(lines); k++ {
+		if lines[k].op == ' ' {
+			continue
+		}
+		from := k - context
+		if from < printed+1 {
+			from = printed + 1
+		} else if from > printed+1 {
+			out.WriteString("...\n")
+		}
+		// Changes closer than twice the context share one hunk.
+		to := k
+		for n := k; n < len(lines) && n <= to+2*context; n++ {
+			if lines[n].op != ' ' {
+				to = n
+			}
+		}
+		end := to + context
+		if end >= len(lines) {
+			end = len(lines) - 1
+		}
+		for n := from; n <= end; n++ {
+			out.WriteByte(lines[n].op)
+			out.WriteByte(' ')
+			out.WriteString(lines[n].text)
+			out.WriteByte('\n')
+		}
+		printed = end
+		k = end
+	}
+	if printed >= 0 && printed < len(lines)-1 {
+		out.WriteString("...\n")
+	}
+	return out.String()
+}
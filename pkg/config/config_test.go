@@ -24,8 +24,8 @@ package config
 import (
 	"fmt"
 	"github.com/TheNatureOfSoftware/k3pi/pkg"
-	"github.com/TheNatureOfSoftware/k3pi/pkg/misc"
 	"github.com/kubernetes-sigs/yaml"
+	"strings"
 	"testing"
 )
 
@@ -59,7 +59,9 @@ k3os:
 
 func TestCloudConfig_LoadFrom(t *testing.T) {
 	cloudConfig := &CloudConfig{}
-	cloudConfig.LoadFromBytes([]byte(cloudConfigYaml))
+	if _, err := cloudConfig.LoadFromBytes([]byte(cloudConfigYaml)); err != nil {
+		t.Fatal(err)
+	}
 
 	if cloudConfig.Hostname != "pi" {
 		t.Fail()
@@ -117,7 +119,9 @@ func TestNewServerConfig(t *testing.T) {
 
 	// This is what we got
 	actual := CloudConfig{}
-	actual.LoadFromBytes(*configAsBytes)
+	if _, err := actual.LoadFromBytes(*configAsBytes); err != nil {
+		t.Fatal(err)
+	}
 
 	wantAsYaml := marshalToString(want)
 	actualAsYaml := marshalToString(actual)
@@ -139,18 +143,72 @@ auth:
 
 	node := &pkg.Node{}
 	err := yaml.Unmarshal([]byte(nodeYaml), node)
-	misc.PanicOnError(err, "failed to unmarshal node")
+	if err != nil {
+		t.Fatal(err)
+	}
 	serverIp := "127.0.0.2"
 	configAsBytes, err := NewAgentConfig("", &pkg.Target{
 		SSHAuthorizedKeys: []string{"github:foobar"},
 		Node:              node,
 		ServerIP:          serverIp,
 	})
-	misc.PanicOnError(err, "failed to create agent config")
+	if err != nil {
+		t.Fatal(err)
+	}
 	fmt.Println(string(*configAsBytes))
 }
 
+func TestCloudConfig_LoadFromBytes_Invalid(t *testing.T) {
+	_, err := (&CloudConfig{}).LoadFromBytes([]byte("hostname: [pi"))
+	if err == nil {
+		t.Error("expected parse error")
+	}
+}
+
 func marshalToString(o interface{}) string {
 	bytes, _ := yaml.Marshal(o)
 	return string(bytes)
 }
+
+func TestReplaceAuthorizedKey(t *testing.T) {
+	b, err := ReplaceAuthorizedKey([]byte(cloudConfigYaml), "ssh-rsa AAAAB3NzaC1yc2EAAAADAQAB old@k3pi", "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cloudConfig, err := (&CloudConfig{}).LoadFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"github:tnos", "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5"}
+	if fmt.Sprint(cloudConfig.SshAuthorizedKeys) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, actual: %v", expected, cloudConfig.SshAuthorizedKeys)
+	}
+	if cloudConfig.Hostname != "pi" || len(cloudConfig.K3os.K3sArgs) != 2 {
+		t.Errorf("expected the rest of the config to be kept: %s", b)
+	}
+}
+
+func TestNewAgentConfig_Token(t *testing.T) {
+	target := &pkg.Target{Node: &pkg.Node{Hostname: "k3s-agent", Address: "127.0.0.1"}, ServerIP: "127.0.0.2", Token: "K10secret"}
+	configAsBytes, err := NewAgentConfig("", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(*configAsBytes), "  token: K10secret\n") {
+		t.Errorf("expected token K10secret, actual:\n%s", *configAsBytes)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	current := "hostname: black-pearl\na: 1\nb: 2\nc: 3\nd: 4\ne: 5\nf: 6\ng: 7\n"
+	desired := "hostname: k3-node1\na: 1\nb: 2\nc: 3\nd: 4\ne: 5\nf: 6\ng: 8\n"
+
+	want := "- hostname: black-pearl\n+ hostname: k3-node1\n  a: 1\n  b: 2\n...\n  e: 5\n  f: 6\n- g: 7\n+ g: 8\n"
+	if actual := Diff(current, desired); actual != want {
+		t.Errorf("wanted:\n%s\nactual:\n%s", want, actual)
+	}
+	if actual := Diff(current, current); actual != "" {
+		t.Errorf("expected no diff, actual:\n%s", actual)
+	}
+}
@@ -0,0 +1,54 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package pkg
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by k3pi, test for them with errors.Is.
+var (
+	// The node rejected the credentials.
+	ErrAuthFailed = errors.New("authentication failed")
+	// The node architecture has no k3os image.
+	ErrUnsupportedArch = errors.New("unsupported architecture")
+	// A file does not match its checksum.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// An operation did not complete in time.
+	ErrTimeout = errors.New("timeout")
+)
+
+// An error from an operation on a node, use errors.As to find the node.
+type NodeError struct {
+	Address string
+	Op      string
+	Err     error
+}
+
+func (e *NodeError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Address, e.Err)
+}
+
+func (e *NodeError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,234 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+// Package inventory keeps what k3pi knows about each cluster in a directory
+// of its own.
+package inventory
+
+import (
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/kubernetes-sigs/yaml"
+	"github.com/mitchellh/go-homedir"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultStateDir = "~/.k3pi/clusters"
+	DefaultCluster  = "default"
+
+	keyFile        = "id_ed25519"
+	pendingKeyFile = "id_ed25519.new"
+	inventoryFile  = "inventory.yaml"
+	kubeconfigFile = "kubeconfig.yaml"
+	stateFile      = "state.yaml"
+
+	// Max number of events kept in the history.
+	maxHistory = 100
+)
+
+// The directory of a named cluster, created when first written to.
+type Cluster struct {
+	Name string
+	Dir  string
+}
+
+// Returns the cluster name in stateDir.
+func Open(stateDir, name string) (*Cluster, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("invalid cluster name %q", name)
+	}
+	dir, err := homedir.Expand(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	return &Cluster{Name: name, Dir: filepath.Join(dir, name)}, nil
+}
+
+// Path of the private key the rancher user logs in with.
+func (c *Cluster) KeyPath() string {
+	return filepath.Join(c.Dir, keyFile)
+}
+
+// Path of the key a rotation is moving the nodes to.
+func (c *Cluster) PendingKeyPath() string {
+	return filepath.Join(c.Dir, pendingKeyFile)
+}
+
+// Returns the cluster and pending keys that exist, a node is reachable with
+// one of them also while a rotation is incomplete.
+func (c *Cluster) KeyPaths() []string {
+	var paths []string
+	for _, path := range []string{c.KeyPath(), c.PendingKeyPath()} {
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// Path of the kubeconfig copied from the server.
+func (c *Cluster) KubeconfigPath() string {
+	return filepath.Join(c.Dir, kubeconfigFile)
+}
+
+// Path of the install progress of each node.
+func (c *Cluster) StatePath() string {
+	return filepath.Join(c.Dir, stateFile)
+}
+
+// Path of the inventory.
+func (c *Cluster) InventoryPath() string {
+	return filepath.Join(c.Dir, inventoryFile)
+}
+
+// Creates the cluster directory.
+func (c *Cluster) Init() error {
+	return os.MkdirAll(c.Dir, 0700)
+}
+
+// An installed node and its role in the cluster, server or agent.
+type Node struct {
+	pkg.Node
+	Role string `json:"role"`
+}
+
+// Versions the cluster was installed with.
+type Versions struct {
+	K3os string `json:"k3os,omitempty"`
+	K3pi string `json:"k3pi,omitempty"`
+}
+
+// A command run against the cluster.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	Nodes   []string  `json:"nodes,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// What k3pi knows about a cluster.
+type Inventory struct {
+	Name string `json:"name"`
+	// Address of the server.
+	Server   string   `json:"server,omitempty"`
+	Token    string   `json:"token,omitempty"`
+	Versions Versions `json:"versions"`
+	Nodes    []*Node  `json:"nodes,omitempty"`
+	History  []Event  `json:"history,omitempty"`
+}
+
+// Loads the inventory, empty if the cluster has none.
+func (c *Cluster) Load() (*Inventory, error) {
+	inv := &Inventory{Name: c.Name}
+	b, err := ioutil.ReadFile(c.InventoryPath())
+	if os.IsNotExist(err) {
+		return inv, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(b, inv); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", c.InventoryPath(), err)
+	}
+	return inv, nil
+}
+
+// Writes the inventory, readable by the owner only since it holds the token.
+func (c *Cluster) Save(inv *Inventory) error {
+	b, err := yaml.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	if err = c.Init(); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(c.Dir, ".k3pi-inventory-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.InventoryPath())
+}
+
+// Adds node or replaces the node with the same address. A password resolved
+// from a reference is not stored.
+func (inv *Inventory) SetNode(node *pkg.Node, role string) {
+	stored := &Node{Node: *node, Role: role}
+	if stored.Auth.HasPasswordRef() {
+		stored.Auth.Password = ""
+	}
+	for i, n := range inv.Nodes {
+		if n.Address == node.Address {
+			inv.Nodes[i] = stored
+			return
+		}
+	}
+	inv.Nodes = append(inv.Nodes, stored)
+}
+
+// Removes the node with address.
+func (inv *Inventory) RemoveNode(address string) {
+	for i, n := range inv.Nodes {
+		if n.Address == address {
+			inv.Nodes = append(inv.Nodes[:i], inv.Nodes[i+1:]...)
+			return
+		}
+	}
+}
+
+// Returns the node with address, nil if there is none.
+func (inv *Inventory) GetNode(address string) *Node {
+	for _, n := range inv.Nodes {
+		if n.Address == address {
+			return n
+		}
+	}
+	return nil
+}
+
+// Returns copies of the nodes without roles.
+func (inv *Inventory) NodeList() pkg.Nodes {
+	var nodes pkg.Nodes
+	for _, n := range inv.Nodes {
+		node := n.Node
+		nodes = append(nodes, &node)
+	}
+	return nodes
+}
+
+// Appends event to the history, dropping the oldest events.
+func (inv *Inventory) Record(event Event) {
+	inv.History = append(inv.History, event)
+	if len(inv.History) > maxHistory {
+		inv.History = inv.History[len(inv.History)-maxHistory:]
+	}
+}
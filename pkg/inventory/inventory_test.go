@@ -0,0 +1,101 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package inventory
+
+import (
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpen_Invalid_Name(t *testing.T) {
+	for _, name := range []string{"", "../x", "a/b", ".hidden"} {
+		if _, err := Open("/tmp", name); err == nil {
+			t.Errorf("expected %q to be invalid", name)
+		}
+	}
+}
+
+func TestCluster_Save_Load(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cluster, err := Open(dir, "pearl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err := cluster.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.Name != "pearl" || len(inv.Nodes) != 0 {
+		t.Fatalf("expected an empty inventory, got %+v", inv)
+	}
+
+	inv.Token = "secret"
+	inv.SetNode(&pkg.Node{Address: "10.0.0.1", Hostname: "k3s-server"}, "server")
+	inv.SetNode(&pkg.Node{Address: "10.0.0.2", Hostname: "k3s-agent", Auth: pkg.Auth{Password: "resolved", PasswordEnv: "PI_PASSWORD"}}, "agent")
+	inv.SetNode(&pkg.Node{Address: "10.0.0.2", Hostname: "k3s-agent-1", Auth: pkg.Auth{Password: "resolved", PasswordEnv: "PI_PASSWORD"}}, "agent")
+	for i := 0; i < maxHistory+1; i++ {
+		inv.Record(Event{Time: time.Now(), Command: "install"})
+	}
+	if err := cluster.Save(inv); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(cluster.InventoryPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, actual: %v", info.Mode().Perm())
+	}
+
+	loaded, err := cluster.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Token != "secret" || len(loaded.Nodes) != 2 || len(loaded.History) != maxHistory {
+		t.Fatalf("unexpected inventory %+v", loaded)
+	}
+	agent := loaded.GetNode("10.0.0.2")
+	if agent == nil || agent.Role != "agent" || agent.Hostname != "k3s-agent-1" {
+		t.Errorf("unexpected agent %+v", agent)
+	}
+	if agent.Auth.Password != "" || agent.Auth.PasswordEnv != "PI_PASSWORD" {
+		t.Errorf("expected the password reference without the password, got %+v", agent.Auth)
+	}
+
+	nodes := loaded.NodeList()
+	if len(nodes) != 2 || nodes[0].Address != "10.0.0.1" {
+		t.Errorf("unexpected nodes %v", nodes)
+	}
+	if filepath.Dir(cluster.KubeconfigPath()) != cluster.Dir {
+		t.Errorf("expected the kubeconfig in %s", cluster.Dir)
+	}
+}
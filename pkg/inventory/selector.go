@@ -0,0 +1,121 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package inventory
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// Picks nodes of the inventory, all conditions set must match.
+type Selector struct {
+	Role string
+	// An IP address or a CIDR.
+	Address string
+	// A glob matched against the hostname.
+	Hostname string
+	Arch     string
+}
+
+// Parses a selector like role=agent,hostname=k3-node*. A value without a key
+// is a hostname glob.
+func ParseSelector(s string) (*Selector, error) {
+	sel := &Selector{}
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		key, value := "hostname", term
+		if i := strings.Index(term, "="); i >= 0 {
+			key, value = term[:i], term[i+1:]
+		}
+		switch key {
+		case "role":
+			if value != "server" && value != "agent" {
+				return nil, fmt.Errorf("invalid selector %q, role must be server or agent", s)
+			}
+			sel.Role = value
+		case "address":
+			if net.ParseIP(value) == nil {
+				if _, _, err := net.ParseCIDR(value); err != nil {
+					return nil, fmt.Errorf("invalid selector %q, address must be an IP or a CIDR", s)
+				}
+			}
+			sel.Address = value
+		case "hostname":
+			if _, err := filepath.Match(value, ""); err != nil {
+				return nil, fmt.Errorf("invalid selector %q: %w", s, err)
+			}
+			sel.Hostname = value
+		case "arch":
+			sel.Arch = value
+		default:
+			return nil, fmt.Errorf("invalid selector %q, unknown key %s", s, key)
+		}
+	}
+	return sel, nil
+}
+
+// Returns true if node matches all conditions of the selector.
+func (sel *Selector) Matches(node *Node) bool {
+	if sel.Role != "" && sel.Role != node.Role {
+		return false
+	}
+	if sel.Address != "" {
+		ip := net.ParseIP(node.Address)
+		if _, cidr, err := net.ParseCIDR(sel.Address); err == nil {
+			if ip == nil || !cidr.Contains(ip) {
+				return false
+			}
+		} else if sel.Address != node.Address {
+			return false
+		}
+	}
+	if sel.Hostname != "" {
+		if ok, _ := filepath.Match(sel.Hostname, node.Hostname); !ok {
+			return false
+		}
+	}
+	return sel.Arch == "" || sel.Arch == node.Arch
+}
+
+// Returns the nodes matching any of selectors, all nodes if there are no
+// selectors.
+func (inv *Inventory) Select(selectors []*Selector) []*Node {
+	var nodes []*Node
+	for _, n := range inv.Nodes {
+		matched := len(selectors) == 0
+		for _, sel := range selectors {
+			if sel.Matches(n) {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,89 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package inventory
+
+import (
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	sel, err := ParseSelector("role=agent, address=10.0.0.0/24,k3-node*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sel.Role != "agent" || sel.Address != "10.0.0.0/24" || sel.Hostname != "k3-node*" {
+		t.Errorf("unexpected selector: %+v", sel)
+	}
+
+	for _, s := range []string{"role=master", "address=10.0.0", "hostname=[", "zone=a"} {
+		if _, err := ParseSelector(s); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestInventory_Select(t *testing.T) {
+	inv := &Inventory{Nodes: []*Node{
+		{Node: pkg.Node{Hostname: "k3-node1", Address: "10.0.0.1", Arch: "aarch64"}, Role: "server"},
+		{Node: pkg.Node{Hostname: "k3-node2", Address: "10.0.0.2", Arch: "aarch64"}, Role: "agent"},
+		{Node: pkg.Node{Hostname: "k3-node3", Address: "10.0.1.3", Arch: "armv7l"}, Role: "agent"},
+	}}
+	parse := func(s ...string) []*Selector {
+		var selectors []*Selector
+		for _, v := range s {
+			sel, err := ParseSelector(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			selectors = append(selectors, sel)
+		}
+		return selectors
+	}
+
+	tests := []struct {
+		selectors []*Selector
+		expected  []string
+	}{
+		{nil, []string{"k3-node1", "k3-node2", "k3-node3"}},
+		{parse("role=agent"), []string{"k3-node2", "k3-node3"}},
+		{parse("role=agent,address=10.0.0.0/24"), []string{"k3-node2"}},
+		{parse("arch=armv7l", "address=10.0.0.1"), []string{"k3-node1", "k3-node3"}},
+		{parse("k3-node[12]"), []string{"k3-node1", "k3-node2"}},
+		{parse("hostname=pi-*"), nil},
+	}
+	for _, test := range tests {
+		var actual []string
+		for _, n := range inv.Select(test.selectors) {
+			actual = append(actual, n.Hostname)
+		}
+		if len(actual) != len(test.expected) {
+			t.Errorf("expected %v, actual %v", test.expected, actual)
+			continue
+		}
+		for i := range actual {
+			if actual[i] != test.expected[i] {
+				t.Errorf("expected %v, actual %v", test.expected, actual)
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// Levelled logger, lines are prefixed with the node when logging for a node.
+// A logger is safe for concurrent use, loggers created with WithNode share the
+// output with their parent so lines never interleave.
+type Logger struct {
+	out    io.Writer
+	level  Level
+	format string
+	node   string
+	mu     *sync.Mutex
+}
+
+// Creates a logger writing messages at level and above to out in format.
+func New(out io.Writer, level Level, format string) *Logger {
+	return &Logger{out: out, level: level, format: format, mu: &sync.Mutex{}}
+}
+
+var (
+	defaultLogger = New(os.Stderr, LevelInfo, FormatText)
+	logDir        string
+)
+
+// Returns the logger used by the package level functions.
+func Default() *Logger {
+	return defaultLogger
+}
+
+func SetDefault(logger *Logger) {
+	defaultLogger = logger
+}
+
+// Returns a logger that prefixes all lines with node.
+func (l *Logger) WithNode(node string) *Logger {
+	c := *l
+	c.node = node
+	return &c
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Returns true when progress output meant for a terminal should be shown.
+func (l *Logger) Interactive() bool {
+	return l.format == FormatText && l.Enabled(LevelInfo)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(LevelDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(LevelWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, format, args...)
+}
+
+type jsonLine struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Node    string `json:"node,omitempty"`
+	Message string `json:"msg"`
+}
+
+func (l *Logger) log(level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	message := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+
+	var line string
+	if l.format == FormatJSON {
+		b, _ := json.Marshal(jsonLine{
+			Time:    time.Now().Format(time.RFC3339),
+			Level:   level.String(),
+			Node:    l.node,
+			Message: message,
+		})
+		line = string(b)
+	} else {
+		var prefix string
+		if level != LevelInfo {
+			prefix = strings.ToUpper(level.String()) + " "
+		}
+		if l.node != "" {
+			prefix += fmt.Sprintf("[%s] ", l.node)
+		}
+		line = prefix + strings.Replace(message, "\n", "\n"+prefix, -1)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = fmt.Fprintln(l.out, line)
+}
+
+func Debugf(format string, args ...interface{}) {
+	defaultLogger.Debugf(format, args...)
+}
+
+func Infof(format string, args ...interface{}) {
+	defaultLogger.Infof(format, args...)
+}
+
+func Warnf(format string, args ...interface{}) {
+	defaultLogger.Warnf(format, args...)
+}
+
+func Errorf(format string, args ...interface{}) {
+	defaultLogger.Errorf(format, args...)
+}
+
+// Sets the directory where NodeOutput creates the per node log files, an
+// empty dir disables the log files.
+func SetLogDir(dir string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	logDir = dir
+	return nil
+}
+
+// Opens the log file for node in the log directory for appending. Without a
+// log directory all output is discarded.
+func NodeOutput(node string) (io.WriteCloser, error) {
+	if logDir == "" {
+		return nopCloser{ioutil.Discard}, nil
+	}
+	filename := filepath.Join(logDir, fmt.Sprintf("%s.log", strings.Replace(node, string(os.PathSeparator), "_", -1)))
+	return os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogger_Levels(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := New(out, LevelWarn, FormatText)
+
+	logger.Debugf("debug")
+	logger.Infof("info")
+	logger.Warnf("warn")
+	logger.Errorf("error")
+
+	expected := "WARN warn\nERROR error\n"
+	if actual := out.String(); actual != expected {
+		t.Errorf("expected: %q, actual: %q", expected, actual)
+	}
+}
+
+func TestLogger_WithNode(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := New(out, LevelInfo, FormatText).WithNode("k3-node1")
+
+	logger.Infof("line 1\nline 2")
+
+	expected := "[k3-node1] line 1\n[k3-node1] line 2\n"
+	if actual := out.String(); actual != expected {
+		t.Errorf("expected: %q, actual: %q", expected, actual)
+	}
+}
+
+func TestLogger_JSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := New(out, LevelInfo, FormatJSON).WithNode("k3-node1")
+
+	logger.Errorf("failed: %s", "tar")
+
+	line := &jsonLine{}
+	if err := json.Unmarshal(out.Bytes(), line); err != nil {
+		t.Fatal(err)
+	}
+
+	if line.Level != "error" || line.Node != "k3-node1" || line.Message != "failed: tar" {
+		t.Errorf("unexpected log line: %s", out.String())
+	}
+}
+
+func TestNodeOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k3pi-logs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = SetLogDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer SetLogDir("")
+
+	for _, line := range []string{"first\n", "second\n"} {
+		out, err := NodeOutput("k3-node1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = out.Write([]byte(line))
+		_ = out.Close()
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "k3-node1.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := strings.TrimSpace(string(b)); actual != "first\nsecond" {
+		t.Errorf("unexpected log file content: %q", actual)
+	}
+}
@@ -25,10 +25,11 @@ import (
 	"bufio"
 	"crypto/sha256"
 	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/logging"
 	"github.com/dustin/go-humanize"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -50,6 +51,9 @@ func (wc *WriteCounter) Write(p []byte) (int, error) {
 }
 
 func (wc WriteCounter) PrintProgress() {
+	if !logging.Default().Interactive() {
+		return
+	}
 	fmt.Printf("\r%s", strings.Repeat(" ", 35))
 	fmt.Printf("\rDownloading... %s complete", humanize.Bytes(wc.Total))
 }
@@ -109,11 +113,11 @@ func DownloadAndVerify(download FileDownload) error {
 
 	calcSHA256, err := CalculateSHA256(download.Filename)
 	if err != nil {
-		return fmt.Errorf("failed to calculate check sum: %v", err)
+		return fmt.Errorf("failed to calculate check sum: %w", err)
 	}
 
 	if !strings.Contains(allValidCheckSums, calcSHA256) {
-		return fmt.Errorf("%s check sum is not valid for %s", calcSHA256, download.Filename)
+		return fmt.Errorf("%s check sum is not valid for %s: %w", calcSHA256, download.Filename, pkg.ErrChecksumMismatch)
 	}
 
 	return nil
@@ -130,7 +134,7 @@ func CalculateSHA256(filename string) (string, error) {
 
 	hash := sha256.New()
 	if _, err := io.Copy(hash, input); err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 	sum := hash.Sum(nil)
 
@@ -22,7 +22,6 @@ THE SOFTWARE.
 package misc
 
 import (
-	"fmt"
 	"github.com/pkg/errors"
 	"io/ioutil"
 	"os"
@@ -34,49 +33,22 @@ func DataPipedIn() bool {
 	return (stat.Mode() & os.ModeCharDevice) == 0
 }
 
-func PanicOnError(err error, message string) {
+// Returns the name of a file in dir that does not exist, created from pattern.
+func CreateTempFileName(dir string, pattern string) (string, error) {
+	dirPath, err := filepath.Abs(dir)
 	if err != nil {
-		panic(errors.Wrap(err, message))
+		return "", errors.Wrap(err, "failed to resolve abs path")
 	}
-}
-
-func ExitOnError(err error, message ...string) {
+	f, err := ioutil.TempFile(dirPath, pattern)
 	if err != nil {
-		if len(message) > 0 {
-			ErrorExitWithError(errors.Wrap(err, message[0]))
-		} else {
-			ErrorExitWithError(err)
-		}
+		return "", errors.Wrap(err, "failed to create temp file")
 	}
-}
-
-func Info(message string) {
-	fmt.Printf("%s\n", message)
-}
-
-func ErrorExitWithMessage(message string) {
-	fmt.Printf("Error: %s\n", message)
-	os.Exit(1)
-}
-
-func ErrorExitWithError(err error) {
-	fmt.Printf("Error: %s\n", err)
-	os.Exit(1)
-}
-
-func CreateTempFileName(dir string, pattern string) string {
-	dirPath, err := filepath.Abs(dir)
-	PanicOnError(err, "failed to resolve abs path")
-
-	f, err := ioutil.TempFile(dirPath, pattern)
-	PanicOnError(err, "failed to create temp file")
-
 	fn := f.Name()
-	err = f.Close()
-	PanicOnError(err, "failed to close temp file")
-
-	err = os.Remove(fn)
-	PanicOnError(err, "failed to remove temp file")
-
-	return fn
+	if err = f.Close(); err != nil {
+		return "", errors.Wrap(err, "failed to close temp file")
+	}
+	if err = os.Remove(fn); err != nil {
+		return "", errors.Wrap(err, "failed to remove temp file")
+	}
+	return fn, nil
 }
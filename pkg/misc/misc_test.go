@@ -22,19 +22,53 @@ THE SOFTWARE.
 package misc
 
 import (
+	"errors"
 	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
-func TestCheckError_Should_Panic_On_Error(t *testing.T) {
-	defer func() {
-		r := recover()
-		if r == nil {
-			t.Errorf("The code did not panic")
-		} else {
-			fmt.Printf("%v\n", r)
-		}
-	}()
-
-	PanicOnError(fmt.Errorf("a wrapped error"), "wrapping error")
+func TestDownloadAndVerify_ChecksumMismatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "content of %s", r.URL.Path)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = DownloadAndVerify(FileDownload{
+		Filename:         filepath.Join(dir, "image"),
+		CheckSumFilename: filepath.Join(dir, "sha256sum.txt"),
+		Url:              server.URL + "/image",
+		CheckSumUrl:      server.URL + "/sha256sum.txt",
+	})
+
+	if !errors.Is(err, pkg.ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch, got: %v", err)
+	}
+}
+
+func TestCreateTempFileName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn, err := CreateTempFileName(dir, "k3s-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Errorf("expected %s to not exist", fn)
+	}
 }
@@ -22,9 +22,11 @@ THE SOFTWARE.
 package misc
 
 import (
+	"context"
 	"fmt"
 	"github.com/TheNatureOfSoftware/k3pi/pkg"
 	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"io/ioutil"
 	"net"
 	"os/exec"
 	"time"
@@ -48,7 +50,7 @@ func hosts(cidr string) ([]string, error) {
 	}
 }
 
-//  http://play.golang.org/p/m8TNTtygK0
+// http://play.golang.org/p/m8TNTtygK0
 func inc(ip net.IP) {
 	for j := len(ip) - 1; j >= 0; j-- {
 		ip[j]++
@@ -123,50 +125,91 @@ func (h *hostScanner) ScanForAliveHosts(cidr string) (*[]string, error) {
 	return &aliveHosts, nil
 }
 
-func WaitForNode(node *pkg.Node, sshSettings *ssh.Settings, timeout time.Duration) error {
-
-	resolvedSSHSettings := resolveSSHSettings(sshSettings)
-
-	clientConfig, sshAgentCloseHandler, err := ssh.NewClientConfig(resolveSSHSettings(sshSettings))
-	PanicOnError(err, "failed to create ssh agent")
-	defer sshAgentCloseHandler()
-
-	ctx := &pkg.CmdOperatorCtx{
-		Address:         fmt.Sprintf("%s:%s", node.Address, resolvedSSHSettings.Port),
-		SSHClientConfig: clientConfig,
-		EnableStdOut:    false,
+// Waits until the node accepts ssh connections on its k3os port, or on the
+// port of sshSettings when given. Stops waiting when ctx is cancelled.
+func WaitForNode(ctx context.Context, node *pkg.Node, sshSettings *ssh.Settings, timeout time.Duration) error {
+	operatorCtx, closeSSHAgent, err := k3osCmdOperatorCtx(node, sshSettings)
+	if err != nil {
+		return err
 	}
+	defer closeSSHAgent()
 
-	timeToStop := time.Now().Add(timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 	for {
-		_, err := ssh.NewCmdOperator(ctx)
+		operator, err := ssh.NewCmdOperator(operatorCtx)
 		if err == nil {
-			break
-		} else if time.Now().After(timeToStop) {
-			return fmt.Errorf("timeout waiting for node: %s", node.Address)
+			_ = operator.Close()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("%w: %v", pkg.ErrTimeout, err)
+			} else {
+				err = fmt.Errorf("%v: %v", ctx.Err(), err)
+			}
+			return &pkg.NodeError{Address: node.Address, Op: "wait for", Err: err}
+		case <-time.After(time.Second * 2):
 		}
-		time.Sleep(time.Second * 2)
 	}
-
-	return nil
 }
 
-func resolveSSHSettings(sshSettings *ssh.Settings) *ssh.Settings {
+// Returns sshSettings or, if nil, the settings for the rancher user on k3os.
+func ResolveSSHSettings(sshSettings *ssh.Settings) *ssh.Settings {
 	if sshSettings != nil {
 		return sshSettings
 	}
+	return RancherSSHSettings()
+}
+
+// Returns the settings for the rancher user on k3os, keyPaths are tried before
+// ~/.ssh/id_rsa. The port is left to the node.
+func RancherSSHSettings(keyPaths ...string) *ssh.Settings {
 	return &ssh.Settings{
-		User:    "rancher",
-		KeyPath: "~/.ssh/id_rsa",
-		Port:    "22",
+		User:     "rancher",
+		KeyPaths: append(keyPaths, "~/.ssh/id_rsa"),
+	}
+}
+
+// Returns the context for connecting to node once it runs k3os.
+func k3osCmdOperatorCtx(node *pkg.Node, sshSettings *ssh.Settings) (*pkg.CmdOperatorCtx, func() error, error) {
+	address := node.K3osSSHAddress()
+	if sshSettings != nil && sshSettings.Port != "" {
+		address = net.JoinHostPort(node.Address, sshSettings.Port)
 	}
+
+	clientConfig, closeSSHAgent, err := ssh.NewClientConfig(ResolveSSHSettings(sshSettings))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &pkg.CmdOperatorCtx{
+		Address:         address,
+		SSHClientConfig: clientConfig,
+		EnableStdOut:    false,
+		JumpHost:        node.JumpHost,
+	}, closeSSHAgent, nil
 }
 
-func CopyKubeconfig(kubeconfigFile string, node *pkg.Node) error {
-	return exec.Command(
-		"scp",
-		"-o",
-		"StrictHostKeyChecking=no",
-		fmt.Sprintf("rancher@%s:/etc/rancher/k3s/k3s.yaml", node.Address),
-		kubeconfigFile).Run()
+// Fetches the kubeconfig of the k3s server running on node over ssh and
+// saves it to kubeconfigFile.
+func CopyKubeconfig(ctx context.Context, kubeconfigFile string, node *pkg.Node, sshSettings *ssh.Settings) error {
+	operatorCtx, closeSSHAgent, err := k3osCmdOperatorCtx(node, sshSettings)
+	if err != nil {
+		return err
+	}
+	defer closeSSHAgent()
+
+	operator, err := ssh.NewCmdOperator(operatorCtx)
+	if err != nil {
+		return err
+	}
+	defer operator.Close()
+
+	result, err := operator.ExecuteContext(ctx, "sudo cat /etc/rancher/k3s/k3s.yaml")
+	if err != nil {
+		return fmt.Errorf("failed to read kubeconfig from %s: %v", node, err)
+	}
+	return ioutil.WriteFile(kubeconfigFile, result.StdOut, 0600)
 }
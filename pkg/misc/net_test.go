@@ -22,9 +22,15 @@ THE SOFTWARE.
 package misc
 
 import (
+	"context"
+	"errors"
 	"github.com/TheNatureOfSoftware/k3pi/pkg"
 	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh/sshtest"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -58,34 +64,129 @@ func verifyNumOfHosts(want int, found int, t *testing.T) {
 }
 
 func TestWaitForNode(t *testing.T) {
-	t.Skip("manual test")
+	dir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath, err := sshtest.WriteKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pi := sshtest.NewPi("black-pearl")
+	pi.RebootDelay = time.Second
+	if err := pi.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pi.Close()
+	pi.Reboot()
+
 	node := &pkg.Node{
-		Address: "192.168.1.111",
+		Address: "127.0.0.1",
 	}
 	sshSettings := &ssh.Settings{
-		User:    "pirate",
-		KeyPath: "~/.ssh/id_rsa",
-		Port:    "22",
+		User:     "pirate",
+		KeyPaths: []string{keyPath},
+		Port:     pi.Port(),
 	}
-	err := WaitForNode(node, sshSettings, time.Second*10)
+	err = WaitForNode(context.Background(), node, sshSettings, time.Second*10)
 	if err != nil {
 		t.Error(err)
 	}
 }
 
+func TestWaitForNode_Timeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath, err := sshtest.WriteKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pi := sshtest.NewPi("black-pearl")
+	pi.RebootDelay = time.Minute
+	if err := pi.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pi.Close()
+	pi.Reboot()
+
+	sshSettings := &ssh.Settings{User: "pirate", KeyPaths: []string{keyPath}, Port: pi.Port()}
+	err = WaitForNode(context.Background(), &pkg.Node{Address: "127.0.0.1"}, sshSettings, time.Second)
+	if !errors.Is(err, pkg.ErrTimeout) {
+		t.Errorf("expected ErrTimeout, got: %v", err)
+	}
+}
+
+func TestWaitForNode_Cancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath, err := sshtest.WriteKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pi := sshtest.NewPi("black-pearl")
+	pi.RebootDelay = time.Minute
+	if err := pi.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pi.Close()
+	pi.Reboot()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(time.Second, cancel)
+	started := time.Now()
+	sshSettings := &ssh.Settings{User: "pirate", KeyPaths: []string{keyPath}, Port: pi.Port()}
+	err = WaitForNode(ctx, &pkg.Node{Address: "127.0.0.1"}, sshSettings, time.Minute)
+	if err == nil || errors.Is(err, pkg.ErrTimeout) {
+		t.Errorf("expected cancelled error, got: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second*10 {
+		t.Errorf("expected WaitForNode to stop when cancelled, took %s", elapsed)
+	}
+}
+
 func TestCopyKubeconfig(t *testing.T) {
-	//t.Skip("manual test")
+	dir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath, err := sshtest.WriteKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	node := &pkg.Node{
-		Address: "192.168.1.111",
+	pi := sshtest.NewPi("k3-node1")
+	if err := pi.Start(); err != nil {
+		t.Fatal(err)
 	}
+	defer pi.Close()
+	pi.SetFile("/etc/rancher/k3s/k3s.yaml", []byte("apiVersion: v1\nkind: Config\n"))
 
-	fn := CreateTempFileName("", "k3s-*.yaml")
-	defer os.RemoveAll(fn)
+	port, _ := strconv.Atoi(pi.Port())
+	node := &pkg.Node{
+		Address:  "127.0.0.1",
+		Port:     22,
+		K3osPort: port,
+	}
+	fn := filepath.Join(dir, "k3s.yaml")
 
-	err := CopyKubeconfig(fn, node)
+	err = CopyKubeconfig(context.Background(), fn, node, &ssh.Settings{User: "rancher", KeyPaths: []string{keyPath}})
 
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(fn); string(content) != "apiVersion: v1\nkind: Config\n" {
+		t.Errorf("unexpected kubeconfig: %q", content)
 	}
 }
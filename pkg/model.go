@@ -22,30 +22,62 @@ THE SOFTWARE.
 package pkg
 
 import (
+	"context"
 	"fmt"
 	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
-const ( ImageFilenameTmpl = "k3os-rootfs-%s.tar.gz" )
+const (
+	ImageFilenameTmpl = "k3os-rootfs-%s.tar.gz"
+)
 
 type SSHKeys []string
 
-// The stdin and stdout from executing a command.
+// The stdin and stdout from executing a command, output written before a
+// command failed is kept.
 type Result struct {
 	StdOut []byte
 	StdErr []byte
+	// Exit code of the remote command, -1 if it did not exit normally.
+	ExitCode int
+	Duration time.Duration
+}
+
+// Returns the exit code and the trimmed stderr, for use in error messages.
+func (r *Result) String() string {
+	return fmt.Sprintf("exit code %d, stderr: %s", r.ExitCode, strings.TrimSpace(string(r.StdErr)))
 }
 
 type CmdOperatorCtx struct {
 	Address         string
 	SSHClientConfig *ssh.ClientConfig
 	EnableStdOut    bool
+	// When set, the connection goes through this [user@]host[:port].
+	JumpHost string
+	// When set, receives every command with its complete stdout and stderr.
+	Log io.Writer
+	// When set, called with each line of output as soon as the command writes it.
+	OnLine func(line string, stderr bool)
 }
 
 type CmdOperator interface {
 	Close() error
 	Execute(command string) (*Result, error)
+	// Like Execute, the remote command is killed when ctx is done.
+	ExecuteContext(ctx context.Context, command string) (*Result, error)
+	// Copies size bytes from r to remotePath with mode, the transfer is
+	// aborted when ctx is done.
+	Copy(ctx context.Context, r io.Reader, remotePath string, size int64, mode os.FileMode) error
+	// Copies remotePath to the writer returned by create, called with the
+	// size and mode of the remote file. The transfer is aborted when ctx is
+	// done.
+	CopyFrom(ctx context.Context, remotePath string, create func(size int64, mode os.FileMode) (io.Writer, error)) error
 }
 
 type CmdOperatorFactory struct {
@@ -55,6 +87,12 @@ type CmdOperatorFactory struct {
 type Node struct {
 	Hostname string `json:"hostname"`
 	Address  string `json:"address"`
+	// SSH port before the install, 0 means 22.
+	Port int `json:"port,omitempty"`
+	// SSH port of k3os after the install, 0 means 22.
+	K3osPort int `json:"k3os_port,omitempty"`
+	// Optional [user@]host[:port] of a jump host to connect through.
+	JumpHost string `json:"jump_host,omitempty"`
 	Auth     Auth   `json:"auth"`
 	Arch     string `json:"arch"`
 }
@@ -74,6 +112,28 @@ func (n *Node) GetArch() string {
 	}
 }
 
+// Returns the hostname and address identifying the node.
+func (n *Node) String() string {
+	return fmt.Sprintf("%s (%s)", n.Hostname, n.Address)
+}
+
+// Returns host:port to connect to before the install.
+func (n *Node) SSHAddress() string {
+	return sshAddress(n.Address, n.Port)
+}
+
+// Returns host:port to connect to once the node runs k3os.
+func (n *Node) K3osSSHAddress() string {
+	return sshAddress(n.Address, n.K3osPort)
+}
+
+func sshAddress(address string, port int) string {
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(address, strconv.Itoa(port))
+}
+
 func (n *Node) GetTarget(sshAuthorizedKeys []string) *Target {
 	return &Target{
 		SSHAuthorizedKeys: sshAuthorizedKeys,
@@ -101,13 +161,50 @@ type Auth struct {
 	Type     string `json:"type"`
 	User     string `json:"user"`
 	Password string `json:"password,omitempty"`
-	SSHKey   string `json:"ssh_key,omitempty"`
+	// References to the password, see package secrets.
+	PasswordEnv    string `json:"password_env,omitempty"`
+	PasswordFile   string `json:"password_file,omitempty"`
+	PasswordSecret string `json:"password_secret,omitempty"`
+	SSHKey         string `json:"ssh_key,omitempty"`
+	// More keys to try, without any key only the ssh agent is used.
+	SSHKeys []string `json:"ssh_keys,omitempty"`
 }
 
+// Returns ssh_key followed by ssh_keys.
+func (a *Auth) GetSSHKeys() []string {
+	var keys []string
+	if a.SSHKey != "" {
+		keys = append(keys, a.SSHKey)
+	}
+	return append(keys, a.SSHKeys...)
+}
+
+// Returns true if the password is referenced instead of given.
+func (a *Auth) HasPasswordRef() bool {
+	return a.PasswordEnv != "" || a.PasswordFile != "" || a.PasswordSecret != ""
+}
+
+// Token of clusters installed without one.
+const DefaultToken = "myclustersecret"
+
 type Target struct {
 	SSHAuthorizedKeys []string
 	ServerIP          string
-	Node              *Node
+	// Token the server is created with and agents join with.
+	Token string
+	// Values merged into the generated k3os config.
+	ConfigOverrides map[string]interface{}
+	// k3os config installed instead of the generated config, from a saved
+	// plan.
+	Config []byte
+	Node   *Node
+}
+
+func (target *Target) GetToken() string {
+	if target.Token == "" {
+		return DefaultToken
+	}
+	return target.Token
 }
 
 func (target *Target) GetImageFilename() string {
@@ -120,6 +217,12 @@ func (target *Target) GetImageFilePath(resourceDir string) string {
 
 type Targets []*Target
 
+func (targets *Targets) SetToken(token string) {
+	for _, target := range *targets {
+		target.Token = token
+	}
+}
+
 func (targets *Targets) SetServerIP(serverIP string) {
 	for _, target := range *targets {
 		target.ServerIP = serverIP
@@ -135,7 +238,9 @@ func (nodes *Nodes) Targets(sshAuthorizedKeys []string) Targets {
 }
 
 type Installer interface {
-	Install() error
+	// Installs k3os, in-flight operations are aborted when ctx is done.
+	Install(ctx context.Context) error
+	GetTarget() *Target
 }
 
 type Installers []Installer
@@ -144,6 +249,47 @@ type InstallTask struct {
 	DryRun bool
 	Server *Target
 	Agents Targets
+	// Creates the operators of the installers, when nil operators connect
+	// over ssh or record their steps in a dry run.
+	OperatorFactory *CmdOperatorFactory
+}
+
+// Install progress of a node, phases are completed in the order of Phases.
+type Phase string
+
+const (
+	PhaseNone       Phase = ""
+	PhaseConnected  Phase = "connected"
+	PhaseUploaded   Phase = "uploaded"
+	PhaseVerified   Phase = "verified"
+	PhaseExtracted  Phase = "extracted"
+	PhaseConfigured Phase = "configured"
+	PhaseRebooted   Phase = "rebooted"
+	PhaseJoined     Phase = "joined"
+)
+
+var Phases = []Phase{
+	PhaseConnected,
+	PhaseUploaded,
+	PhaseVerified,
+	PhaseExtracted,
+	PhaseConfigured,
+	PhaseRebooted,
+	PhaseJoined,
+}
+
+// Returns the position of the phase in Phases, PhaseNone is -1.
+func (p Phase) Index() int {
+	for i, phase := range Phases {
+		if phase == p {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p Phase) Before(other Phase) bool {
+	return p.Index() < other.Index()
 }
 
 type HostnameSpec struct {
@@ -132,3 +132,37 @@ func TestTargets_SetServerIP(t *testing.T) {
 		}
 	}
 }
+
+func TestPhase_Before(t *testing.T) {
+	if !PhaseNone.Before(PhaseConnected) {
+		t.Error("expected none before connected")
+	}
+
+	if !PhaseUploaded.Before(PhaseJoined) {
+		t.Error("expected uploaded before joined")
+	}
+
+	if PhaseRebooted.Before(PhaseExtracted) {
+		t.Error("expected rebooted after extracted")
+	}
+}
+
+func TestResult_String(t *testing.T) {
+	result := &Result{StdErr: []byte("tar: write error\n"), ExitCode: 2}
+
+	expected := "exit code 2, stderr: tar: write error"
+	if actual := result.String(); actual != expected {
+		t.Errorf(msg, expected, actual)
+	}
+}
+
+func TestNode_SSHAddress(t *testing.T) {
+	node := &Node{Address: "192.168.1.10", Port: 2222}
+
+	if actual := node.SSHAddress(); actual != "192.168.1.10:2222" {
+		t.Errorf("expected 192.168.1.10:2222, actual: %s", actual)
+	}
+	if actual := node.K3osSSHAddress(); actual != "192.168.1.10:22" {
+		t.Errorf("expected 192.168.1.10:22, actual: %s", actual)
+	}
+}
@@ -0,0 +1,361 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package replay records the sessions of real nodes to a cassette file and
+// serves the recorded responses back in tests and bug reports.
+package replay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/kubernetes-sigs/yaml"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	KindConnect = "connect"
+	KindCommand = "command"
+	KindCopy    = "copy"
+	// A copy from the node, the content of the file is kept in stdout.
+	KindDownload = "download"
+)
+
+// Sentinel errors that survive a round trip through a cassette.
+var errorTypes = map[string]error{
+	"auth_failed":       pkg.ErrAuthFailed,
+	"unsupported_arch":  pkg.ErrUnsupportedArch,
+	"checksum_mismatch": pkg.ErrChecksumMismatch,
+	"timeout":           pkg.ErrTimeout,
+}
+
+// One connect, command or copy of a session with a node.
+type Interaction struct {
+	Kind        string `json:"kind"`
+	Address     string `json:"address"`
+	User        string `json:"user,omitempty"`
+	Command     string `json:"command,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	// Octal mode of a downloaded file.
+	Mode     string `json:"mode,omitempty"`
+	StdOut   string `json:"stdout,omitempty"`
+	StdErr   string `json:"stderr,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// The pkg sentinel error wrapped by Error, restored on replay.
+	ErrorType string `json:"error_type,omitempty"`
+}
+
+// The interactions of all sessions in the order they completed.
+type Cassette struct {
+	Interactions []*Interaction `json:"interactions"`
+}
+
+func Load(filename string) (*Cassette, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cassette := &Cassette{}
+	if err = yaml.Unmarshal(b, cassette); err != nil {
+		return nil, fmt.Errorf("failed to parse cassette %s: %w", filename, err)
+	}
+	return cassette, nil
+}
+
+func (c *Cassette) Save(filename string) error {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0600)
+}
+
+// Records the interactions of the operators it creates.
+type Recorder struct {
+	create   func(ctx *pkg.CmdOperatorCtx) (pkg.CmdOperator, error)
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// Creates a recorder of the operators created by create.
+func NewRecorder(create func(ctx *pkg.CmdOperatorCtx) (pkg.CmdOperator, error)) *Recorder {
+	return &Recorder{create: create}
+}
+
+// Creates a recording operator, use as pkg.CmdOperatorFactory.Create.
+func (r *Recorder) Create(ctx *pkg.CmdOperatorCtx) (pkg.CmdOperator, error) {
+	interaction := &Interaction{Kind: KindConnect, Address: ctx.Address, User: user(ctx)}
+	operator, err := r.create(ctx)
+	setError(interaction, err)
+	r.add(interaction)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingCmdOperator{recorder: r, operator: operator, address: ctx.Address, user: interaction.User}, nil
+}
+
+// Returns a copy of the interactions recorded so far.
+func (r *Recorder) Cassette() *Cassette {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &Cassette{Interactions: append([]*Interaction(nil), r.cassette.Interactions...)}
+}
+
+// Writes the interactions recorded so far to filename.
+func (r *Recorder) Save(filename string) error {
+	return r.Cassette().Save(filename)
+}
+
+func (r *Recorder) add(interaction *Interaction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, interaction)
+}
+
+type recordingCmdOperator struct {
+	recorder *Recorder
+	operator pkg.CmdOperator
+	address  string
+	user     string
+}
+
+func (op *recordingCmdOperator) Close() error {
+	return op.operator.Close()
+}
+
+func (op *recordingCmdOperator) Execute(command string) (*pkg.Result, error) {
+	return op.ExecuteContext(context.Background(), command)
+}
+
+func (op *recordingCmdOperator) ExecuteContext(ctx context.Context, command string) (*pkg.Result, error) {
+	result, err := op.operator.ExecuteContext(ctx, command)
+	interaction := &Interaction{Kind: KindCommand, Address: op.address, User: op.user, Command: command}
+	if result != nil {
+		interaction.StdOut = string(result.StdOut)
+		interaction.StdErr = string(result.StdErr)
+		interaction.ExitCode = result.ExitCode
+	}
+	setError(interaction, err)
+	op.recorder.add(interaction)
+	return result, err
+}
+
+func (op *recordingCmdOperator) Copy(ctx context.Context, r io.Reader, remotePath string, size int64, mode os.FileMode) error {
+	err := op.operator.Copy(ctx, r, remotePath, size, mode)
+	interaction := &Interaction{Kind: KindCopy, Address: op.address, User: op.user, Destination: remotePath, Size: size}
+	setError(interaction, err)
+	op.recorder.add(interaction)
+	return err
+}
+
+func (op *recordingCmdOperator) CopyFrom(ctx context.Context, remotePath string, create func(size int64, mode os.FileMode) (io.Writer, error)) error {
+	interaction := &Interaction{Kind: KindDownload, Address: op.address, User: op.user, Source: remotePath}
+	content := &bytes.Buffer{}
+	err := op.operator.CopyFrom(ctx, remotePath, func(size int64, mode os.FileMode) (io.Writer, error) {
+		interaction.Size, interaction.Mode = size, fmt.Sprintf("%04o", mode.Perm())
+		w, err := create(size, mode)
+		if err != nil {
+			return nil, err
+		}
+		return io.MultiWriter(w, content), nil
+	})
+	interaction.StdOut = content.String()
+	setError(interaction, err)
+	op.recorder.add(interaction)
+	return err
+}
+
+// Serves the interactions of a cassette, each interaction is served once.
+// Concurrent sessions with different nodes are replayed independently.
+type Player struct {
+	mu           sync.Mutex
+	interactions []*Interaction
+	used         []bool
+}
+
+func NewPlayer(cassette *Cassette) *Player {
+	return &Player{
+		interactions: cassette.Interactions,
+		used:         make([]bool, len(cassette.Interactions)),
+	}
+}
+
+// Creates a replaying operator, use as pkg.CmdOperatorFactory.Create.
+func (p *Player) Create(ctx *pkg.CmdOperatorCtx) (pkg.CmdOperator, error) {
+	u := user(ctx)
+	interaction, err := p.next(&Interaction{Kind: KindConnect, Address: ctx.Address, User: u})
+	if err != nil {
+		return nil, err
+	}
+	if err = replayedErr(interaction); err != nil {
+		return nil, err
+	}
+	return &replayingCmdOperator{player: p, address: ctx.Address, user: u}, nil
+}
+
+// Returns the interactions that were not replayed.
+func (p *Player) Unused() []*Interaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var unused []*Interaction
+	for i, interaction := range p.interactions {
+		if !p.used[i] {
+			unused = append(unused, interaction)
+		}
+	}
+	return unused
+}
+
+// Returns the first unused interaction that matches want.
+func (p *Player) next(want *Interaction) (*Interaction, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, interaction := range p.interactions {
+		if p.used[i] || interaction.Kind != want.Kind || interaction.Address != want.Address || interaction.User != want.User {
+			continue
+		}
+		if interaction.Command != want.Command || interaction.Source != want.Source || interaction.Destination != want.Destination {
+			continue
+		}
+		p.used[i] = true
+		return interaction, nil
+	}
+	what := want.Command
+	if want.Kind == KindCopy {
+		what = want.Destination
+	} else if want.Kind == KindDownload {
+		what = want.Source
+	}
+	return nil, fmt.Errorf("no recorded %s %s for %s@%s", want.Kind, what, want.User, want.Address)
+}
+
+type replayingCmdOperator struct {
+	player  *Player
+	address string
+	user    string
+}
+
+func (op *replayingCmdOperator) Close() error {
+	return nil
+}
+
+func (op *replayingCmdOperator) Execute(command string) (*pkg.Result, error) {
+	return op.ExecuteContext(context.Background(), command)
+}
+
+func (op *replayingCmdOperator) ExecuteContext(ctx context.Context, command string) (*pkg.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return &pkg.Result{ExitCode: -1}, err
+	}
+	interaction, err := op.player.next(&Interaction{Kind: KindCommand, Address: op.address, User: op.user, Command: command})
+	if err != nil {
+		return &pkg.Result{ExitCode: -1}, err
+	}
+	return &pkg.Result{
+		StdOut:   []byte(interaction.StdOut),
+		StdErr:   []byte(interaction.StdErr),
+		ExitCode: interaction.ExitCode,
+	}, replayedErr(interaction)
+}
+
+func (op *replayingCmdOperator) Copy(ctx context.Context, r io.Reader, remotePath string, size int64, mode os.FileMode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	interaction, err := op.player.next(&Interaction{Kind: KindCopy, Address: op.address, User: op.user, Destination: remotePath})
+	if err != nil {
+		return err
+	}
+	return replayedErr(interaction)
+}
+
+func (op *replayingCmdOperator) CopyFrom(ctx context.Context, remotePath string, create func(size int64, mode os.FileMode) (io.Writer, error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	interaction, err := op.player.next(&Interaction{Kind: KindDownload, Address: op.address, User: op.user, Source: remotePath})
+	if err != nil {
+		return err
+	}
+	if err = replayedErr(interaction); err != nil {
+		return err
+	}
+	mode, err := strconv.ParseUint(interaction.Mode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid mode %q of the recorded download of %s", interaction.Mode, remotePath)
+	}
+	w, err := create(interaction.Size, os.FileMode(mode))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, interaction.StdOut)
+	return err
+}
+
+func user(ctx *pkg.CmdOperatorCtx) string {
+	if ctx.SSHClientConfig == nil {
+		return ""
+	}
+	return ctx.SSHClientConfig.User
+}
+
+func setError(interaction *Interaction, err error) {
+	if err == nil {
+		return
+	}
+	interaction.Error = err.Error()
+	for name, sentinel := range errorTypes {
+		if errors.Is(err, sentinel) {
+			interaction.ErrorType = name
+		}
+	}
+}
+
+// An error read from a cassette, unwraps to the recorded sentinel error.
+type replayedError struct {
+	message  string
+	sentinel error
+}
+
+func (e *replayedError) Error() string {
+	return e.message
+}
+
+func (e *replayedError) Unwrap() error {
+	return e.sentinel
+}
+
+func replayedErr(interaction *Interaction) error {
+	if interaction.Error == "" {
+		return nil
+	}
+	return &replayedError{message: interaction.Error, sentinel: errorTypes[interaction.ErrorType]}
+}
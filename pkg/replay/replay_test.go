@@ -0,0 +1,133 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package replay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh/sshtest"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Runs a session with scan and install like operations.
+func session(t *testing.T, factory *pkg.CmdOperatorFactory, address string) {
+	wrongConfig, _ := ssh.PasswordClientConfig("pirate", "wrong")
+	if _, err := factory.Create(&pkg.CmdOperatorCtx{Address: address, SSHClientConfig: wrongConfig}); !errors.Is(err, pkg.ErrAuthFailed) {
+		t.Errorf("expected ErrAuthFailed, got: %v", err)
+	}
+
+	config, _ := ssh.PasswordClientConfig("pirate", "hypriot")
+	operator, err := factory.Create(&pkg.CmdOperatorCtx{Address: address, SSHClientConfig: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer operator.Close()
+
+	if result, err := operator.Execute("uname -m"); err != nil || string(result.StdOut) != "aarch64\n" {
+		t.Errorf("unexpected uname result: %v, %v", result, err)
+	}
+	if result, err := operator.Execute("cat /missing"); err == nil || result.ExitCode != 1 {
+		t.Errorf("expected cat to fail with exit code 1: %v, %v", result, err)
+	}
+	if err := operator.Copy(context.Background(), strings.NewReader("config"), "~/config.yaml", 6, 0600); err != nil {
+		t.Error(err)
+	}
+	downloaded := &bytes.Buffer{}
+	err = operator.CopyFrom(context.Background(), "~/config.yaml", func(size int64, mode os.FileMode) (io.Writer, error) {
+		if size != 6 || mode != 0600 {
+			t.Errorf("expected 6 bytes with mode 0600, actual: %d bytes with mode %04o", size, mode)
+		}
+		return downloaded, nil
+	})
+	if err != nil || downloaded.String() != "config" {
+		t.Errorf("unexpected download: %q, %v", downloaded, err)
+	}
+}
+
+func TestRecord_And_Replay(t *testing.T) {
+	pi := sshtest.NewPi("black-pearl")
+	pi.Arch = "aarch64"
+	pi.Password = "hypriot"
+	if err := pi.Start(); err != nil {
+		t.Fatal(err)
+	}
+	recorder := NewRecorder(ssh.NewCmdOperator)
+	session(t, &pkg.CmdOperatorFactory{Create: recorder.Create}, pi.Addr())
+	pi.Close()
+
+	dir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "cassette.yaml")
+	if err := recorder.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	cassette, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := len(cassette.Interactions); actual != 6 {
+		t.Errorf("expected 6 interactions, actual: %d", actual)
+	}
+
+	player := NewPlayer(cassette)
+	session(t, &pkg.CmdOperatorFactory{Create: player.Create}, pi.Addr())
+	if unused := player.Unused(); len(unused) != 0 {
+		t.Errorf("expected all interactions to be replayed, unused: %v", unused)
+	}
+}
+
+func TestPlayer_Unknown_Command(t *testing.T) {
+	player := NewPlayer(&Cassette{Interactions: []*Interaction{
+		{Kind: KindConnect, Address: "10.0.0.1:22", User: "pirate"},
+		{Kind: KindCommand, Address: "10.0.0.1:22", User: "pirate", Command: "hostname", StdOut: "black-pearl\n"},
+	}})
+	config, _ := ssh.PasswordClientConfig("pirate", "")
+	operator, err := player.Create(&pkg.CmdOperatorCtx{Address: "10.0.0.1:22", SSHClientConfig: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := operator.Execute("uname -m"); err == nil {
+		t.Error("expected error for a command that was not recorded")
+	}
+	if result, err := operator.Execute("hostname"); err != nil || string(result.StdOut) != "black-pearl\n" {
+		t.Errorf("unexpected hostname result: %v, %v", result, err)
+	}
+	if _, err := operator.Execute("hostname"); err == nil {
+		t.Error("expected error, each interaction is replayed once")
+	}
+	if _, err := player.Create(&pkg.CmdOperatorCtx{Address: "10.0.0.2:22", SSHClientConfig: config}); err == nil {
+		t.Error("expected error for an address that was not recorded")
+	}
+}
@@ -0,0 +1,341 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+// Package secrets keeps node passwords out of the nodes file, as references
+// to environment variables and files or as entries in a local store that is
+// encrypted with NaCl secretbox and a key derived from a passphrase.
+package secrets
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/kubernetes-sigs/yaml"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	DefaultFile = "~/.k3pi/secrets.yaml"
+	// Environment variable holding the passphrase of the store.
+	PassphraseEnv = "K3PI_SECRETS_PASSPHRASE"
+
+	// Password references written by scan instead of literal passwords.
+	RefEnv    = "env"
+	RefSecret = "secret"
+
+	fileVersion = 1
+)
+
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupt secrets file")
+
+// The encrypted store as written to disk, the entries are sealed as JSON.
+type storeFile struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// Named secrets decrypted in memory, call Save to write changes.
+type Store struct {
+	path    string
+	salt    []byte
+	key     *[32]byte
+	entries map[string]string
+}
+
+// Opens the store in path with passphrase, a missing file gives an empty store.
+func Open(path string, passphrase []byte) (*Store, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+	store := &Store{path: path, entries: make(map[string]string)}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		store.salt = make([]byte, 16)
+		if _, err = io.ReadFull(rand.Reader, store.salt); err != nil {
+			return nil, err
+		}
+		store.key, err = deriveKey(passphrase, store.salt)
+		return store, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	file := &storeFile{}
+	if err = yaml.Unmarshal(b, file); err != nil {
+		return nil, fmt.Errorf("failed to parse secrets file %s: %w", path, err)
+	}
+	if file.Version != fileVersion || len(file.Nonce) != 24 {
+		return nil, fmt.Errorf("unsupported secrets file %s", path)
+	}
+	store.salt = file.Salt
+	if store.key, err = deriveKey(passphrase, file.Salt); err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], file.Nonce)
+	data, ok := secretbox.Open(nil, file.Data, &nonce, store.key)
+	if !ok {
+		return nil, ErrWrongPassphrase
+	}
+	if err = json.Unmarshal(data, &store.entries); err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return store, nil
+}
+
+func deriveKey(passphrase, salt []byte) (*[32]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	b, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	key := &[32]byte{}
+	copy(key[:], b)
+	return key, nil
+}
+
+func (s *Store) Get(name string) (string, bool) {
+	value, ok := s.entries[name]
+	return value, ok
+}
+
+func (s *Store) Set(name, value string) {
+	s.entries[name] = value
+}
+
+// Removes the entry, returns false if there was none.
+func (s *Store) Delete(name string) bool {
+	_, ok := s.entries[name]
+	delete(s.entries, name)
+	return ok
+}
+
+// Returns the sorted entry names.
+func (s *Store) Names() []string {
+	var names []string
+	for name := range s.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Seals the entries with a new nonce and replaces the store file.
+func (s *Store) Save() error {
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	if _, err = io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(&storeFile{
+		Version: fileVersion,
+		Salt:    s.salt,
+		Nonce:   nonce[:],
+		Data:    secretbox.Seal(nil, data, &nonce, s.key),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".k3pi-secrets-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Returns the passphrase from keyFile when set, else from PassphraseEnv, else
+// prompts for it on the terminal.
+func ReadPassphrase(keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		path, err := homedir.Expand(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimSpace(string(b))), nil
+	}
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("no passphrase for the secrets store, set %s or use a key file", PassphraseEnv)
+	}
+	_, _ = fmt.Fprint(os.Stderr, "Enter passphrase for the secrets store: ")
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	_, _ = fmt.Fprintln(os.Stderr)
+	return passphrase, err
+}
+
+// Sets the password of every node with a password reference. The nodes file
+// is never rewritten, resolved passwords only live in memory. The store is
+// opened by open the first time a node references an entry.
+func Resolve(nodes []*pkg.Node, open func() (*Store, error)) error {
+	var store *Store
+	for _, node := range nodes {
+		auth := &node.Auth
+		if !auth.HasPasswordRef() {
+			continue
+		}
+		if auth.PasswordSecret != "" && store == nil {
+			var err error
+			if store, err = open(); err != nil {
+				return err
+			}
+		}
+		password, err := resolvePassword(auth, store)
+		if err != nil {
+			return &pkg.NodeError{Address: node.Address, Op: "resolve password for", Err: err}
+		}
+		auth.Password = password
+	}
+	return nil
+}
+
+func resolvePassword(auth *pkg.Auth, store *Store) (string, error) {
+	refs := 0
+	for _, ref := range []string{auth.Password, auth.PasswordEnv, auth.PasswordFile, auth.PasswordSecret} {
+		if ref != "" {
+			refs++
+		}
+	}
+	if refs > 1 {
+		return "", errors.New("only one of password, password_env, password_file and password_secret can be set")
+	}
+
+	switch {
+	case auth.PasswordEnv != "":
+		password, ok := os.LookupEnv(auth.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", auth.PasswordEnv)
+		}
+		return password, nil
+	case auth.PasswordFile != "":
+		path, err := homedir.Expand(auth.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	default:
+		password, ok := store.Get(auth.PasswordSecret)
+		if !ok {
+			return "", fmt.Errorf("no secret %s in %s", auth.PasswordSecret, store.path)
+		}
+		return password, nil
+	}
+}
+
+// Replaces the literal passwords found by scan with references of kind
+// RefEnv or RefSecret. RefSecret saves the passwords in the store opened by
+// open. A reference is named after the user, or after the user and the node
+// address when the name already refers to another password.
+func Externalize(nodes []pkg.Node, kind string, open func() (*Store, error)) error {
+	if kind != RefEnv && kind != RefSecret {
+		return fmt.Errorf("unknown password reference: %s", kind)
+	}
+	var store *Store
+	passwords := make(map[string]string)
+	for i := range nodes {
+		auth := &nodes[i].Auth
+		if auth.Password == "" {
+			continue
+		}
+		if kind == RefSecret && store == nil {
+			var err error
+			if store, err = open(); err != nil {
+				return err
+			}
+		}
+		name := auth.User
+		password, ok := passwords[name]
+		if !ok && store != nil {
+			password, ok = store.Get(name)
+		}
+		if ok && password != auth.Password {
+			name = auth.User + "@" + nodes[i].Address
+		}
+		passwords[name] = auth.Password
+		if kind == RefEnv {
+			auth.PasswordEnv = EnvName(name)
+		} else {
+			store.Set(name, auth.Password)
+			auth.PasswordSecret = name
+		}
+		auth.Password = ""
+	}
+	if store != nil {
+		return store.Save()
+	}
+	return nil
+}
+
+// Returns the environment variable scan references for the password named
+// name.
+func EnvName(name string) string {
+	return "K3PI_PASSWORD_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
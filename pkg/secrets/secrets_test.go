@@ -0,0 +1,186 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package secrets
+
+import (
+	"errors"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestStore_Save_Open(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "k3pi", "secrets.yaml")
+
+	store, err := Open(path, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set("pirate", "hypriot")
+	if err = store.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := ioutil.ReadFile(path); strings.Contains(string(b), "hypriot") {
+		t.Errorf("expected the password to be encrypted: %s", b)
+	}
+
+	store, err = Open(path, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password, ok := store.Get("pirate"); !ok || password != "hypriot" {
+		t.Errorf("expected hypriot, actual: %s", password)
+	}
+}
+
+func TestStore_Open_Wrong_Passphrase(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secrets.yaml")
+
+	store, _ := Open(path, []byte("passphrase"))
+	store.Set("pirate", "hypriot")
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Open(path, []byte("wrong"))
+	if !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("expected ErrWrongPassphrase, got: %v", err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	passwordFile := filepath.Join(dir, "password")
+	_ = ioutil.WriteFile(passwordFile, []byte("from-file\n"), 0600)
+	_ = os.Setenv("K3PI_TEST_PASSWORD", "from-env")
+	defer os.Unsetenv("K3PI_TEST_PASSWORD")
+	store, _ := Open(filepath.Join(dir, "secrets.yaml"), []byte("passphrase"))
+	store.Set("pirate", "from-store")
+
+	nodes := []*pkg.Node{
+		{Address: "10.0.0.1", Auth: pkg.Auth{Password: "literal"}},
+		{Address: "10.0.0.2", Auth: pkg.Auth{PasswordEnv: "K3PI_TEST_PASSWORD"}},
+		{Address: "10.0.0.3", Auth: pkg.Auth{PasswordFile: passwordFile}},
+		{Address: "10.0.0.4", Auth: pkg.Auth{PasswordSecret: "pirate"}},
+	}
+	opened := 0
+	err := Resolve(nodes, func() (*Store, error) {
+		opened++
+		return store, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []string{"literal", "from-env", "from-file", "from-store"} {
+		if actual := nodes[i].Auth.Password; actual != expected {
+			t.Errorf("expected %s, actual: %s", expected, actual)
+		}
+	}
+	if opened != 1 {
+		t.Errorf("expected the store to be opened once, actual: %d", opened)
+	}
+}
+
+func TestResolve_Errors(t *testing.T) {
+	noStore := func() (*Store, error) { return nil, errors.New("unexpected open") }
+	tests := []pkg.Auth{
+		{PasswordEnv: "K3PI_TEST_MISSING"},
+		{PasswordFile: "/missing/password"},
+		{Password: "literal", PasswordEnv: "HOME"},
+	}
+	for _, auth := range tests {
+		err := Resolve([]*pkg.Node{{Address: "10.0.0.1", Auth: auth}}, noStore)
+		var nodeErr *pkg.NodeError
+		if !errors.As(err, &nodeErr) {
+			t.Errorf("expected NodeError for %v, got: %v", auth, err)
+		}
+	}
+}
+
+func TestExternalize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store, _ := Open(filepath.Join(dir, "secrets.yaml"), []byte("passphrase"))
+	open := func() (*Store, error) { return store, nil }
+
+	nodes := []pkg.Node{{Auth: pkg.Auth{User: "pi-user", Password: "raspberry"}}, {Auth: pkg.Auth{User: "root", SSHKey: "~/.ssh/id_rsa"}}}
+	if err := Externalize(nodes, RefEnv, open); err != nil {
+		t.Fatal(err)
+	}
+	if auth := nodes[0].Auth; auth.Password != "" || auth.PasswordEnv != "K3PI_PASSWORD_PI_USER" {
+		t.Errorf("unexpected auth: %v", auth)
+	}
+
+	nodes = []pkg.Node{{Auth: pkg.Auth{User: "pirate", Password: "hypriot"}}}
+	if err := Externalize(nodes, RefSecret, open); err != nil {
+		t.Fatal(err)
+	}
+	if auth := nodes[0].Auth; auth.Password != "" || auth.PasswordSecret != "pirate" {
+		t.Errorf("unexpected auth: %v", auth)
+	}
+	if password, _ := store.Get("pirate"); password != "hypriot" {
+		t.Errorf("expected hypriot in the store, actual: %s", password)
+	}
+
+	nodes = []pkg.Node{
+		{Address: "10.0.0.1", Auth: pkg.Auth{User: "rancher", Password: "rancher"}},
+		{Address: "10.0.0.2", Auth: pkg.Auth{User: "rancher", Password: "rancher"}},
+		{Address: "10.0.0.3", Auth: pkg.Auth{User: "rancher", Password: "k3os"}},
+	}
+	if err := Externalize(nodes, RefEnv, open); err != nil {
+		t.Fatal(err)
+	}
+	for i, env := range []string{"K3PI_PASSWORD_RANCHER", "K3PI_PASSWORD_RANCHER", "K3PI_PASSWORD_RANCHER_10_0_0_3"} {
+		if nodes[i].Auth.PasswordEnv != env {
+			t.Errorf("expected %s for %s, actual: %s", env, nodes[i].Address, nodes[i].Auth.PasswordEnv)
+		}
+	}
+
+	nodes = []pkg.Node{{Address: "10.0.0.4", Auth: pkg.Auth{User: "pirate", Password: "arrr"}}}
+	if err := Externalize(nodes, RefSecret, open); err != nil {
+		t.Fatal(err)
+	}
+	if auth := nodes[0].Auth; auth.PasswordSecret != "pirate@10.0.0.4" {
+		t.Errorf("expected a secret named after the node, actual: %v", auth)
+	}
+	if password, _ := store.Get("pirate"); password != "hypriot" {
+		t.Errorf("expected the password of pirate to be kept, actual: %s", password)
+	}
+}
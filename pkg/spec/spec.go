@@ -0,0 +1,311 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+// Package spec reads the declarative description of a cluster applied by
+// k3pi apply.
+package spec
+
+import (
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/config"
+	"github.com/kubernetes-sigs/yaml"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Version of the spec format read by this release.
+const Version = 1
+
+const (
+	RoleServer = "server"
+	RoleAgent  = "agent"
+)
+
+// The desired state of a cluster.
+type ClusterSpec struct {
+	Version  int      `json:"version"`
+	Name     string   `json:"name"`
+	Versions Versions `json:"versions"`
+	// Token the server is created with, the token of the inventory or the
+	// default token when empty.
+	Token    string       `json:"token,omitempty"`
+	Hostname HostnameSpec `json:"hostname"`
+	// Authorized keys of the rancher user in addition to the cluster key, see
+	// ssh.ResolveAuthorizedKeys for the sources supported.
+	SSHKeys []string `json:"ssh_keys,omitempty"`
+	// Nodes listed explicitly.
+	Nodes []*Node `json:"nodes,omitempty"`
+	// Scan output the selectors pick nodes from, relative to the spec file.
+	NodesFile string      `json:"nodes_file,omitempty"`
+	Selectors []*Selector `json:"selectors,omitempty"`
+	// Values merged into the k3os config of all nodes.
+	Config map[string]interface{} `json:"config,omitempty"`
+	Addons []*Addon               `json:"addons,omitempty"`
+
+	dir     string
+	scanned pkg.Nodes
+}
+
+type Versions struct {
+	K3os string `json:"k3os,omitempty"`
+}
+
+// Hostnames of nodes without one, printf pattern with the prefix and the
+// index of the node.
+type HostnameSpec struct {
+	Prefix  string `json:"prefix,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// A node listed in the spec.
+type Node struct {
+	pkg.Node
+	Role string `json:"role"`
+	// Values merged into the k3os config of this node after the cluster
+	// config.
+	Config map[string]interface{} `json:"config,omitempty"`
+}
+
+// Picks nodes from the scan output, all conditions set must match.
+type Selector struct {
+	Role string `json:"role"`
+	// An IP address or a CIDR.
+	Address string `json:"address,omitempty"`
+	// A glob matched against the hostname found by scan.
+	Hostname string                 `json:"hostname,omitempty"`
+	Arch     string                 `json:"arch,omitempty"`
+	Config   map[string]interface{} `json:"config,omitempty"`
+}
+
+// A manifest deployed by k3s on the server.
+type Addon struct {
+	Name string `json:"name"`
+	// Path relative to the spec file or an https:// URL.
+	Manifest string `json:"manifest"`
+}
+
+// Reads and validates the spec in path together with its nodes file.
+func Load(path string) (*ClusterSpec, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	spec := &ClusterSpec{}
+	if err = yaml.UnmarshalStrict(b, spec); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	spec.dir = filepath.Dir(path)
+	if err = spec.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if spec.NodesFile != "" {
+		b, err := ioutil.ReadFile(spec.path(spec.NodesFile))
+		if err != nil {
+			return nil, err
+		}
+		if err = yaml.Unmarshal(b, &spec.scanned); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", spec.NodesFile, err)
+		}
+	}
+	return spec, nil
+}
+
+func (s *ClusterSpec) Validate() error {
+	if s.Version != Version {
+		return fmt.Errorf("unsupported spec version %d, expected %d", s.Version, Version)
+	}
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	for _, n := range s.Nodes {
+		if n.Address == "" {
+			return fmt.Errorf("node without address")
+		}
+		if err := validateRole(n.Role); err != nil {
+			return fmt.Errorf("node %s: %w", n.Address, err)
+		}
+	}
+	for _, sel := range s.Selectors {
+		if err := validateRole(sel.Role); err != nil {
+			return fmt.Errorf("selector: %w", err)
+		}
+		if sel.Address != "" && net.ParseIP(sel.Address) == nil {
+			if _, _, err := net.ParseCIDR(sel.Address); err != nil {
+				return fmt.Errorf("selector: invalid address %s", sel.Address)
+			}
+		}
+		if _, err := filepath.Match(sel.Hostname, ""); err != nil {
+			return fmt.Errorf("selector: invalid hostname pattern %s", sel.Hostname)
+		}
+	}
+	if len(s.Selectors) > 0 && s.NodesFile == "" {
+		return fmt.Errorf("selectors require a nodes_file")
+	}
+	names := make(map[string]bool)
+	for _, addon := range s.Addons {
+		if addon.Name == "" || strings.ContainsAny(addon.Name, `/\ `) || addon.Manifest == "" {
+			return fmt.Errorf("addons require a name without slashes and a manifest")
+		}
+		if names[addon.Name] {
+			return fmt.Errorf("duplicate addon %s", addon.Name)
+		}
+		names[addon.Name] = true
+	}
+	return nil
+}
+
+func validateRole(role string) error {
+	if role != RoleServer && role != RoleAgent {
+		return fmt.Errorf("role must be %s or %s, not %q", RoleServer, RoleAgent, role)
+	}
+	return nil
+}
+
+// Returns the listed nodes followed by the scanned nodes picked by the
+// selectors, a node listed explicitly or matched by an earlier selector is
+// not picked again. Picked nodes and listed nodes without a hostname keep the
+// hostname of the installed node with their address, the others are numbered
+// by the hostname spec in this order, skipping hostnames already in use.
+// Exactly one node must be the server.
+func (s *ClusterSpec) Resolve(installed pkg.Nodes) ([]*Node, error) {
+	var nodes []*Node
+	seen := make(map[string]bool)
+	for _, n := range s.Nodes {
+		if seen[n.Address] {
+			return nil, fmt.Errorf("node %s is listed twice", n.Address)
+		}
+		seen[n.Address] = true
+		node := *n
+		nodes = append(nodes, &node)
+	}
+	for _, sel := range s.Selectors {
+		for _, scanned := range s.scanned {
+			if seen[scanned.Address] || !sel.matches(scanned) {
+				continue
+			}
+			seen[scanned.Address] = true
+			node := &Node{Node: *scanned, Role: sel.Role, Config: sel.Config}
+			node.Hostname = ""
+			nodes = append(nodes, node)
+		}
+	}
+
+	taken := make(map[string]bool)
+	hostnames := make(map[string]string)
+	for _, n := range installed {
+		taken[n.Hostname] = true
+		hostnames[n.Address] = n.Hostname
+	}
+	for _, n := range nodes {
+		if n.Hostname == "" {
+			n.Hostname = hostnames[n.Address]
+		}
+		taken[n.Hostname] = true
+	}
+
+	servers, index := 0, 1
+	for _, n := range nodes {
+		if n.Role == RoleServer {
+			servers++
+		}
+		for n.Hostname == "" {
+			if hostname := s.hostname(index); !taken[hostname] {
+				n.Hostname = hostname
+				taken[hostname] = true
+			}
+			index++
+		}
+	}
+	if servers != 1 {
+		return nil, fmt.Errorf("expected one server, found %d", servers)
+	}
+	return nodes, nil
+}
+
+// Returns the hostname of the node with index.
+func (s *ClusterSpec) hostname(index int) string {
+	spec := &pkg.HostnameSpec{Prefix: s.Hostname.Prefix, Pattern: s.Hostname.Pattern}
+	if spec.Prefix == "" {
+		spec.Prefix = s.Name + "-"
+	}
+	if spec.Pattern == "" {
+		spec.Pattern = "%s%d"
+	}
+	return spec.GetHostname(index)
+}
+
+func (sel *Selector) matches(node *pkg.Node) bool {
+	if sel.Address != "" {
+		ip := net.ParseIP(node.Address)
+		if _, cidr, err := net.ParseCIDR(sel.Address); err == nil {
+			if ip == nil || !cidr.Contains(ip) {
+				return false
+			}
+		} else if sel.Address != node.Address {
+			return false
+		}
+	}
+	if sel.Hostname != "" {
+		if ok, _ := filepath.Match(sel.Hostname, node.Hostname); !ok {
+			return false
+		}
+	}
+	return sel.Arch == "" || sel.Arch == node.Arch
+}
+
+// Returns the config overrides of node, the cluster config merged with the
+// config of the node.
+func (s *ClusterSpec) ConfigFor(node *Node) map[string]interface{} {
+	if len(s.Config) == 0 && len(node.Config) == 0 {
+		return nil
+	}
+	return config.MergeValues(config.MergeValues(nil, s.Config), node.Config)
+}
+
+// Reads the manifest of addon.
+func (s *ClusterSpec) ReadManifest(addon *Addon) ([]byte, error) {
+	if strings.HasPrefix(addon.Manifest, "https://") {
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Get(addon.Manifest)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s - %s", addon.Manifest, resp.Status)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+	return ioutil.ReadFile(s.path(addon.Manifest))
+}
+
+func (s *ClusterSpec) path(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(s.dir, path)
+}
@@ -0,0 +1,168 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package spec
+
+import (
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var nodesYaml = `
+- address: 192.168.1.10
+  hostname: black-pearl
+  arch: armv7l
+- address: 192.168.1.11
+  hostname: black-pearl
+  arch: aarch64
+- address: 192.168.2.12
+  hostname: black-pearl
+  arch: armv7l
+`
+
+var specYaml = `
+version: 1
+name: pearl
+nodes:
+- address: 192.168.1.10
+  hostname: captain
+  role: server
+  config:
+    k3os:
+      labels:
+        role: server
+nodes_file: nodes.yaml
+selectors:
+- role: agent
+  address: 192.168.1.0/24
+  arch: aarch64
+- role: agent
+  hostname: black-*
+config:
+  k3os:
+    labels:
+      zone: deck
+    dns_nameservers:
+    - 1.1.1.1
+`
+
+func writeSpec(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ioutil.WriteFile(filepath.Join(dir, "nodes.yaml"), []byte(nodesYaml), 0600)
+	path := filepath.Join(dir, "cluster.yaml")
+	_ = ioutil.WriteFile(path, []byte(content), 0600)
+	return path
+}
+
+func TestClusterSpec_Resolve(t *testing.T) {
+	path := writeSpec(t, specYaml)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	spec, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := spec.Resolve(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actual []string
+	for _, n := range nodes {
+		actual = append(actual, n.Address+" "+n.Hostname+" "+n.Role)
+	}
+	want := []string{"192.168.1.10 captain server", "192.168.1.11 pearl-1 agent", "192.168.2.12 pearl-2 agent"}
+	if !reflect.DeepEqual(actual, want) {
+		t.Errorf("got %v, want %v", actual, want)
+	}
+
+	config := spec.ConfigFor(nodes[0])
+	labels := config["k3os"].(map[string]interface{})["labels"]
+	if !reflect.DeepEqual(labels, map[string]interface{}{"zone": "deck", "role": "server"}) {
+		t.Errorf("expected the node labels merged with the cluster labels, actual: %v", labels)
+	}
+	if _, ok := spec.Config["k3os"].(map[string]interface{})["labels"].(map[string]interface{})["role"]; ok {
+		t.Error("expected the cluster config to be unchanged")
+	}
+}
+
+// Installed nodes keep their hostname, new nodes skip the hostnames in use.
+func TestClusterSpec_Resolve_Installed(t *testing.T) {
+	path := writeSpec(t, specYaml)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	spec, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	installed := pkg.Nodes{
+		{Address: "192.168.1.11", Hostname: "pearl-2"},
+		{Address: "192.168.1.99", Hostname: "pearl-1"},
+	}
+	nodes, err := spec.Resolve(installed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actual []string
+	for _, n := range nodes {
+		actual = append(actual, n.Address+" "+n.Hostname)
+	}
+	want := []string{"192.168.1.10 captain", "192.168.1.11 pearl-2", "192.168.2.12 pearl-3"}
+	if !reflect.DeepEqual(actual, want) {
+		t.Errorf("got %v, want %v", actual, want)
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"version":  "version: 2\nname: pearl\n",
+		"name":     "version: 1\n",
+		"role":     "version: 1\nname: pearl\nnodes:\n- address: 10.0.0.1\n  role: master\n",
+		"selector": "version: 1\nname: pearl\nselectors:\n- role: agent\n",
+		"cidr":     "version: 1\nname: pearl\nnodes_file: nodes.yaml\nselectors:\n- role: agent\n  address: 10.0.0.0/33\n",
+		"unknown":  "version: 1\nname: pearl\nservers: []\n",
+		"addon":    "version: 1\nname: pearl\naddons:\n- name: a/b\n  manifest: a.yaml\n",
+	} {
+		path := writeSpec(t, content)
+		if _, err := Load(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		_ = os.RemoveAll(filepath.Dir(path))
+	}
+
+	path := writeSpec(t, "version: 1\nname: pearl\nnodes:\n- address: 10.0.0.1\n  role: agent\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	spec, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := spec.Resolve(nil); err == nil {
+		t.Error("expected an error without a server")
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Prefix of sources with the public keys of a GitHub user, github:<user>.
+const GitHubKeyPrefix = "github:"
+
+// Where the keys of a GitHub user are fetched from, <url>/<user>.keys.
+const DefaultGitHubKeysURL = "https://github.com"
+
+// Options for resolving authorized keys.
+type AuthorizedKeysOptions struct {
+	// Base URL the keys of github:<user> are fetched from, empty writes the
+	// entry through for k3os to fetch on boot.
+	GitHubKeysURL string
+	Client        *http.Client
+}
+
+/*
+Resolves sources into authorized keys. A source is a public key, a file with
+one key per line, a directory whose .pub files are read, github:<user> or an
+https:// URL returning one key per line. Every key is validated and written as
+"[<options>] <type> <base64>", keeping its options and dropping its comment.
+Duplicates are dropped keeping the first occurrence.
+*/
+func ResolveAuthorizedKeys(sources []string, opts *AuthorizedKeysOptions) ([]string, error) {
+	if opts == nil {
+		opts = &AuthorizedKeysOptions{}
+	}
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	var keys []string
+	seen := make(map[string]bool)
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	for _, source := range sources {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+
+		var content []byte
+		var err error
+		switch {
+		case strings.HasPrefix(source, GitHubKeyPrefix):
+			user := strings.TrimPrefix(source, GitHubKeyPrefix)
+			if user == "" || strings.ContainsAny(user, "/ ") {
+				return nil, fmt.Errorf("invalid GitHub user in %s", source)
+			}
+			if opts.GitHubKeysURL == "" {
+				add(source)
+				continue
+			}
+			content, err = fetchKeys(client, fmt.Sprintf("%s/%s.keys", strings.TrimSuffix(opts.GitHubKeysURL, "/"), user))
+		case strings.HasPrefix(source, "https://"):
+			content, err = fetchKeys(client, source)
+		case strings.HasPrefix(source, "http://"):
+			return nil, fmt.Errorf("refusing to fetch keys over plain http: %s", source)
+		default:
+			if _, _, _, _, parseErr := ssh.ParseAuthorizedKey([]byte(source)); parseErr == nil {
+				content = []byte(source)
+			} else {
+				content, err = readKeyFiles(source)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sourceKeys, err := parseAuthorizedKeys(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		if len(sourceKeys) == 0 {
+			return nil, fmt.Errorf("no keys found in %s", source)
+		}
+		for _, key := range sourceKeys {
+			add(key)
+		}
+	}
+	return keys, nil
+}
+
+// Reads a key file, or all .pub files of a directory.
+func readKeyFiles(source string) ([]byte, error) {
+	path, err := homedir.Expand(source)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s is neither a public key nor an existing file", source)
+	} else if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return ioutil.ReadFile(path)
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "*.pub"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var content bytes.Buffer
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		content.Write(b)
+		content.WriteByte('\n')
+	}
+	return content.Bytes(), nil
+}
+
+func fetchKeys(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s - %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Parses one key per line, skipping blank lines and comments. Options such
+// as from= and no-pty are kept in front of the key.
+func parseAuthorizedKeys(content []byte) ([]string, error) {
+	var keys []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key on line %d: %w", lineNo, err)
+		}
+		authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+		if len(options) > 0 {
+			authorizedKey = strings.Join(options, ",") + " " + authorizedKey
+		}
+		keys = append(keys, authorizedKey)
+	}
+	return keys, scanner.Err()
+}
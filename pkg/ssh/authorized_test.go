@@ -0,0 +1,116 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package ssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveAuthorizedKeys(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	keyDir := filepath.Join(dir, "team")
+	_ = os.Mkdir(keyDir, 0700)
+	alice, _ := GenerateKey(filepath.Join(keyDir, "alice"), "alice@team")
+	bob, _ := GenerateKey(filepath.Join(keyDir, "bob"), "bob@team")
+	carol, _ := GenerateKey(filepath.Join(dir, "carol"), "carol")
+	dave, _ := GenerateKey(filepath.Join(dir, "dave"), "dave")
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/octocat.keys":
+			_, _ = fmt.Fprintf(w, "%s\n%s\n", dave, alice)
+		case "/keys":
+			_, _ = fmt.Fprintln(w, carol)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	sources := []string{
+		keyDir,
+		filepath.Join(dir, "carol.pub"),
+		bob + " duplicate",
+		"github:octocat",
+		server.URL + "/keys",
+	}
+
+	if _, err := ResolveAuthorizedKeys(sources, nil); err == nil {
+		t.Fatal("expected the https URL to fail with the default client")
+	}
+
+	opts := &AuthorizedKeysOptions{Client: server.Client()}
+	keys, err := ResolveAuthorizedKeys(sources, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{alice, bob, carol, "github:octocat"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+
+	opts.GitHubKeysURL = server.URL
+	keys, err = ResolveAuthorizedKeys(sources, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{alice, bob, carol, dave}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+
+	for _, source := range []string{"ssh-rsa AAAA", filepath.Join(dir, "missing.pub"), "github:", "http://example.com/keys", server.URL + "/missing"} {
+		if _, err := ResolveAuthorizedKeys([]string{source}, opts); err == nil {
+			t.Errorf("expected %s to fail", source)
+		}
+	}
+
+	_ = ioutil.WriteFile(filepath.Join(dir, "broken.pub"), []byte(strings.TrimSuffix(carol, "A")+"!\n"), 0600)
+	if _, err := ResolveAuthorizedKeys([]string{filepath.Join(dir, "broken.pub")}, opts); err == nil {
+		t.Error("expected an invalid key file to fail")
+	}
+}
+
+func TestParseAuthorizedKeys_Options(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	alice, _ := GenerateKey(filepath.Join(dir, "alice"), "alice")
+	bob, _ := GenerateKey(filepath.Join(dir, "bob"), "bob")
+
+	content := fmt.Sprintf("from=\"10.0.0.0/24\",no-pty %s alice@laptop\ncommand=\"echo hello, world\" %s\n", alice, bob)
+	keys, err := parseAuthorizedKeys([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`from="10.0.0.0/24",no-pty ` + alice, `command="echo hello, world" ` + bob}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+}
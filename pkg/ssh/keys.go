@@ -0,0 +1,252 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package ssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Prompts for the passphrase of an encrypted key, replaced by tests.
+var readPassphrase = func(keyPath string) ([]byte, error) {
+	_, _ = fmt.Fprintf(os.Stderr, "Enter passphrase for '%s': ", keyPath)
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	_, _ = fmt.Fprintln(os.Stderr)
+	return passphrase, err
+}
+
+// Passphrases by key path, so parallel connections prompt only once.
+var passphrases = struct {
+	sync.Mutex
+	byPath map[string][]byte
+}{byPath: make(map[string][]byte)}
+
+/*
+Loads the identities of settings as one auth method: the keys of
+settings.KeyPaths, each with its certificate from <key>-cert.pub when present,
+followed by all keys of the ssh agent. Missing key files are skipped, without
+key files only the agent is used. Encrypted keys held by the agent are left to
+the agent, other encrypted keys prompt for their passphrase.
+
+	LoadPublicKey(&Settings{KeyPaths: []string{"~/.ssh/id_ed25519"}})
+*/
+func LoadPublicKey(settings *Settings) (ssh.AuthMethod, func() error, error) {
+	var sshAgent agent.ExtendedAgent
+	closeSSHAgent := func() error { return nil }
+	if !settings.IdentitiesOnly {
+		sshAgent, closeSSHAgent = connectAgent()
+	}
+	var agentKeys []*agent.Key
+	if sshAgent != nil {
+		agentKeys, _ = sshAgent.List()
+	}
+
+	var signers []ssh.Signer
+	for _, keyPath := range settings.GetKeyPaths() {
+		signer, err := loadSigner(keyPath, agentKeys)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			_ = closeSSHAgent()
+			return nil, func() error { return nil }, fmt.Errorf("unable to load the ssh key from path %q: %w", keyPath, err)
+		}
+		if signer != nil {
+			signers = append(signers, signer)
+		}
+	}
+
+	if len(signers) == 0 && len(agentKeys) == 0 {
+		_ = closeSSHAgent()
+		return nil, func() error { return nil }, fmt.Errorf("no ssh keys found in %v or in the ssh agent", settings.KeyPaths)
+	}
+
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		all := append([]ssh.Signer{}, signers...)
+		if sshAgent != nil {
+			if agentSigners, err := sshAgent.Signers(); err == nil {
+				all = append(all, agentSigners...)
+			}
+		}
+		return all, nil
+	}), closeSSHAgent, nil
+}
+
+// Returns the signer of the key in keyPath, nil if the key is encrypted and
+// held by the agent.
+func loadSigner(keyPath string, agentKeys []*agent.Key) (ssh.Signer, error) {
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		publicKey := missing.PublicKey
+		if publicKey == nil {
+			publicKey = readPublicKey(keyPath + ".pub")
+		}
+		if publicKey != nil && inAgent(publicKey, agentKeys) {
+			return nil, nil
+		}
+		signer, err = parseWithPassphrase(keyPath, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return withCertificate(keyPath, signer)
+}
+
+func parseWithPassphrase(keyPath string, key []byte) (ssh.Signer, error) {
+	passphrases.Lock()
+	defer passphrases.Unlock()
+
+	if passphrase, ok := passphrases.byPath[keyPath]; ok {
+		return ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+	}
+	passphrase, err := readPassphrase(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+	if err == nil {
+		passphrases.byPath[keyPath] = passphrase
+	}
+	return signer, err
+}
+
+// Returns signer presenting the user certificate in <keyPath>-cert.pub, or
+// signer itself when there is no certificate.
+func withCertificate(keyPath string, signer ssh.Signer) (ssh.Signer, error) {
+	b, err := ioutil.ReadFile(keyPath + "-cert.pub")
+	if os.IsNotExist(err) {
+		return signer, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate %s-cert.pub: %v", keyPath, err)
+	}
+	cert, ok := publicKey.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%s-cert.pub is not a user certificate", keyPath)
+	}
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return nil, fmt.Errorf("%s-cert.pub is not a certificate of the key", keyPath)
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
+
+func readPublicKey(path string) ssh.PublicKey {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil
+	}
+	return publicKey
+}
+
+func inAgent(publicKey ssh.PublicKey, agentKeys []*agent.Key) bool {
+	for _, key := range agentKeys {
+		if bytes.Equal(key.Blob, publicKey.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Connects to the agent in SSH_AUTH_SOCK, returns nil if there is none.
+func connectAgent() (agent.ExtendedAgent, func() error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, func() error { return nil }
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, func() error { return nil }
+	}
+	return agent.NewClient(conn), conn.Close
+}
+
+// Writes a new ed25519 private key to path and its public key to path.pub,
+// returns the public key in authorized_keys format without comment.
+func GenerateKey(path, comment string) (string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublicKey)))
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	if err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return "", err
+	}
+	if err = ioutil.WriteFile(path+".pub", []byte(fmt.Sprintf("%s %s\n", authorizedKey, comment)), 0644); err != nil {
+		return "", err
+	}
+	return authorizedKey, nil
+}
+
+// Returns the public key in path.pub in authorized_keys format without
+// comment.
+func ReadAuthorizedKey(path string) (string, error) {
+	b, err := ioutil.ReadFile(path + ".pub")
+	if err != nil {
+		return "", err
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return "", fmt.Errorf("invalid public key %s.pub: %v", path, err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))), nil
+}
@@ -0,0 +1,194 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package ssh
+
+import (
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh/sshtest"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Creates a key with ssh-keygen in dir and returns its path.
+func keygen(t *testing.T, dir, name string, args ...string) string {
+	keyPath := filepath.Join(dir, name)
+	args = append([]string{"-q", "-f", keyPath, "-C", name}, args...)
+	if out, err := exec.Command("ssh-keygen", args...).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen failed: %v: %s", err, out)
+	}
+	return keyPath
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "k3pi-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Starts a Pi that only accepts the public key in keyPath.pub.
+func startKeyPi(t *testing.T, keyPath string) *sshtest.Server {
+	pi := sshtest.NewPi("black-pearl")
+	pi.AuthorizedKeys = []ssh.PublicKey{readPublicKey(keyPath + ".pub")}
+	if err := pi.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return pi
+}
+
+func login(pi *sshtest.Server, settings *Settings) error {
+	config, closeSSHAgent, err := NewClientConfig(settings)
+	if err != nil {
+		return err
+	}
+	defer closeSSHAgent()
+
+	operator, err := NewCmdOperator(&pkg.CmdOperatorCtx{Address: pi.Addr(), SSHClientConfig: config})
+	if err != nil {
+		return err
+	}
+	return operator.Close()
+}
+
+func noAgent() func() {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	_ = os.Unsetenv("SSH_AUTH_SOCK")
+	return func() { _ = os.Setenv("SSH_AUTH_SOCK", socket) }
+}
+
+func TestLoadPublicKey_OpenSSH_ECDSA(t *testing.T) {
+	defer noAgent()()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	keyPath := keygen(t, dir, "id_ecdsa", "-t", "ecdsa", "-N", "")
+	pi := startKeyPi(t, keyPath)
+	defer pi.Close()
+
+	if err := login(pi, &Settings{User: "pirate", KeyPaths: []string{filepath.Join(dir, "missing"), keyPath}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadPublicKey_OpenSSH_Encrypted(t *testing.T) {
+	defer noAgent()()
+	defer func(read func(string) ([]byte, error)) { readPassphrase = read }(readPassphrase)
+	prompts := 0
+	readPassphrase = func(keyPath string) ([]byte, error) {
+		prompts++
+		return []byte("secret"), nil
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	keyPath := keygen(t, dir, "id_ed25519", "-t", "ed25519", "-N", "secret")
+	pi := startKeyPi(t, keyPath)
+	defer pi.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := login(pi, &Settings{User: "pirate", KeyPaths: []string{keyPath}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if prompts != 1 {
+		t.Errorf("expected 1 passphrase prompt, actual: %d", prompts)
+	}
+}
+
+func TestLoadPublicKey_Certificate(t *testing.T) {
+	defer noAgent()()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	caPath := keygen(t, dir, "ca", "-t", "ed25519", "-N", "")
+	keyPath := keygen(t, dir, "id_ed25519", "-t", "ed25519", "-N", "")
+	if out, err := exec.Command("ssh-keygen", "-q", "-s", caPath, "-I", "pirate", "-n", "pirate", keyPath+".pub").CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen failed: %v: %s", err, out)
+	}
+
+	pi := sshtest.NewPi("black-pearl")
+	pi.AuthorizedKeys = []ssh.PublicKey{}
+	pi.UserCA = readPublicKey(caPath + ".pub")
+	if err := pi.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pi.Close()
+
+	if err := login(pi, &Settings{User: "pirate", KeyPaths: []string{keyPath}}); err != nil {
+		t.Error(err)
+	}
+	if err := login(pi, &Settings{User: "root", KeyPaths: []string{keyPath}}); err == nil {
+		t.Error("expected login as a user not in the certificate to fail")
+	}
+}
+
+func TestLoadPublicKey_Agent_Only(t *testing.T) {
+	defer noAgent()()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	keyPath := keygen(t, dir, "id_ed25519", "-t", "ed25519", "-N", "")
+	pi := startKeyPi(t, keyPath)
+	defer pi.Close()
+
+	b, _ := ioutil.ReadFile(keyPath)
+	key, err := ssh.ParseRawPrivateKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err = keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _ = agent.ServeAgent(keyring, conn) }()
+		}
+	}()
+	_ = os.Setenv("SSH_AUTH_SOCK", socket)
+
+	if err := login(pi, &Settings{User: "pirate"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadPublicKey_No_Keys(t *testing.T) {
+	defer noAgent()()
+
+	_, _, err := LoadPublicKey(&Settings{KeyPaths: []string{"/missing/id_rsa"}})
+	if err == nil {
+		t.Error("expected error without keys")
+	}
+}
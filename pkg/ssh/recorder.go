@@ -0,0 +1,113 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package ssh
+
+import (
+	"context"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+type StepKind string
+
+const (
+	StepCommand StepKind = "command"
+	StepCopy    StepKind = "copy"
+	StepReboot  StepKind = "reboot"
+)
+
+// A command or file transfer that would have been executed on a node.
+type Step struct {
+	Kind        StepKind `json:"kind"`
+	Command     string   `json:"command,omitempty"`
+	Source      string   `json:"source,omitempty"`
+	Destination string   `json:"destination,omitempty"`
+	Size        int64    `json:"size,omitempty"`
+}
+
+// Records the steps of dry run operators per address, nothing is executed and
+// no connection is made. Nodes behind the same host are told apart by port.
+type Recorder struct {
+	mu    sync.Mutex
+	steps map[string][]Step
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{steps: make(map[string][]Step)}
+}
+
+// Creates an operator that records its steps, use as pkg.CmdOperatorFactory.Create.
+func (r *Recorder) Create(ctx *pkg.CmdOperatorCtx) (pkg.CmdOperator, error) {
+	return &recordingCmdRunner{recorder: r, address: ctx.Address}, nil
+}
+
+// Returns the steps recorded for address, as host:port, in the order they
+// were executed.
+func (r *Recorder) Steps(address string) []Step {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Step(nil), r.steps[address]...)
+}
+
+func (r *Recorder) add(address string, step Step) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.steps[address] = append(r.steps[address], step)
+}
+
+type recordingCmdRunner struct {
+	recorder *Recorder
+	address  string
+}
+
+func (d *recordingCmdRunner) Close() error {
+	return nil
+}
+
+func (d *recordingCmdRunner) Execute(command string) (*pkg.Result, error) {
+	return d.ExecuteContext(context.Background(), command)
+}
+
+func (d *recordingCmdRunner) ExecuteContext(ctx context.Context, command string) (*pkg.Result, error) {
+	kind := StepCommand
+	if strings.Contains(command, "reboot") {
+		kind = StepReboot
+	}
+	d.recorder.add(d.address, Step{Kind: kind, Command: command})
+	return &pkg.Result{
+		StdOut: []byte("\n"),
+		StdErr: []byte{},
+	}, nil
+}
+
+func (d *recordingCmdRunner) Copy(ctx context.Context, r io.Reader, remotePath string, size int64, mode os.FileMode) error {
+	d.recorder.add(d.address, Step{Kind: StepCopy, Destination: remotePath, Size: size})
+	return nil
+}
+
+func (d *recordingCmdRunner) CopyFrom(ctx context.Context, remotePath string, create func(size int64, mode os.FileMode) (io.Writer, error)) error {
+	d.recorder.add(d.address, Step{Kind: StepCopy, Source: remotePath})
+	return nil
+}
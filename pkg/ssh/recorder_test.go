@@ -0,0 +1,60 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"reflect"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	recorder := NewRecorder()
+	operator, err := recorder.Create(&pkg.CmdOperatorCtx{Address: "10.0.0.1:22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = operator.Copy(context.Background(), bytes.NewReader([]byte("config")), "~/config.yaml", 6, 0600)
+	_, _ = operator.Execute("sudo cp config.yaml /k3os/system/config.yaml")
+	_, _ = operator.ExecuteContext(context.Background(), "sudo sync && sudo reboot -f")
+
+	expected := []Step{
+		{Kind: StepCopy, Destination: "~/config.yaml", Size: 6},
+		{Kind: StepCommand, Command: "sudo cp config.yaml /k3os/system/config.yaml"},
+		{Kind: StepReboot, Command: "sudo sync && sudo reboot -f"},
+	}
+	if actual := recorder.Steps("10.0.0.1:22"); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %v, actual: %v", expected, actual)
+	}
+	if steps := recorder.Steps("10.0.0.2:22"); len(steps) != 0 {
+		t.Errorf("expected no steps for 10.0.0.2:22, actual: %v", steps)
+	}
+
+	forwarded, _ := recorder.Create(&pkg.CmdOperatorCtx{Address: "10.0.0.1:2222"})
+	_, _ = forwarded.Execute("hostname")
+	if steps := recorder.Steps("10.0.0.1:2222"); len(steps) != 1 || len(recorder.Steps("10.0.0.1:22")) != 3 {
+		t.Errorf("expected the steps of each port to be recorded apart, actual: %v", steps)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package ssh
+
+import (
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"golang.org/x/crypto/ssh"
+	"io"
+)
+
+// Size of a terminal window in characters.
+type WindowSize struct {
+	Width, Height int
+}
+
+// The local end of an interactive session.
+type Terminal struct {
+	Stdin          io.Reader
+	Stdout, Stderr io.Writer
+	// Type of the pseudo terminal, like xterm, none is requested when empty.
+	Term string
+	Size WindowSize
+	// Receives the new size when the window is resized.
+	Resize <-chan WindowSize
+}
+
+// Opens a login shell on the address of ctx connected to terminal and
+// returns its exit code when it exits.
+func Shell(ctx *pkg.CmdOperatorCtx, terminal *Terminal) (int, error) {
+	client, jump, err := dial(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer client.Close()
+	if jump != nil {
+		defer jump.Close()
+	}
+
+	sess, err := client.NewSession()
+	if err != nil {
+		return -1, err
+	}
+	defer sess.Close()
+	sess.Stdin, sess.Stdout, sess.Stderr = terminal.Stdin, terminal.Stdout, terminal.Stderr
+
+	if terminal.Term != "" {
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+		if err = sess.RequestPty(terminal.Term, terminal.Size.Height, terminal.Size.Width, modes); err != nil {
+			return -1, err
+		}
+	}
+	if err = sess.Shell(); err != nil {
+		return -1, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case size := <-terminal.Resize:
+				_ = sess.WindowChange(size.Height, size.Width)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err = sess.Wait()
+	if _, ok := err.(*ssh.ExitError); ok || err == nil {
+		return exitStatus(err), nil
+	}
+	return -1, err
+}
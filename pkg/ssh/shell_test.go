@@ -0,0 +1,75 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package ssh
+
+import (
+	"bytes"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh/sshtest"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestShell(t *testing.T) {
+	pi := startPi(t)
+	defer pi.Close()
+	pi.Handle("false", func(command string, stdout, stderr io.Writer) int { return 3 })
+
+	stdin, input := io.Pipe()
+	resize := make(chan WindowSize)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	config, _ := PasswordClientConfig("pirate", "hypriot")
+	terminal := &Terminal{Stdin: stdin, Stdout: stdout, Stderr: stderr, Term: "xterm", Size: WindowSize{Width: 80, Height: 24}, Resize: resize}
+
+	type exit struct {
+		code int
+		err  error
+	}
+	exited := make(chan exit)
+	go func() {
+		code, err := Shell(&pkg.CmdOperatorCtx{Address: pi.Addr(), SSHClientConfig: config}, terminal)
+		exited <- exit{code, err}
+	}()
+
+	_, _ = io.WriteString(input, "echo hello\n")
+	waitForPty(t, pi, sshtest.Pty{Term: "xterm", Width: 80, Height: 24})
+	resize <- WindowSize{Width: 120, Height: 40}
+	waitForPty(t, pi, sshtest.Pty{Term: "xterm", Width: 120, Height: 40})
+	_, _ = io.WriteString(input, "false\nexit\n")
+
+	result := <-exited
+	if result.err != nil || result.code != 3 {
+		t.Errorf("expected exit code 3, actual %d: %v", result.code, result.err)
+	}
+	if stdout.String() != "hello\n" {
+		t.Errorf("unexpected output: %q", stdout)
+	}
+}
+
+func waitForPty(t *testing.T, pi *sshtest.Server, expected sshtest.Pty) {
+	for start := time.Now(); pi.Pty() != expected; time.Sleep(time.Millisecond * 10) {
+		if time.Since(start) > time.Second*5 {
+			t.Fatalf("expected pty %+v, actual %+v", expected, pi.Pty())
+		}
+	}
+}
@@ -22,78 +22,53 @@ THE SOFTWARE.
 package ssh
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/TheNatureOfSoftware/k3pi/pkg"
 	"github.com/mitchellh/go-homedir"
-	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
-	"golang.org/x/crypto/ssh/terminal"
 	"io"
-	"io/ioutil"
 	"net"
 	"os"
+	"path"
+	"strings"
 	"sync"
 	"time"
 )
 
+// Max duration of a copy when the context has no deadline.
+const copyTimeout = time.Hour
+
 // SSH settings to use.
 type Settings struct {
-	User, KeyPath, Port string
-}
-
-// Returns the expanded key path.
-func (s *Settings) GetKeyPath() string {
-	path, _ := homedir.Expand(s.KeyPath)
-	return path
+	User, Port string
+	// Private keys to try, in order, before the keys of the ssh agent.
+	KeyPaths []string
+	// When true, only KeyPaths are tried and the ssh agent is not used.
+	IdentitiesOnly bool
 }
 
-/* Loads the ssh public key.
-   LoadPublicKey(Settings{KeyPath: "~/.ssh/id_rsa"})
-*/
-func LoadPublicKey(settings *Settings) (ssh.AuthMethod, func() error, error) {
-	noopCloseFunc := func() error { return nil }
-	keyPath := settings.GetKeyPath()
-
-	key, err := ioutil.ReadFile(keyPath)
-	if err != nil {
-		return nil, noopCloseFunc, err
-	}
-
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		if err.Error() != "ssh: cannot decode encrypted private keys" {
-			return nil, noopCloseFunc, err
-		}
-
-		sshAgent, sshAgentCloseHandler := sshAgent(keyPath + ".pub")
-		if sshAgent != nil {
-			return sshAgent, sshAgentCloseHandler, nil
-		}
-
-		defer sshAgentCloseHandler()
-
-		fmt.Printf("Enter passphrase for '%s': ", keyPath)
-		bytePassword, err := terminal.ReadPassword(int(os.Stdin.Fd()))
-		fmt.Println()
-
-		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, bytePassword)
-		if err != nil {
-			return nil, noopCloseFunc, err
+// Returns the expanded key paths.
+func (s *Settings) GetKeyPaths() []string {
+	var paths []string
+	for _, keyPath := range s.KeyPaths {
+		if keyPath == "" {
+			continue
 		}
+		path, _ := homedir.Expand(keyPath)
+		paths = append(paths, path)
 	}
-
-	return ssh.PublicKeys(signer), noopCloseFunc, nil
+	return paths
 }
 
 // Creates a new ssh client configuration.
 func NewClientConfig(settings *Settings) (*ssh.ClientConfig, func() error, error) {
 
 	authMethod, closeSSHAgent, err := LoadPublicKey(settings)
-
 	if err != nil {
-		return nil, nil, errors.Wrap(err, fmt.Sprintf("unable to load the ssh key from path %q", settings.GetKeyPath()))
+		return nil, nil, err
 	}
 
 	return &ssh.ClientConfig{
@@ -109,10 +84,11 @@ func NewClientConfig(settings *Settings) (*ssh.ClientConfig, func() error, error
 func NewClientConfigFor(node *pkg.Node) (*ssh.ClientConfig, func() error, error) {
 	auth := node.Auth
 	if auth.Type == "ssh-key" {
+		_, port, _ := net.SplitHostPort(node.SSHAddress())
 		config, closeHandler, err := NewClientConfig(&Settings{
-			User:    auth.User,
-			KeyPath: auth.SSHKey,
-			Port:    "22",
+			User:     auth.User,
+			KeyPaths: auth.GetSSHKeys(),
+			Port:     port,
 		})
 		if err != nil {
 			return nil, nil, err
@@ -136,132 +112,446 @@ func PasswordClientConfig(username string, password string) (*ssh.ClientConfig,
 type cmdRunner struct {
 	writeToStdOut bool
 	client        *ssh.Client
+	// The jump host connection, nil when connected directly.
+	jump   *ssh.Client
+	log    io.Writer
+	onLine func(line string, stderr bool)
 }
 
 func (s *cmdRunner) Close() error {
-	return s.client.Close()
+	err := s.client.Close()
+	if s.jump != nil {
+		_ = s.jump.Close()
+	}
+	return err
 }
 
 func (s *cmdRunner) Execute(command string) (*pkg.Result, error) {
+	return s.ExecuteContext(context.Background(), command)
+}
+
+// Runs command in a new session. When ctx is done the remote command is
+// killed and the session closed, pkg.ErrTimeout is returned if the deadline
+// of ctx was exceeded.
+func (s *cmdRunner) ExecuteContext(ctx context.Context, command string) (*pkg.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return &pkg.Result{ExitCode: -1}, contextError(ctx, command)
+	}
 	sess, err := s.client.NewSession()
 	if err != nil {
-		return &pkg.Result{}, err
+		return &pkg.Result{ExitCode: -1}, err
 	}
-
 	defer sess.Close()
 
 	sessStdOut, err := sess.StdoutPipe()
 	if err != nil {
-		return &pkg.Result{}, err
+		return &pkg.Result{ExitCode: -1}, err
 	}
-
 	output := bytes.Buffer{}
-
 	wg := sync.WaitGroup{}
-
-	var stdOutWriter io.Writer
+	stdOutWriters := []io.Writer{&output}
 	if s.writeToStdOut {
-		stdOutWriter = io.MultiWriter(os.Stdout, &output)
-	} else {
-		stdOutWriter = io.MultiWriter(&output)
+		stdOutWriters = append(stdOutWriters, os.Stdout)
 	}
-
+	if s.log != nil {
+		stdOutWriters = append(stdOutWriters, s.log)
+	}
+	stdOutLines := &lineWriter{onLine: s.onLine}
+	if s.onLine != nil {
+		stdOutWriters = append(stdOutWriters, stdOutLines)
+	}
+	stdOutWriter := io.MultiWriter(stdOutWriters...)
 	wg.Add(1)
 	go func() {
 		_, _ = io.Copy(stdOutWriter, sessStdOut)
 		wg.Done()
 	}()
+
 	sessStderr, err := sess.StderrPipe()
 	if err != nil {
-		return &pkg.Result{}, err
+		return &pkg.Result{ExitCode: -1}, err
 	}
-
 	errorOutput := bytes.Buffer{}
-	stdErrWriter := io.MultiWriter(os.Stderr, &errorOutput)
+	stdErrWriters := []io.Writer{&errorOutput}
+	if s.writeToStdOut {
+		stdErrWriters = append(stdErrWriters, os.Stderr)
+	}
+	if s.log != nil {
+		stdErrWriters = append(stdErrWriters, s.log)
+	}
+	stdErrLines := &lineWriter{onLine: s.onLine, stderr: true}
+	if s.onLine != nil {
+		stdErrWriters = append(stdErrWriters, stdErrLines)
+	}
+	stdErrWriter := io.MultiWriter(stdErrWriters...)
 	wg.Add(1)
 	go func() {
 		_, _ = io.Copy(stdErrWriter, sessStderr)
 		wg.Done()
 	}()
 
-	err = sess.Run(command)
-
+	if s.log != nil {
+		_, _ = fmt.Fprintf(s.log, "$ %s\n", command)
+	}
+	started := time.Now()
+	if err = sess.Start(command); err != nil {
+		return &pkg.Result{ExitCode: -1}, err
+	}
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- sess.Wait()
+	}()
+	select {
+	case err = <-runErr:
+	case <-ctx.Done():
+		_ = sess.Signal(ssh.SIGKILL)
+		_ = sess.Close()
+		<-runErr
+		err = contextError(ctx, command)
+	}
 	wg.Wait()
-
-	if err != nil {
-		return &pkg.Result{}, err
+	stdOutLines.flush()
+	stdErrLines.flush()
+	if s.log != nil {
+		_, _ = fmt.Fprintf(s.log, "# exit: %v\n", exitStatus(err))
 	}
 
 	return &pkg.Result{
-		StdErr: errorOutput.Bytes(),
-		StdOut: output.Bytes(),
-	}, nil
+		StdErr:   errorOutput.Bytes(),
+		StdOut:   output.Bytes(),
+		ExitCode: exitStatus(err),
+		Duration: time.Since(started),
+	}, err
 }
 
-type dryRunCmdRunner struct {
+// Passes each complete line written to onLine, flush passes the remainder.
+type lineWriter struct {
+	buf    []byte
+	stderr bool
+	onLine func(line string, stderr bool)
 }
 
-func (d dryRunCmdRunner) Close() error {
-	return nil
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.onLine(strings.TrimSuffix(string(w.buf[:i]), "\r"), w.stderr)
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
 }
 
-func (d dryRunCmdRunner) Execute(command string) (*pkg.Result, error) {
-	//fmt.Printf("%s\n", command)
-	return &pkg.Result{
-		StdOut: []byte("\n"),
-		StdErr: []byte{},
-	}, nil
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 && w.onLine != nil {
+		w.onLine(string(w.buf), w.stderr)
+		w.buf = nil
+	}
 }
 
-func NewCmdOperator(ctx *pkg.CmdOperatorCtx) (pkg.CmdOperator, error) {
-	client, err := ssh.Dial("tcp", ctx.Address, ctx.SSHClientConfig)
+// Copies r to remotePath with scp over a new session of the connection. The
+// file keeps the base name of remotePath when remotePath is a directory.
+func (s *cmdRunner) Copy(ctx context.Context, r io.Reader, remotePath string, size int64, mode os.FileMode) error {
+	if err := ctx.Err(); err != nil {
+		return contextError(ctx, "copy "+remotePath)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, copyTimeout)
+		defer cancel()
+	}
+	sess, err := s.client.NewSession()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer sess.Close()
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		return err
 	}
 
-	cmdOperator := cmdRunner{
-		writeToStdOut: ctx.EnableStdOut,
-		client:        client,
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = sess.Close()
+		case <-done:
+		}
+	}()
+
+	if s.log != nil {
+		_, _ = fmt.Fprintf(s.log, "$ scp - %s (%d bytes)\n", remotePath, size)
+	}
+	if err = sess.Start("scp -qt " + QuotePath(remotePath)); err != nil {
+		return err
+	}
+	err = sendFile(stdin, bufio.NewReader(stdout), r, path.Base(remotePath), size, mode)
+	_ = stdin.Close()
+	if waitErr := sess.Wait(); err == nil {
+		err = waitErr
+	}
+	if ctx.Err() != nil {
+		err = contextError(ctx, "copy "+remotePath)
+	}
+	if s.log != nil {
+		_, _ = fmt.Fprintf(s.log, "# exit: %v\n", exitStatus(err))
+	}
+	return err
+}
+
+// Sends one file named name to scp -t, reading each acknowledgement from r.
+func sendFile(w io.Writer, r *bufio.Reader, content io.Reader, name string, size int64, mode os.FileMode) error {
+	ack := func() error {
+		status, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if status != 0 {
+			message, _ := r.ReadString('\n')
+			return fmt.Errorf("%s", strings.TrimSpace(message))
+		}
+		return nil
+	}
+	if err := ack(); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "C%04o %d %s\n", mode.Perm(), size, name); err != nil {
+		return err
+	}
+	if err := ack(); err != nil {
+		return err
 	}
+	if _, err := io.CopyN(w, content, size); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{0}); err != nil {
+		return err
+	}
+	return ack()
+}
+
+// Copies remotePath with scp over a new session of the connection to the
+// writer returned by create.
+func (s *cmdRunner) CopyFrom(ctx context.Context, remotePath string, create func(size int64, mode os.FileMode) (io.Writer, error)) error {
+	if err := ctx.Err(); err != nil {
+		return contextError(ctx, "copy "+remotePath)
+	}
+	sess, err := s.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = sess.Close()
+		case <-done:
+		}
+	}()
 
-	return &cmdOperator, nil
+	if s.log != nil {
+		_, _ = fmt.Fprintf(s.log, "$ scp %s -\n", remotePath)
+	}
+	if err = sess.Start("scp -f " + QuotePath(remotePath)); err != nil {
+		return err
+	}
+	err = receiveFile(stdin, bufio.NewReader(stdout), create)
+	_ = stdin.Close()
+	if waitErr := sess.Wait(); err == nil {
+		err = waitErr
+	}
+	if ctx.Err() != nil {
+		err = contextError(ctx, "copy "+remotePath)
+	}
+	if s.log != nil {
+		_, _ = fmt.Fprintf(s.log, "# exit: %v\n", exitStatus(err))
+	}
+	return err
 }
 
-func NewDryRunCmdOperator(ctx *pkg.CmdOperatorCtx) (pkg.CmdOperator, error) {
-	client, err := ssh.Dial("tcp", ctx.Address, ctx.SSHClientConfig)
+// Receives one file from scp -f, acknowledging each message on w.
+func receiveFile(w io.Writer, r *bufio.Reader, create func(size int64, mode os.FileMode) (io.Writer, error)) error {
+	ack := func() error {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	if err := ack(); err != nil {
+		return err
+	}
+	header, err := r.ReadString('\n')
 	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf("failed to connect to %s", ctx.Address))
+		return err
+	}
+	if header[0] == 1 || header[0] == 2 {
+		return fmt.Errorf("%s", strings.TrimSpace(header[1:]))
+	}
+	var mode uint32
+	var size int64
+	var name string
+	if _, err = fmt.Sscanf(header, "C%o %d %s", &mode, &size, &name); err != nil {
+		return fmt.Errorf("unexpected scp header %q", header)
+	}
+	out, err := create(size, os.FileMode(mode))
+	if err != nil {
+		return err
+	}
+	if err = ack(); err != nil {
+		return err
 	}
-	defer client.Close()
+	if _, err = io.CopyN(out, r, size); err != nil {
+		return err
+	}
+	if status, err := r.ReadByte(); err != nil {
+		return err
+	} else if status != 0 {
+		message, _ := r.ReadString('\n')
+		return fmt.Errorf("%s", strings.TrimSpace(message))
+	}
+	return ack()
+}
 
-	return &dryRunCmdRunner{}, nil
+// Quotes path for the remote shell, a leading ~/ is kept unquoted so it
+// expands to the home directory.
+func QuotePath(path string) string {
+	home := ""
+	if strings.HasPrefix(path, "~/") {
+		home, path = "~/", path[2:]
+	}
+	if path == "" || strings.Trim(path, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789/._-+:=@,%") == "" {
+		return home + path
+	}
+	return home + "'" + strings.Replace(path, "'", `'\''`, -1) + "'"
 }
 
-func sshAgent(publicKeyPath string) (ssh.AuthMethod, func() error) {
-	if sshAgentConn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
-		sshAgent := agent.NewClient(sshAgentConn)
+// Returns the reason ctx is done, wrapping pkg.ErrTimeout on deadline.
+func contextError(ctx context.Context, command string) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w: %s", pkg.ErrTimeout, command)
+	}
+	return fmt.Errorf("%w: %s", ctx.Err(), command)
+}
 
-		keys, _ := sshAgent.List()
-		if len(keys) == 0 {
-			return nil, sshAgentConn.Close
-		}
+// Returns the exit status of a command run with err.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return exitErr.ExitStatus()
+	}
+	return -1
+}
 
-		pubkey, err := ioutil.ReadFile(publicKeyPath)
-		if err != nil {
-			return nil, sshAgentConn.Close
-		}
+// Serializes writes from the stdout and stderr copies.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
 
-		authkey, _, _, _, err := ssh.ParseAuthorizedKey(pubkey)
-		if err != nil {
-			return nil, sshAgentConn.Close
-		}
-		parsedkey := authkey.Marshal()
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// Wraps a dial error in a pkg.NodeError, rejected credentials are reported
+// as pkg.ErrAuthFailed.
+func dialError(address string, err error) error {
+	if strings.Contains(err.Error(), "unable to authenticate") {
+		err = fmt.Errorf("%w: %v", pkg.ErrAuthFailed, err)
+	}
+	return &pkg.NodeError{Address: address, Op: "connect to", Err: err}
+}
 
-		for _, key := range keys {
-			if bytes.Equal(key.Blob, parsedkey) {
-				return ssh.PublicKeysCallback(sshAgent.Signers), sshAgentConn.Close
-			}
+func NewCmdOperator(ctx *pkg.CmdOperatorCtx) (pkg.CmdOperator, error) {
+	client, jump, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newCmdRunner(ctx, client, jump), nil
+}
+
+// Connects to the address of ctx, through the jump host if there is one. The
+// jump host connection is nil when connected directly.
+func dial(ctx *pkg.CmdOperatorCtx) (*ssh.Client, *ssh.Client, error) {
+	if ctx.JumpHost != "" {
+		return dialThrough(ctx)
+	}
+	client, err := ssh.Dial("tcp", ctx.Address, ctx.SSHClientConfig)
+	if err != nil {
+		return nil, nil, dialError(ctx.Address, err)
+	}
+	return client, nil, nil
+}
+
+// Connects to the jump host and from there to the address of ctx. The jump
+// host is authenticated with the same config, except for the user when
+// given as user@host.
+func dialThrough(ctx *pkg.CmdOperatorCtx) (*ssh.Client, *ssh.Client, error) {
+	jumpConfig := *ctx.SSHClientConfig
+	jumpAddress := ctx.JumpHost
+	if i := strings.LastIndex(jumpAddress, "@"); i >= 0 {
+		jumpConfig.User = jumpAddress[:i]
+		jumpAddress = jumpAddress[i+1:]
+	}
+	if _, _, err := net.SplitHostPort(jumpAddress); err != nil {
+		jumpAddress = net.JoinHostPort(jumpAddress, "22")
+	}
+
+	jump, err := ssh.Dial("tcp", jumpAddress, &jumpConfig)
+	if err != nil {
+		return nil, nil, dialError(jumpAddress, err)
+	}
+	conn, err := jump.Dial("tcp", ctx.Address)
+	if err != nil {
+		_ = jump.Close()
+		return nil, nil, dialError(ctx.Address, fmt.Errorf("through %s: %v", jumpAddress, err))
+	}
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, ctx.Address, ctx.SSHClientConfig)
+	if err != nil {
+		_ = conn.Close()
+		_ = jump.Close()
+		return nil, nil, dialError(ctx.Address, err)
+	}
+	return ssh.NewClient(clientConn, channels, requests), jump, nil
+}
+
+func newCmdRunner(ctx *pkg.CmdOperatorCtx, client, jump *ssh.Client) *cmdRunner {
+	cmdOperator := cmdRunner{
+		writeToStdOut: ctx.EnableStdOut,
+		client:        client,
+		jump:          jump,
+	}
+	if ctx.Log != nil {
+		cmdOperator.log = &syncWriter{w: ctx.Log}
+	}
+	if onLine := ctx.OnLine; onLine != nil {
+		// Serializes the calls from the stdout and stderr copies.
+		mu := sync.Mutex{}
+		cmdOperator.onLine = func(line string, stderr bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			onLine(line, stderr)
 		}
 	}
-	return nil, func() error { return nil }
+
+	return &cmdOperator
 }
@@ -22,17 +22,24 @@ THE SOFTWARE.
 package ssh
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/TheNatureOfSoftware/k3pi/pkg/ssh/sshtest"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCreateSshSettings(t *testing.T) {
-	sshSettings := &Settings{KeyPath: "", Port: "22", User: ""}
+	sshSettings := &Settings{KeyPaths: nil, Port: "22", User: ""}
 	if sshSettings == nil {
 		t.Fail()
 	}
@@ -56,7 +63,7 @@ func TestLoadPublicKey(t *testing.T) {
 		return
 	}
 
-	sshSettings := &Settings{KeyPath: keyFile}
+	sshSettings := &Settings{KeyPaths: []string{keyFile}}
 	publicKey, closeHandler, err := LoadPublicKey(sshSettings)
 	if closeHandler == nil {
 		t.Error("close handler is nil")
@@ -68,27 +75,231 @@ func TestLoadPublicKey(t *testing.T) {
 	}
 }
 
-func TestRunCommand(t *testing.T) {
-	t.Skip("manual test")
-	settings := &Settings{User: "tnos", KeyPath: "~/.ssh/id_rsa", Port: "22"}
-	config, closeHandler, _ := NewClientConfig(settings)
-
-	defer closeHandler()
+func startPi(t *testing.T) *sshtest.Server {
+	pi := sshtest.NewPi("black-pearl")
+	pi.Password = "hypriot"
+	if err := pi.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return pi
+}
 
-	ctx := &pkg.CmdOperatorCtx{
-		Address:         fmt.Sprintf("%s:%s", "192.168.1.31", settings.Port),
+func connectPi(t *testing.T, pi *sshtest.Server) pkg.CmdOperator {
+	config, _ := PasswordClientConfig("pirate", "hypriot")
+	cmdOperator, err := NewCmdOperator(&pkg.CmdOperatorCtx{
+		Address:         pi.Addr(),
 		SSHClientConfig: config,
 		EnableStdOut:    false,
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
-	cmdOperator, _ := NewCmdOperator(ctx)
+	return cmdOperator
+}
+
+func TestRunCommand(t *testing.T) {
+	pi := startPi(t)
+	defer pi.Close()
+	cmdOperator := connectPi(t, pi)
 	defer cmdOperator.Close()
 
 	result, err := cmdOperator.Execute("echo hello")
 	if err != nil {
-		t.Errorf("command execution failed: %d", err)
+		t.Errorf("command execution failed: %v", err)
 	}
 
 	if string(result.StdOut) != "hello\n" {
 		t.Fail()
 	}
 }
+
+func TestRunCommand_Failed(t *testing.T) {
+	pi := startPi(t)
+	defer pi.Close()
+	cmdOperator := connectPi(t, pi)
+	defer cmdOperator.Close()
+
+	result, err := cmdOperator.Execute("cat /missing")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	if result.ExitCode != 1 || !strings.Contains(string(result.StdErr), "No such file") {
+		t.Errorf("expected exit code 1 and stderr, actual: %v", result)
+	}
+}
+
+func TestRunCommand_Timeout(t *testing.T) {
+	pi := startPi(t)
+	defer pi.Close()
+	cmdOperator := connectPi(t, pi)
+	defer cmdOperator.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err := cmdOperator.ExecuteContext(ctx, "sleep 10")
+
+	if !errors.Is(err, pkg.ErrTimeout) {
+		t.Errorf("expected ErrTimeout, got: %v", err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	pi := startPi(t)
+	defer pi.Close()
+	cmdOperator := connectPi(t, pi)
+	defer cmdOperator.Close()
+
+	err := cmdOperator.Copy(context.Background(), strings.NewReader("hostname: k3-node1\n"), "~/config.yaml", 19, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content, _ := pi.File("~/config.yaml"); string(content) != "hostname: k3-node1\n" {
+		t.Errorf("unexpected content: %q", content)
+	}
+	if mode := pi.FileMode("~/config.yaml"); mode != 0600 {
+		t.Errorf("expected mode 0600, actual: %04o", mode)
+	}
+}
+
+func TestCopy_Directory(t *testing.T) {
+	pi := startPi(t)
+	defer pi.Close()
+	cmdOperator := connectPi(t, pi)
+	defer cmdOperator.Close()
+
+	err := cmdOperator.Copy(context.Background(), strings.NewReader("mirrors: {}\n"), "~/it's here/", 12, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content, ok := pi.File("~/it's here/it's here"); !ok || string(content) != "mirrors: {}\n" {
+		t.Errorf("expected the file to keep the unquoted base name, actual: %q", content)
+	}
+}
+
+func TestCopyFrom(t *testing.T) {
+	pi := startPi(t)
+	defer pi.Close()
+	cmdOperator := connectPi(t, pi)
+	defer cmdOperator.Close()
+
+	err := cmdOperator.Copy(context.Background(), strings.NewReader("mirrors: {}\n"), "~/k3s config/it's.yaml", 12, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var content strings.Builder
+	err = cmdOperator.CopyFrom(context.Background(), "~/k3s config/it's.yaml", func(size int64, mode os.FileMode) (io.Writer, error) {
+		if size != 12 || mode != 0640 {
+			t.Errorf("expected 12 bytes with mode 0640, actual: %d bytes with mode %04o", size, mode)
+		}
+		return &content, nil
+	})
+	if err != nil || content.String() != "mirrors: {}\n" {
+		t.Errorf("unexpected content: %q, %v", content.String(), err)
+	}
+
+	err = cmdOperator.CopyFrom(context.Background(), "/missing", func(size int64, mode os.FileMode) (io.Writer, error) {
+		t.Error("expected no file to be created")
+		return ioutil.Discard, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "No such file") {
+		t.Errorf("expected the scp error, actual: %v", err)
+	}
+}
+
+func TestQuotePath(t *testing.T) {
+	for path, quoted := range map[string]string{
+		"/etc/os-release":    "/etc/os-release",
+		"~/config.yaml":      "~/config.yaml",
+		"~/":                 "~/",
+		"/tmp/my file":       "'/tmp/my file'",
+		"~/it's; rm -rf ~":   `~/'it'\''s; rm -rf ~'`,
+		"/var/lib/$(whoami)": "'/var/lib/$(whoami)'",
+	} {
+		if actual := QuotePath(path); actual != quoted {
+			t.Errorf("expected %s for %s, actual: %s", quoted, path, actual)
+		}
+	}
+}
+
+func TestNewCmdOperator_AuthFailed(t *testing.T) {
+	pi := startPi(t)
+	defer pi.Close()
+
+	config, _ := PasswordClientConfig("pirate", "wrong")
+	_, err := NewCmdOperator(&pkg.CmdOperatorCtx{Address: pi.Addr(), SSHClientConfig: config})
+
+	if !errors.Is(err, pkg.ErrAuthFailed) {
+		t.Errorf("expected ErrAuthFailed, got: %v", err)
+	}
+}
+
+func TestDialError_AuthFailed(t *testing.T) {
+	err := dialError("10.0.0.1:22", fmt.Errorf("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey], no supported methods remain"))
+
+	if !errors.Is(err, pkg.ErrAuthFailed) {
+		t.Errorf("expected ErrAuthFailed, got: %v", err)
+	}
+	var nodeErr *pkg.NodeError
+	if !errors.As(err, &nodeErr) || nodeErr.Address != "10.0.0.1:22" {
+		t.Errorf("expected NodeError for 10.0.0.1:22, got: %v", err)
+	}
+}
+
+func TestDialError_Other(t *testing.T) {
+	err := dialError("10.0.0.1:22", fmt.Errorf("dial tcp 10.0.0.1:22: connect: connection refused"))
+
+	if errors.Is(err, pkg.ErrAuthFailed) {
+		t.Errorf("expected no ErrAuthFailed, got: %v", err)
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := &lineWriter{stderr: true, onLine: func(line string, stderr bool) {
+		if !stderr {
+			t.Errorf("expected stderr line: %s", line)
+		}
+		lines = append(lines, line)
+	}}
+
+	_, _ = w.Write([]byte("x etc/\r\nx etc/os-"))
+	_, _ = w.Write([]byte("release\nx k3os"))
+	w.flush()
+
+	expected := []string{"x etc/", "x etc/os-release", "x k3os"}
+	if !reflect.DeepEqual(expected, lines) {
+		t.Errorf("expected %v, actual: %v", expected, lines)
+	}
+}
+
+func TestNewCmdOperator_JumpHost(t *testing.T) {
+	bastion := sshtest.NewPi("bastion")
+	if err := bastion.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer bastion.Close()
+	pi := startPi(t)
+	defer pi.Close()
+
+	config, _ := PasswordClientConfig("pirate", "hypriot")
+	cmdOperator, err := NewCmdOperator(&pkg.CmdOperatorCtx{
+		Address:         pi.Addr(),
+		SSHClientConfig: config,
+		JumpHost:        "admin@" + bastion.Addr(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmdOperator.Close()
+
+	result, err := cmdOperator.Execute("hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostname := strings.TrimSpace(string(result.StdOut)); hostname != "black-pearl" {
+		t.Errorf("expected black-pearl, actual: %s", hostname)
+	}
+}
@@ -0,0 +1,775 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package sshtest runs in-memory ssh servers on localhost that emulate a
+// Raspberry Pi, so scan and install can be tested without real nodes.
+package sshtest
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/TheNatureOfSoftware/k3pi/pkg"
+	"github.com/kubernetes-sigs/yaml"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Runs a command, writes its output and returns the exit status.
+type Handler func(command string, stdout, stderr io.Writer) int
+
+const (
+	// Path of the k3os config written by the installer, read-only once the
+	// Pi runs k3os.
+	K3osConfigFile = "/k3os/system/config.yaml"
+	// Path of the k3os config that overrides K3osConfigFile.
+	K3osRuntimeConfigFile = "/var/lib/rancher/k3os/config.yaml"
+
+	raspbianOSRelease = "PRETTY_NAME=\"Raspbian GNU/Linux 10 (buster)\"\nID=raspbian\n"
+	k3osOSRelease     = "PRETTY_NAME=\"k3OS v0.3.0\"\nID=k3os\n"
+)
+
+// An ssh server emulating a Pi. Configure the exported fields before Start,
+// the emulation changes the hostname when it boots into k3os.
+type Server struct {
+	// Output of uname -m.
+	Arch     string
+	Hostname string
+	// When false sudo fails asking for a password.
+	Sudo bool
+	// Required password, any password is accepted when empty.
+	Password string
+	// Accepted public keys, any key is accepted when nil and no key when empty.
+	AuthorizedKeys []ssh.PublicKey
+	// When set, user certificates signed by this CA are accepted.
+	UserCA ssh.PublicKey
+	// When true, keys are checked against ~/.ssh/authorized_keys instead.
+	AuthorizedKeysFile bool
+	// Commands found by command -v.
+	Tools []string
+	// Available KB in the home directory reported by df.
+	DiskFreeKB int64
+	// Time the node refuses connections while rebooting.
+	RebootDelay time.Duration
+
+	mu       sync.Mutex
+	files    map[string][]byte
+	modes    map[string]os.FileMode
+	handlers map[string]Handler
+	listener net.Listener
+	conns    map[ssh.Conn]bool
+	down     bool
+	reboots  int
+	pty      Pty
+}
+
+// The pseudo terminal of the last shell session, the size follows window
+// changes.
+type Pty struct {
+	Term          string
+	Width, Height int
+}
+
+// Creates a server emulating a Pi running Raspbian, call Start to listen.
+func NewPi(hostname string) *Server {
+	return &Server{
+		Arch:        "armv7l",
+		Hostname:    hostname,
+		Sudo:        true,
+		Tools:       []string{"bash", "scp", "sha256sum", "sync", "tar"},
+		DiskFreeKB:  4 * 1024 * 1024,
+		RebootDelay: time.Millisecond * 100,
+		files: map[string][]byte{
+			"/etc/os-release":         []byte(raspbianOSRelease),
+			"/proc/device-tree/model": []byte("Raspberry Pi 3 Model B Rev 1.2\x00"),
+		},
+		modes:    make(map[string]os.FileMode),
+		handlers: make(map[string]Handler),
+		conns:    make(map[ssh.Conn]bool),
+	}
+}
+
+// Listens on a random port on localhost.
+func (s *Server) Start() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return err
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if s.Password != "" && s.Password != string(password) {
+				return nil, fmt.Errorf("wrong password for %s", conn.User())
+			}
+			return nil, nil
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if _, ok := key.(*ssh.Certificate); ok && s.UserCA != nil {
+				checker := &ssh.CertChecker{IsUserAuthority: func(auth ssh.PublicKey) bool {
+					return string(auth.Marshal()) == string(s.UserCA.Marshal())
+				}}
+				return checker.Authenticate(conn, key)
+			}
+			authorizedKeys := s.AuthorizedKeys
+			if s.AuthorizedKeysFile {
+				authorizedKeys = s.authorizedKeys()
+			} else if authorizedKeys == nil {
+				return nil, nil
+			}
+			for _, authorized := range authorizedKeys {
+				if string(authorized.Marshal()) == string(key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	go s.accept(config)
+	return nil
+}
+
+// Parses the keys in ~/.ssh/authorized_keys.
+func (s *Server) authorizedKeys() []ssh.PublicKey {
+	var keys []ssh.PublicKey
+	rest, _ := s.File("~/.ssh/authorized_keys")
+	for len(rest) > 0 {
+		key, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			break
+		}
+		keys = append(keys, key)
+		rest = next
+	}
+	return keys
+}
+
+// Stops listening and closes all connections.
+func (s *Server) Close() {
+	_ = s.listener.Close()
+	s.closeConns()
+}
+
+// Returns the host:port the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Returns the port the server listens on.
+func (s *Server) Port() string {
+	_, port, _ := net.SplitHostPort(s.Addr())
+	return port
+}
+
+// Runs handler for commands starting with prefix instead of the emulation,
+// sudo is removed from the command before it is matched.
+func (s *Server) Handle(prefix string, handler Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[prefix] = handler
+}
+
+// Returns the content of a file, paths relative to the home directory
+// start with ~/.
+func (s *Server) File(path string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	content, ok := s.files[s.path(path)]
+	return content, ok
+}
+
+func (s *Server) SetFile(path string, content []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[s.path(path)] = content
+}
+
+// Returns the mode of a file copied with scp, cp or changed with chmod, 0644
+// for other files.
+func (s *Server) FileMode(path string) os.FileMode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if mode, ok := s.modes[s.path(path)]; ok {
+		return mode
+	}
+	return 0644
+}
+
+func (s *Server) setFileMode(path string, mode os.FileMode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.modes[s.path(path)] = mode
+}
+
+// Returns the current hostname, it changes when the Pi boots into k3os.
+func (s *Server) CurrentHostname() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Hostname
+}
+
+// Returns the number of times the Pi has rebooted.
+func (s *Server) Reboots() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reboots
+}
+
+// Returns the pseudo terminal of the last shell session.
+func (s *Server) Pty() Pty {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pty
+}
+
+// Drops all connections and refuses new ones for RebootDelay. When a k3os
+// config is installed the Pi boots into k3os with the configured hostname.
+func (s *Server) Reboot() {
+	s.mu.Lock()
+	s.down = true
+	s.reboots++
+	s.mu.Unlock()
+	s.closeConns()
+
+	time.AfterFunc(s.RebootDelay, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		config, ok := s.files[K3osRuntimeConfigFile]
+		if !ok {
+			config, ok = s.files[K3osConfigFile]
+		}
+		if ok {
+			cloudConfig := struct {
+				Hostname string `json:"hostname"`
+			}{}
+			if err := yaml.Unmarshal(config, &cloudConfig); err == nil && cloudConfig.Hostname != "" {
+				s.Hostname = cloudConfig.Hostname
+			}
+			s.files["/etc/os-release"] = []byte(k3osOSRelease)
+		}
+		s.down = false
+	})
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+func (s *Server) accept(config *ssh.ServerConfig) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		down := s.down
+		s.mu.Unlock()
+		if down {
+			_ = conn.Close()
+			continue
+		}
+		go s.serve(conn, config)
+	}
+}
+
+func (s *Server) serve(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	s.mu.Lock()
+	s.conns[serverConn] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, serverConn)
+		s.mu.Unlock()
+		_ = serverConn.Close()
+	}()
+
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "session":
+			channel, channelRequests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go s.session(channel, channelRequests)
+		case "direct-tcpip":
+			go forward(newChannel)
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only sessions and forwarding are supported")
+		}
+	}
+}
+
+// Forwards a direct-tcpip channel, so the server can act as a jump host.
+func forward(newChannel ssh.NewChannel) {
+	var target struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	go func() {
+		_, _ = io.Copy(conn, channel)
+		_ = conn.Close()
+	}()
+	_, _ = io.Copy(channel, conn)
+	_ = channel.Close()
+}
+
+// Serves the requests of a session, only exec is supported.
+func (s *Server) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	killed := make(chan struct{})
+	killOnce := sync.Once{}
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			exec := struct{ Command string }{}
+			if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			go func() {
+				status := s.exec(exec.Command, channel, killed)
+				select {
+				case <-killed:
+				default:
+					_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+				}
+				_ = channel.Close()
+			}()
+		case "shell":
+			_ = req.Reply(true, nil)
+			go func() {
+				status := s.shell(channel, killed)
+				_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+				_ = channel.Close()
+			}()
+		case "pty-req":
+			pty := struct {
+				Term                         string
+				Columns, Rows, Width, Height uint32
+				Modes                        string
+			}{}
+			_ = ssh.Unmarshal(req.Payload, &pty)
+			s.mu.Lock()
+			s.pty = Pty{Term: pty.Term, Width: int(pty.Columns), Height: int(pty.Rows)}
+			s.mu.Unlock()
+			_ = req.Reply(true, nil)
+		case "window-change":
+			size := struct{ Columns, Rows, Width, Height uint32 }{}
+			_ = ssh.Unmarshal(req.Payload, &size)
+			s.mu.Lock()
+			s.pty.Width, s.pty.Height = int(size.Columns), int(size.Rows)
+			s.mu.Unlock()
+		case "signal":
+			killOnce.Do(func() { close(killed) })
+		default:
+			if req.WantReply {
+				_ = req.Reply(req.Type == "env", nil)
+			}
+		}
+	}
+	killOnce.Do(func() { close(killed) })
+}
+
+// Runs the commands separated by &&, stops at the first failing command.
+func (s *Server) exec(command string, channel ssh.Channel, killed <-chan struct{}) int {
+	if strings.HasPrefix(command, "scp -qt ") || strings.HasPrefix(command, "scp -t ") {
+		fields := splitArgs(command)
+		return s.scpSink(fields[len(fields)-1], channel)
+	}
+	if strings.HasPrefix(command, "scp -f ") {
+		fields := splitArgs(command)
+		return s.scpSource(fields[len(fields)-1], channel)
+	}
+	for _, part := range strings.Split(command, "&&") {
+		if status := s.run(strings.TrimSpace(part), channel, channel.Stderr(), killed); status != 0 {
+			return status
+		}
+	}
+	return 0
+}
+
+// Runs each line read from the channel as a command until exit or the end of
+// the input, returns the status of the last command.
+func (s *Server) shell(channel ssh.Channel, killed <-chan struct{}) int {
+	status := 0
+	scanner := bufio.NewScanner(channel)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "exit" {
+			break
+		} else if line != "" {
+			status = s.exec(line, channel, killed)
+		}
+	}
+	return status
+}
+
+func (s *Server) run(command string, stdout, stderr io.Writer, killed <-chan struct{}) int {
+	if strings.HasPrefix(command, "sudo ") {
+		if !s.Sudo {
+			_, _ = fmt.Fprintln(stderr, "sudo: a password is required")
+			return 1
+		}
+		command = strings.TrimPrefix(strings.TrimPrefix(command, "sudo "), "-n ")
+	}
+
+	s.mu.Lock()
+	for prefix, handler := range s.handlers {
+		if strings.HasPrefix(command, prefix) {
+			s.mu.Unlock()
+			return handler(command, stdout, stderr)
+		}
+	}
+	s.mu.Unlock()
+
+	fields := splitArgs(command)
+	if len(fields) == 0 {
+		return 0
+	}
+	switch fields[0] {
+	case "true", "sync", "ping", "timeout", "mkdir", "chown":
+		return 0
+	case "uname":
+		_, _ = fmt.Fprintln(stdout, s.Arch)
+	case "hostname":
+		_, _ = fmt.Fprintln(stdout, s.CurrentHostname())
+	case "date":
+		_, _ = fmt.Fprintln(stdout, time.Now().Unix())
+	case "df":
+		_, _ = fmt.Fprintf(stdout, "/dev/root 30000000 1000000 %d 4%% /home/pi\n", s.DiskFreeKB)
+	case "command":
+		for _, tool := range s.Tools {
+			if tool == fields[len(fields)-1] {
+				_, _ = fmt.Fprintf(stdout, "/usr/bin/%s\n", tool)
+				return 0
+			}
+		}
+		return 1
+	case "echo":
+		if strings.Contains(command, "| sha256sum -c -") {
+			return s.checkSum(command, stdout)
+		}
+		_, _ = fmt.Fprintln(stdout, strings.Trim(strings.TrimPrefix(command, "echo "), `'"`))
+	case "cat":
+		content, ok := s.File(fields[len(fields)-1])
+		if !ok {
+			_, _ = fmt.Fprintf(stderr, "cat: %s: No such file or directory\n", fields[len(fields)-1])
+			return 1
+		}
+		_, _ = stdout.Write(content)
+	case "cp":
+		content, ok := s.File(fields[1])
+		if !ok {
+			_, _ = fmt.Fprintf(stderr, "cp: cannot stat '%s': No such file or directory\n", fields[1])
+			return 1
+		}
+		if s.readOnly(fields[2], stderr) {
+			return 1
+		}
+		s.SetFile(fields[2], content)
+		s.setFileMode(fields[2], s.FileMode(fields[1]))
+	case "mv":
+		content, ok := s.File(fields[len(fields)-2])
+		if !ok {
+			_, _ = fmt.Fprintf(stderr, "mv: cannot stat '%s': No such file or directory\n", fields[len(fields)-2])
+			return 1
+		}
+		if s.readOnly(fields[len(fields)-1], stderr) {
+			return 1
+		}
+		s.SetFile(fields[len(fields)-1], content)
+		s.setFileMode(fields[len(fields)-1], s.FileMode(fields[len(fields)-2]))
+		s.mu.Lock()
+		delete(s.files, s.path(fields[len(fields)-2]))
+		s.mu.Unlock()
+	case "rm":
+		s.mu.Lock()
+		for _, path := range fields[1:] {
+			delete(s.files, s.path(path))
+			delete(s.modes, s.path(path))
+		}
+		s.mu.Unlock()
+	case "chmod":
+		mode, err := strconv.ParseUint(fields[1], 8, 32)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "chmod: invalid mode: '%s'\n", fields[1])
+			return 1
+		}
+		if _, ok := s.File(fields[2]); !ok {
+			_, _ = fmt.Fprintf(stderr, "chmod: cannot access '%s': No such file or directory\n", fields[2])
+			return 1
+		}
+		s.setFileMode(fields[2], os.FileMode(mode))
+	case "tar":
+		if _, ok := s.File(fields[2]); !ok {
+			_, _ = fmt.Fprintf(stderr, "tar: %s: Cannot open: No such file or directory\n", fields[2])
+			return 2
+		}
+		for _, extracted := range []string{"k3os/", "k3os/system/", "k3os/system/k3os/current/k3os"} {
+			_, _ = fmt.Fprintln(stdout, extracted)
+		}
+	case "reboot":
+		go s.Reboot()
+	case "sleep":
+		seconds, _ := strconv.Atoi(fields[1])
+		select {
+		case <-time.After(time.Duration(seconds) * time.Second):
+		case <-killed:
+			return 137
+		}
+	default:
+		_, _ = fmt.Fprintf(stderr, "sh: %s: not found\n", fields[0])
+		return 127
+	}
+	return 0
+}
+
+// Emulates echo '<sum>  <file>' | sha256sum -c -.
+func (s *Server) checkSum(command string, stdout io.Writer) int {
+	line := strings.Trim(strings.TrimSpace(strings.SplitN(strings.TrimPrefix(command, "echo "), "|", 2)[0]), `'"`)
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return 1
+	}
+	content, ok := s.File(fields[1])
+	if !ok || fmt.Sprintf("%x", sha256.Sum256(content)) != fields[0] {
+		_, _ = fmt.Fprintf(stdout, "%s: FAILED\n", fields[1])
+		return 1
+	}
+	_, _ = fmt.Fprintf(stdout, "%s: OK\n", fields[1])
+	return 0
+}
+
+// Receives one file sent by scp -t, a path ending with a slash is a directory
+// the file is written to by the name it was sent with.
+func (s *Server) scpSink(path string, channel ssh.Channel) int {
+	ack := func() { _, _ = channel.Write([]byte{0}) }
+	ack()
+
+	header := ""
+	b := make([]byte, 1)
+	for {
+		if _, err := channel.Read(b); err != nil {
+			return 1
+		}
+		if b[0] == '\n' {
+			break
+		}
+		header += string(b)
+	}
+	fields := strings.SplitN(header, " ", 3)
+	if len(fields) != 3 || !strings.HasPrefix(fields[0], "C") {
+		return 1
+	}
+	mode, err := strconv.ParseUint(fields[0][1:], 8, 32)
+	if err != nil {
+		return 1
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 1
+	}
+	ack()
+
+	content := make([]byte, size)
+	if _, err := io.ReadFull(channel, content); err != nil {
+		return 1
+	}
+	if _, err := channel.Read(b); err != nil {
+		return 1
+	}
+	if strings.HasSuffix(path, "/") {
+		path += fields[2]
+	}
+	if s.readOnly(path, channel.Stderr()) {
+		return 1
+	}
+	ack()
+	s.SetFile(path, content)
+	s.setFileMode(path, os.FileMode(mode))
+	return 0
+}
+
+// Reports a write to path that fails because k3os mounts /k3os/system
+// read-only.
+func (s *Server) readOnly(path string, stderr io.Writer) bool {
+	osRelease, _ := s.File("/etc/os-release")
+	if !strings.Contains(string(osRelease), "ID=k3os") || !strings.HasPrefix(path, "/k3os/system/") {
+		return false
+	}
+	_, _ = fmt.Fprintf(stderr, "%s: Read-only file system\n", path)
+	return true
+}
+
+// Sends one file to scp -f.
+func (s *Server) scpSource(path string, channel ssh.Channel) int {
+	b := make([]byte, 1)
+	if _, err := channel.Read(b); err != nil {
+		return 1
+	}
+	content, ok := s.File(path)
+	if !ok {
+		_, _ = fmt.Fprintf(channel, "\x01scp: %s: No such file or directory\n", path)
+		return 1
+	}
+	_, _ = fmt.Fprintf(channel, "C%04o %d %s\n", s.FileMode(path), len(content), filepath.Base(path))
+	if _, err := channel.Read(b); err != nil || b[0] != 0 {
+		return 1
+	}
+	_, _ = channel.Write(content)
+	_, _ = channel.Write([]byte{0})
+	if _, err := channel.Read(b); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// Splits a command into arguments like sh, supporting single quotes and
+// backslash escapes.
+func splitArgs(command string) []string {
+	var args []string
+	var arg strings.Builder
+	inArg, quoted, escaped := false, false, false
+	for _, c := range command {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case quoted:
+			if c == '\'' {
+				quoted = false
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\'':
+			quoted, inArg = true, true
+		case c == '\\':
+			escaped, inArg = true, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args
+}
+
+// Paths relative to the home directory are kept with a ~/ prefix.
+func (s *Server) path(path string) string {
+	if strings.HasPrefix(path, "/") || strings.HasPrefix(path, "~/") {
+		return path
+	}
+	return "~/" + path
+}
+
+// Returns a factory function that connects to the server registered for
+// the requested host:port, or else for its host, other addresses are dialed
+// unchanged.
+func Rewrite(create func(ctx *pkg.CmdOperatorCtx) (pkg.CmdOperator, error), servers map[string]*Server) func(ctx *pkg.CmdOperatorCtx) (pkg.CmdOperator, error) {
+	return func(ctx *pkg.CmdOperatorCtx) (pkg.CmdOperator, error) {
+		host, _, err := net.SplitHostPort(ctx.Address)
+		if err != nil {
+			host = ctx.Address
+		}
+		server, ok := servers[ctx.Address]
+		if !ok {
+			server, ok = servers[host]
+		}
+		if ok {
+			rewritten := *ctx
+			rewritten.Address = server.Addr()
+			return create(&rewritten)
+		}
+		return create(ctx)
+	}
+}
+
+// Writes a new private key to dir/id_ecdsa and returns its path.
+func WriteKey(dir string) (string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "id_ecdsa")
+	err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), os.FileMode(0600))
+	return path, err
+}
@@ -0,0 +1,74 @@
+/*
+Copyright © 2019 The Nature of Software Nordic AB <lars@thenatureofsoftware.se>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package sshtest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Reboot_Boots_K3os(t *testing.T) {
+	pi := NewPi("black-pearl")
+	pi.RebootDelay = time.Millisecond * 10
+	if err := pi.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pi.Close()
+
+	pi.SetFile(K3osConfigFile, []byte("hostname: k3-node1\n"))
+	pi.Reboot()
+	time.Sleep(time.Millisecond * 100)
+
+	if hostname := pi.CurrentHostname(); hostname != "k3-node1" {
+		t.Errorf("expected hostname k3-node1, actual: %s", hostname)
+	}
+	if osRelease, _ := pi.File("/etc/os-release"); !strings.Contains(string(osRelease), "ID=k3os") {
+		t.Errorf("expected k3os, actual: %s", osRelease)
+	}
+
+	pi.SetFile("config.yaml", []byte("hostname: k3-node2\n"))
+	stderr := &bytes.Buffer{}
+	if status := pi.run("sudo cp config.yaml "+K3osConfigFile, ioutil.Discard, stderr, nil); status == 0 {
+		t.Error("expected /k3os/system to be read-only")
+	}
+	if status := pi.run("sudo cp config.yaml "+K3osRuntimeConfigFile, ioutil.Discard, stderr, nil); status != 0 {
+		t.Fatalf("expected the runtime config to be written: %s", stderr)
+	}
+	pi.Reboot()
+	time.Sleep(time.Millisecond * 100)
+
+	if hostname := pi.CurrentHostname(); hostname != "k3-node2" {
+		t.Errorf("expected the runtime config to override the hostname, actual: %s", hostname)
+	}
+}
+
+func TestServer_Path(t *testing.T) {
+	pi := NewPi("black-pearl")
+	pi.SetFile("config.yaml", []byte("a"))
+
+	if _, ok := pi.File("~/config.yaml"); !ok {
+		t.Error("expected relative paths in the home directory")
+	}
+}